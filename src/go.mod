@@ -0,0 +1,14 @@
+module siot
+
+go 1.13
+
+require (
+	github.com/aws/aws-sdk-go v1.44.24
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/sirupsen/logrus v1.8.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	go.opentelemetry.io/otel v1.11.2
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.11.2
+	go.opentelemetry.io/otel/sdk v1.11.2
+	go.opentelemetry.io/otel/trace v1.11.2
+)
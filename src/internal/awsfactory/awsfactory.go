@@ -0,0 +1,92 @@
+/*
+Package awsfactory builds the AWS sessions of the serverless-iot-stack
+Lambdas from a single place, so that they can be pointed at a local
+emulator of the AWS APIs (LocalStack, moto) for the integration tests
+instead of the real endpoints.
+
+The endpoint is taken from the --aws-endpoint flag or from AWS_ENDPOINT,
+and is read from the command line before flag.Parse, since the clients
+are created in init. The region is AWS_REGION, falling back to REGION,
+and is left to the SDK resolution if neither is set.
+*/
+package awsfactory
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+
+	"siot/internal/config"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of Factory, endpoint and region every client of the process is created with
+type Factory struct {
+	Endpoint string
+	Region   string
+}
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+const (
+	ENDPOINT_FLAG = "aws-endpoint"
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// register the endpoint flag, so that it is accepted and documented by flag.Parse
+func EndpointFlag() {
+	flag.String(ENDPOINT_FLAG, Endpoint(), "Endpoint of every AWS client, e.g. http://localhost:4566 for LocalStack (the real ones if empty)")
+}
+
+// endpoint of the flag if given, of AWS_ENDPOINT otherwise, empty for the real endpoints
+func Endpoint() string {
+	return config.FlagFromArgs(os.Args[1:], ENDPOINT_FLAG, config.Lookup("AWS_ENDPOINT"))
+}
+
+// region shared by the clients, AWS_REGION or REGION if missing
+func Region() string {
+	return config.String("AWS_REGION", config.Lookup("REGION"))
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// factory resolved from the command line and the environment
+func New() Factory {
+	return Factory{Endpoint: Endpoint(), Region: Region()}
+}
+
+// configuration of a client, with the endpoint override if any; the S3 paths are used in that case,
+// since an emulator does not resolve the bucket subdomains
+func (f Factory) Config() *aws.Config {
+	cfg := aws.NewConfig()
+	if strings.Compare(f.Region, "") != 0 {
+		cfg = cfg.WithRegion(f.Region)
+	}
+	if strings.Compare(f.Endpoint, "") != 0 {
+		cfg = cfg.WithEndpoint(f.Endpoint).WithS3ForcePathStyle(true)
+	}
+	return cfg
+}
+
+// session of the clients, with the configuration of the factory
+func (f Factory) Session() *session.Session {
+	return session.Must(session.NewSession(f.Config()))
+}
+
+// report whether the clients are pointed at an endpoint other than the real ones
+func (f Factory) Overridden() bool {
+	return strings.Compare(f.Endpoint, "") != 0
+}
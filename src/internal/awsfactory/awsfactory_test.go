@@ -0,0 +1,91 @@
+package awsfactory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// type of stubEndpoint, answers every AWS call with an empty success and records the paths requested
+type stubEndpoint struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (s *stubEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.paths = append(s.paths, r.URL.Path)
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Write([]byte("{}"))
+}
+
+func (s *stubEndpoint) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.paths...)
+}
+
+// fake credentials, so that the requests are signed without looking for real ones
+var stubCredentials = &aws.Config{Credentials: credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")}
+
+func TestClientsUseTheEndpointOverride(t *testing.T) {
+	stub := &stubEndpoint{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	f := Factory{Endpoint: server.URL, Region: "eu-west-1"}
+	if !f.Overridden() {
+		t.Fatal("factory with an endpoint not reported as overridden")
+	}
+	sess := f.Session()
+	if region := aws.StringValue(sess.Config.Region); region != "eu-west-1" {
+		t.Errorf("expected the region of the factory, got %s", region)
+	}
+	if _, err := dynamodb.New(sess, stubCredentials).PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String("monitoring-table"),
+		Item:      map[string]*dynamodb.AttributeValue{"digest": {S: aws.String("c4ca4238")}},
+	}); err != nil {
+		t.Fatalf("dynamodb call not answered by the stub: %v", err)
+	}
+	if _, err := s3.New(sess, stubCredentials).PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("history-bucket"),
+		Key:    aws.String("381938912/1700000000"),
+		Body:   strings.NewReader("{}"),
+	}); err != nil {
+		t.Fatalf("s3 call not answered by the stub: %v", err)
+	}
+	// the bucket is in the path, an emulator does not resolve the bucket subdomains
+	if paths := stub.requested(); len(paths) != 2 || paths[1] != "/history-bucket/381938912/1700000000" {
+		t.Errorf("expected both calls on the stub, the bucket in the path, got %v", paths)
+	}
+}
+
+func TestRealEndpointsWithoutOverride(t *testing.T) {
+	f := Factory{Region: "eu-west-1"}
+	if f.Overridden() || f.Config().Endpoint != nil || f.Config().S3ForcePathStyle != nil {
+		t.Errorf("expected the real endpoints without an override")
+	}
+}
+
+func TestEndpointFlagWinsOverEnvironment(t *testing.T) {
+	savedArgs := os.Args
+	t.Cleanup(func() { os.Args = savedArgs })
+	t.Setenv("AWS_ENDPOINT", "http://localhost:4566")
+	os.Args = []string{"worker"}
+	if endpoint := Endpoint(); endpoint != "http://localhost:4566" {
+		t.Errorf("expected the endpoint of AWS_ENDPOINT, got %s", endpoint)
+	}
+	os.Args = []string{"worker", "--sinks", "dynamo", "--aws-endpoint", "http://localhost:5000"}
+	if endpoint := Endpoint(); endpoint != "http://localhost:5000" {
+		t.Errorf("expected the endpoint of the flag, got %s", endpoint)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Package codec encodes and decodes the readings exchanged between the
+simulator and the worker in one of the supported encodings: JSON, the
+default, or the compact binary CBOR and MessagePack, which save bandwidth
+on constrained, cellular-connected devices.
+
+The binary encodings reuse the json tags of the types, so the field names
+on the wire are the same whatever the encoding.
+*/
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+const (
+	JSON    = "json"
+	CBOR    = "cbor"
+	MSGPACK = "msgpack"
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// check that the encoding is a supported one
+func Valid(encoding string) error {
+	switch encoding {
+	case JSON, CBOR, MSGPACK:
+		return nil
+	}
+	return fmt.Errorf("unknown encoding: %s", encoding)
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// encode the value in the given encoding
+func Marshal(encoding string, v interface{}) ([]byte, error) {
+	switch encoding {
+	case JSON:
+		return json.Marshal(v)
+	case CBOR:
+		return cbor.Marshal(v)
+	case MSGPACK:
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		err := enc.Encode(v)
+		return buf.Bytes(), err
+	}
+	return nil, Valid(encoding)
+}
+
+// decode the data, given in the given encoding, into the value
+func Unmarshal(encoding string, data []byte, v interface{}) error {
+	switch encoding {
+	case JSON:
+		return json.Unmarshal(data, v)
+	case CBOR:
+		return cbor.Unmarshal(data, v)
+	case MSGPACK:
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	}
+	return Valid(encoding)
+}
@@ -0,0 +1,72 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+)
+
+// type of reading, shaped as the readings exchanged by the simulator and the worker
+type reading struct {
+	Device    string            `json:"device"`
+	Temp      float64           `json:"temperature"`
+	Hum       float64           `json:"humidity"`
+	Pressure  float64           `json:"pressure,omitempty"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := reading{Device: "381938912", Temp: 27.4312, Hum: 60.4312, Pressure: 1013.25, Timestamp: 1700000000000, Tags: map[string]string{"floor": "3"}}
+	for _, encoding := range []string{JSON, CBOR, MSGPACK} {
+		data, err := Marshal(encoding, &in)
+		if err != nil {
+			t.Fatalf("%s: marshal failed: %v", encoding, err)
+		}
+		var out reading
+		if err := Unmarshal(encoding, data, &out); err != nil {
+			t.Fatalf("%s: unmarshal failed: %v", encoding, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("%s: expected %+v, got %+v", encoding, in, out)
+		}
+	}
+}
+
+func TestFieldNamesFollowTheJSONTags(t *testing.T) {
+	in := reading{Device: "381938912", Temp: 21.5}
+	for _, encoding := range []string{CBOR, MSGPACK} {
+		data, _ := Marshal(encoding, &in)
+		var fields map[string]interface{}
+		if err := Unmarshal(encoding, data, &fields); err != nil {
+			t.Fatalf("%s: unmarshal failed: %v", encoding, err)
+		}
+		if fields["device"] != "381938912" || fields["temperature"] != 21.5 {
+			t.Errorf("%s: expected the json field names, got %v", encoding, fields)
+		}
+		if _, ok := fields["pressure"]; ok {
+			t.Errorf("%s: omitempty field encoded", encoding)
+		}
+	}
+}
+
+func TestBinaryEncodingsAreSmaller(t *testing.T) {
+	in := reading{Device: "381938912", Temp: 27.4312, Hum: 60.4312, Pressure: 1013.25, Timestamp: 1700000000000}
+	plain, _ := Marshal(JSON, &in)
+	for _, encoding := range []string{CBOR, MSGPACK} {
+		if data, _ := Marshal(encoding, &in); len(data) >= len(plain) {
+			t.Errorf("%s: %d bytes, not smaller than the %d of JSON", encoding, len(data), len(plain))
+		}
+	}
+}
+
+func TestUnknownEncoding(t *testing.T) {
+	if _, err := Marshal("protobuf", &reading{}); err == nil {
+		t.Error("expected marshal to refuse an unknown encoding")
+	}
+	if err := Unmarshal("protobuf", nil, &reading{}); err == nil {
+		t.Error("expected unmarshal to refuse an unknown encoding")
+	}
+	if err := Valid(JSON); err != nil {
+		t.Errorf("json refused: %v", err)
+	}
+}
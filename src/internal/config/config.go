@@ -0,0 +1,221 @@
+/*
+Package config resolves the configuration of the serverless-iot-stack
+binaries from the environment.
+
+Every variable is looked up first with a namespacing prefix (SIOT_ by
+default, or the one given with --env-prefix) and then with its bare name,
+so several instances can share a container or a CI environment without
+colliding, while the unprefixed names keep working as before.
+
+A value in the ssm:<parameter name> form is replaced by the value of the
+parameter in AWS SSM Parameter Store, fetched the first time it is looked
+up and cached for the lifetime of the process, so that the Lambdas can be
+tuned without a redeploy (the change is picked up by new containers).
+*/
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+var (
+	prefix    string
+	ssmMu     sync.Mutex
+	ssmSvc    *ssm.SSM
+	ssmCache  = map[string]string{}
+	ssmErrors []error
+)
+
+const (
+	DEFAULT_PREFIX = "SIOT_"
+	PREFIX_FLAG    = "env-prefix"
+	VALIDATE_FLAG  = "validate-only"
+	SSM_PREFIX     = "ssm:"
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// read the prefix from the command line before any variable is resolved
+func init() {
+	prefix = PrefixFromArgs(os.Args[1:], DEFAULT_PREFIX)
+}
+
+// scan the arguments for the env prefix flag, returning def if missing
+func PrefixFromArgs(args []string, def string) string {
+	return FlagFromArgs(args, PREFIX_FLAG, def)
+}
+
+// scan the arguments for the value of the flag, for the settings needed before flag.Parse, returning def if missing
+func FlagFromArgs(args []string, flagName string, def string) string {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if strings.Compare(name, arg) == 0 || strings.Compare(arg, "--") == 0 {
+			continue
+		}
+		if strings.HasPrefix(name, flagName+"=") {
+			return strings.TrimPrefix(name, flagName+"=")
+		}
+		if strings.Compare(name, flagName) == 0 && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return def
+}
+
+// register the env prefix flag, so that it is accepted and documented by flag.Parse
+func PrefixFlag() {
+	flag.String(PREFIX_FLAG, prefix, "Prefix checked before the unprefixed name of every environment variable")
+}
+
+// register the validate-only flag, to check the configuration and exit without connecting to anything
+func ValidateOnlyFlag() *bool {
+	return flag.Bool(VALIDATE_FLAG, false, "Validate the configuration, report the problems found and exit")
+}
+
+// the prefix currently in use
+func Prefix() string {
+	return prefix
+}
+
+// change the prefix used to resolve the variables
+func SetPrefix(p string) {
+	prefix = p
+}
+
+// value of the SSM parameter, fetched once and cached; on failure the error is kept for Validate and
+// the value is empty, so that the default applies
+func resolveSSM(name string, parameter string) string {
+	ssmMu.Lock()
+	defer ssmMu.Unlock()
+	if value, ok := ssmCache[parameter]; ok {
+		return value
+	}
+	if ssmSvc == nil {
+		ssmSvc = ssm.New(session.Must(session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})))
+	}
+	out, err := ssmSvc.GetParameter(&ssm.GetParameterInput{Name: aws.String(parameter), WithDecryption: aws.Bool(true)})
+	if err != nil {
+		ssmErrors = append(ssmErrors, fmt.Errorf("%s: cannot resolve SSM parameter %s: %v", name, parameter, err))
+		ssmCache[parameter] = ""
+		return ""
+	}
+	ssmCache[parameter] = aws.StringValue(out.Parameter.Value)
+	return ssmCache[parameter]
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// value of the prefixed variable if set, of the unprefixed one otherwise, resolved from SSM if in the ssm: form
+func Lookup(name string) string {
+	value, ok := "", false
+	if strings.Compare(prefix, "") != 0 {
+		value, ok = os.LookupEnv(prefix + name)
+	}
+	if !ok {
+		value = os.Getenv(name)
+	}
+	if strings.HasPrefix(value, SSM_PREFIX) {
+		return resolveSSM(name, strings.TrimPrefix(value, SSM_PREFIX))
+	}
+	return value
+}
+
+// string value of the variable, or def if empty
+func String(name string, def string) string {
+	value := Lookup(name)
+	if strings.Compare(value, "") == 0 {
+		return def
+	}
+	return value
+}
+
+// float value of the variable, or def if missing or not valid
+func Float(name string, def float64) float64 {
+	value, err := strconv.ParseFloat(Lookup(name), 64)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// integer value of the variable, or def if missing or not valid
+func Int(name string, def int64) int64 {
+	value, err := strconv.ParseInt(Lookup(name), 10, 64)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// boolean value of the variable, or def if missing or not valid
+func Bool(name string, def bool) bool {
+	value, err := strconv.ParseBool(Lookup(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// duration value of the variable, or def if missing or not valid
+func Duration(name string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(Lookup(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// error if the variable is not set
+func Required(name string) error {
+	if strings.Compare(Lookup(name), "") == 0 {
+		return fmt.Errorf("%s is required", name)
+	}
+	return nil
+}
+
+// check the problems found in the configuration: in validate-only mode report them and exit (non-zero if any),
+// otherwise return an error describing all of them, nil if none
+func Validate(problems []error, validateOnly bool) error {
+	var messages []string
+	ssmMu.Lock()
+	problems = append(append([]error{}, ssmErrors...), problems...)
+	ssmMu.Unlock()
+	for _, problem := range problems {
+		if problem != nil {
+			messages = append(messages, problem.Error())
+		}
+	}
+	if validateOnly {
+		for _, message := range messages {
+			fmt.Fprintf(os.Stderr, "invalid configuration: %s\n", message)
+		}
+		if len(messages) > 0 {
+			fmt.Printf("Configuration not valid: %d problems found\n", len(messages))
+			os.Exit(1)
+		}
+		fmt.Println("Configuration valid")
+		os.Exit(0)
+	}
+	if len(messages) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(messages, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+Package dynamo wraps the DynamoDB writes of the serverless-iot-stack
+Lambdas with a retry policy, so that a throttled or transiently failing
+PutItem, UpdateItem or DeleteItem is retried with an exponential backoff
+instead of silently losing the write.
+
+The backoff is the one of the retry package: the delay doubles at every
+attempt and is randomized by a jitter fraction, so that the concurrent
+containers hitting the same throttled table do not retry in lockstep.
+*/
+package dynamo
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	log "github.com/sirupsen/logrus"
+
+	"siot/internal/retry"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of Putter, satisfied by the DynamoDB client
+type Putter interface {
+	PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+}
+
+// type of Updater, satisfied by the DynamoDB client
+type Updater interface {
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+}
+
+// type of Deleter, satisfied by the DynamoDB client
+type Deleter interface {
+	DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
+}
+
+// type of RetryPolicy, how many times and how long apart a failed write is retried
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	Jitter     float64
+}
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+const (
+	MAX_RETRIES = 3
+	BASE_DELAY  = 50 * time.Millisecond
+	JITTER      = 0.5
+	// version of the schema of the items, to bump whenever a field is added to them
+	SCHEMA_VERSION = 5
+	// version of the items written before the version was stored, which have none
+	LEGACY_SCHEMA_VERSION = 1
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// report whether the error is a throttling or a transient failure worth retrying
+func Retryable(err error) bool {
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+// version of the schema of the item, the legacy one if it has none
+func SchemaVersion(item map[string]*dynamodb.AttributeValue) int {
+	if value, ok := item["schema_version"]; ok && value.N != nil {
+		if version, err := strconv.Atoi(*value.N); err == nil {
+			return version
+		}
+	}
+	return LEGACY_SCHEMA_VERSION
+}
+
+// the generic retry policy of the write of the named operation
+func (p RetryPolicy) policy(operation string) retry.Policy {
+	return retry.Policy{
+		MaxAttempts: p.MaxRetries + 1,
+		BaseDelay:   p.BaseDelay,
+		Jitter:      p.Jitter,
+		IsRetryable: Retryable,
+		OnRetry: func(err error, n int, delay time.Duration) {
+			log.Warnf("%s failed (%s), retry %d of %d in %s", operation, err, n, p.MaxRetries, delay)
+		},
+	}
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// put the item, retrying throttling and transient failures up to the maximum retries of the policy
+func PutItem(svc Putter, input *dynamodb.PutItemInput, policy RetryPolicy) (*dynamodb.PutItemOutput, error) {
+	var out *dynamodb.PutItemOutput
+	err := retry.Do(context.Background(), policy.policy("PutItem"), func() (err error) {
+		out, err = svc.PutItem(input)
+		return err
+	})
+	return out, err
+}
+
+// update the item, retrying throttling and transient failures up to the maximum retries of the policy
+func UpdateItem(svc Updater, input *dynamodb.UpdateItemInput, policy RetryPolicy) (*dynamodb.UpdateItemOutput, error) {
+	var out *dynamodb.UpdateItemOutput
+	err := retry.Do(context.Background(), policy.policy("UpdateItem"), func() (err error) {
+		out, err = svc.UpdateItem(input)
+		return err
+	})
+	return out, err
+}
+
+// delete the item, retrying throttling and transient failures up to the maximum retries of the policy
+func DeleteItem(svc Deleter, input *dynamodb.DeleteItemInput, policy RetryPolicy) (*dynamodb.DeleteItemOutput, error) {
+	var out *dynamodb.DeleteItemOutput
+	err := retry.Do(context.Background(), policy.policy("DeleteItem"), func() (err error) {
+		out, err = svc.DeleteItem(input)
+		return err
+	})
+	return out, err
+}
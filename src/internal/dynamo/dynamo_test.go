@@ -0,0 +1,107 @@
+package dynamo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	log "github.com/sirupsen/logrus"
+)
+
+// type of flakyTable, fails the writes with the queued errors before accepting them
+type flakyTable struct {
+	errs  []error
+	calls int
+}
+
+func (f *flakyTable) next() error {
+	f.calls++
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+func (f *flakyTable) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *flakyTable) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *flakyTable) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+var policy = RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, Jitter: JITTER}
+
+func throttled() error {
+	return awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+}
+
+func init() {
+	log.SetLevel(log.FatalLevel)
+}
+
+func TestPutItemRetriesUntilSuccess(t *testing.T) {
+	table := &flakyTable{errs: []error{throttled(), throttled()}}
+	if _, err := PutItem(table, &dynamodb.PutItemInput{TableName: aws.String("table")}, policy); err != nil {
+		t.Fatalf("put failed after retries: %v", err)
+	}
+	if table.calls != 3 {
+		t.Errorf("expected 3 calls, got %d", table.calls)
+	}
+}
+
+func TestDeleteItemRetriesUntilSuccess(t *testing.T) {
+	table := &flakyTable{errs: []error{throttled()}}
+	if _, err := DeleteItem(table, &dynamodb.DeleteItemInput{TableName: aws.String("table")}, policy); err != nil {
+		t.Fatalf("delete failed after retries: %v", err)
+	}
+	if table.calls != 2 {
+		t.Errorf("expected 2 calls, got %d", table.calls)
+	}
+}
+
+func TestUpdateItemGivesUpAfterMaxRetries(t *testing.T) {
+	table := &flakyTable{errs: []error{throttled(), throttled(), throttled(), throttled()}}
+	if _, err := UpdateItem(table, &dynamodb.UpdateItemInput{TableName: aws.String("table")}, policy); err == nil {
+		t.Fatal("expected the update to fail after the retries")
+	}
+	if table.calls != policy.MaxRetries+1 {
+		t.Errorf("expected %d calls, got %d", policy.MaxRetries+1, table.calls)
+	}
+}
+
+func TestPermanentFailureIsNotRetried(t *testing.T) {
+	table := &flakyTable{errs: []error{awserr.New(dynamodb.ErrCodeResourceNotFoundException, "no table", nil)}}
+	if _, err := PutItem(table, &dynamodb.PutItemInput{TableName: aws.String("table")}, policy); err == nil {
+		t.Fatal("expected the put to fail")
+	}
+	if table.calls != 1 {
+		t.Errorf("expected a single call, got %d", table.calls)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	if v := SchemaVersion(map[string]*dynamodb.AttributeValue{}); v != LEGACY_SCHEMA_VERSION {
+		t.Errorf("expected the legacy version of an unversioned item, got %d", v)
+	}
+	if v := SchemaVersion(map[string]*dynamodb.AttributeValue{"schema_version": {N: aws.String("4")}}); v != 4 {
+		t.Errorf("expected version 4, got %d", v)
+	}
+}
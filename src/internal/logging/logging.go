@@ -0,0 +1,264 @@
+/*
+Package logging configures the logrus logger shared by the
+serverless-iot-stack binaries.
+
+Besides the level, it offers a quiet mode for the lines logged once per
+reading or event: when enabled they are demoted to debug and replaced at
+info level by a periodic rollup, so that high frequencies or many devices
+do not flood stdout and CloudWatch Logs.
+
+Beyond that, the info and debug lines can be sampled, keeping one in every
+N of them while all the warnings and errors pass, and the lines can be
+buffered and written in batches. Both are done by a hook writing the
+entries in place of the logger, since a logrus hook cannot drop an entry.
+*/
+package logging
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of fieldHook, adds the same fields to every entry logged
+type fieldHook struct {
+	mu     sync.RWMutex
+	fields log.Fields
+}
+
+// type of sampleHook, writes the entries in place of the logger, one in rate of the info and debug ones
+// and all the others, through a buffer flushed at every interval if set
+type sampleHook struct {
+	mu     sync.Mutex
+	out    io.Writer
+	buffer *bufio.Writer
+	rate   uint64
+	count  uint64
+}
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+var (
+	quiet  int32
+	events uint64
+	hook   = &fieldHook{fields: log.Fields{}}
+
+	sampler     *sampleHook
+	samplerOnce sync.Once
+)
+
+const (
+	BUFFER_SIZE = 64 * 1024
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// the hook applies to every level
+func (h *fieldHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// add the fields to the entry, without overriding the ones set by the caller
+func (h *fieldHook) Fire(entry *log.Entry) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for key, value := range h.fields {
+		if _, ok := entry.Data[key]; !ok {
+			entry.Data[key] = value
+		}
+	}
+	return nil
+}
+
+// the hook applies to every level
+func (h *sampleHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// write the entry unless sampled out, flushing the buffer at once for the errors
+func (h *sampleHook) Fire(entry *log.Entry) error {
+	rate := atomic.LoadUint64(&h.rate)
+	if entry.Level >= log.InfoLevel && rate > 1 && (atomic.AddUint64(&h.count, 1)-1)%rate != 0 {
+		return nil
+	}
+	serialized, err := entry.Logger.Formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buffer == nil {
+		_, err = h.out.Write(serialized)
+		return err
+	}
+	if _, err = h.buffer.Write(serialized); err != nil {
+		return err
+	}
+	if entry.Level <= log.ErrorLevel {
+		return h.buffer.Flush()
+	}
+	return nil
+}
+
+// write the buffered entries
+func (h *sampleHook) flush() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buffer != nil {
+		h.buffer.Flush()
+	}
+}
+
+// install the sampling hook in place of the output of the logger, once
+func installSampler() *sampleHook {
+	samplerOnce.Do(func() {
+		sampler = &sampleHook{out: log.StandardLogger().Out, rate: 1}
+		log.AddHook(sampler)
+		log.SetOutput(ioutil.Discard)
+	})
+	return sampler
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// setup the JSON logger on stdout, returning the level actually set
+func Setup(level string) string {
+	log.SetFormatter(&log.JSONFormatter{})
+	log.SetOutput(os.Stdout)
+	log.AddHook(hook)
+	return SetLevel(level)
+}
+
+// set the level by name (ERROR, WARNING, DEBUG, INFO for anything else), returning the level actually set
+func SetLevel(level string) string {
+	switch strings.ToUpper(level) {
+	case "ERROR":
+		log.SetLevel(log.ErrorLevel)
+		return "ERROR"
+	case "WARNING":
+		log.SetLevel(log.WarnLevel)
+		return "WARNING"
+	case "DEBUG":
+		log.SetLevel(log.DebugLevel)
+		return "DEBUG"
+	}
+	log.SetLevel(log.InfoLevel)
+	return "INFO"
+}
+
+// enable or disable the quiet mode
+func SetQuiet(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&quiet, 1)
+	} else {
+		atomic.StoreInt32(&quiet, 0)
+	}
+}
+
+// add the field to every line logged from now on, removing it if the value is empty
+func SetField(key string, value string) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if strings.Compare(value, "") == 0 {
+		delete(hook.fields, key)
+		return
+	}
+	hook.fields[key] = value
+}
+
+// keep one in rate of the info and debug lines, all of them if the rate is 1 or less; warnings and errors always pass
+func SetSampleRate(rate int64) {
+	if rate <= 1 && sampler == nil {
+		return
+	}
+	if rate < 1 {
+		rate = 1
+	}
+	atomic.StoreUint64(&installSampler().rate, uint64(rate))
+}
+
+// buffer the lines and write them in batches, every interval, when the buffer is full, at every error
+// and on Flush; unbuffered if the interval is not positive
+func SetBuffering(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	h := installSampler()
+	h.mu.Lock()
+	h.buffer = bufio.NewWriterSize(h.out, BUFFER_SIZE)
+	h.mu.Unlock()
+	go func() {
+		for range time.Tick(interval) {
+			h.flush()
+		}
+	}()
+}
+
+// write the buffered lines, e.g. before a Lambda invocation returns and the container is frozen
+func Flush() {
+	if sampler != nil {
+		sampler.flush()
+	}
+}
+
+// log a line emitted once per reading or event: at info, or at debug and counted in the rollup when quiet
+func Eventf(format string, args ...interface{}) {
+	if atomic.LoadInt32(&quiet) == 1 {
+		atomic.AddUint64(&events, 1)
+		log.Debugf(format, args...)
+		return
+	}
+	log.Infof(format, args...)
+}
+
+// log a line emitted once per reading or event, with the given fields, as Eventf does
+func EventWithFields(fields log.Fields, format string, args ...interface{}) {
+	if atomic.LoadInt32(&quiet) == 1 {
+		atomic.AddUint64(&events, 1)
+		log.WithFields(fields).Debugf(format, args...)
+		return
+	}
+	log.WithFields(fields).Infof(format, args...)
+}
+
+// log a line accompanying each event: at info, or at debug when quiet, without counting it
+func Verbosef(format string, args ...interface{}) {
+	if atomic.LoadInt32(&quiet) == 1 {
+		log.Debugf(format, args...)
+		return
+	}
+	log.Infof(format, args...)
+}
+
+// log at info, every interval while quiet, how many events were logged by Eventf in the meantime
+func StartRollup(interval time.Duration, what string) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if atomic.LoadInt32(&quiet) == 0 {
+				continue
+			}
+			n := atomic.SwapUint64(&events, 0)
+			log.WithField("count", n).Infof("%s %d in last %s", what, n, interval)
+		}
+	}()
+}
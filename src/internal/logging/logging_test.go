@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logger writing through the hook only, as the installed sampler does
+func sampledLogger(h *sampleHook) *log.Logger {
+	logger := log.New()
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.SetOutput(ioutil.Discard)
+	logger.SetLevel(log.DebugLevel)
+	logger.AddHook(h)
+	return logger
+}
+
+// number of lines written at every level
+func levels(t *testing.T, out *bytes.Buffer) map[string]int {
+	counts := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.Compare(line, "") == 0 {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid line %s: %v", line, err)
+		}
+		counts[entry["level"].(string)]++
+	}
+	return counts
+}
+
+func TestSampleRateKeepsEveryError(t *testing.T) {
+	var out bytes.Buffer
+	logger := sampledLogger(&sampleHook{out: &out, rate: 10})
+	for i := 0; i < 1000; i++ {
+		logger.Infof("Reading %d processed", i)
+		if i%20 == 0 {
+			logger.Errorf("Error in reading %d", i)
+		}
+	}
+	counts := levels(t, &out)
+	if counts["info"] < 90 || counts["info"] > 110 {
+		t.Errorf("expected about 1 in 10 info lines, got %d of 1000", counts["info"])
+	}
+	if counts["error"] != 50 {
+		t.Errorf("expected every error, got %d of 50", counts["error"])
+	}
+}
+
+func TestBufferedLinesAreWrittenOnFlushAndErrors(t *testing.T) {
+	var out bytes.Buffer
+	h := &sampleHook{out: &out, rate: 1}
+	h.buffer = bufio.NewWriterSize(&out, BUFFER_SIZE)
+	logger := sampledLogger(h)
+	logger.Info("Reading processed")
+	if out.Len() != 0 {
+		t.Fatalf("info line written before the flush: %s", out.String())
+	}
+	h.flush()
+	if counts := levels(t, &out); counts["info"] != 1 {
+		t.Fatalf("expected the buffered line written by the flush, got %v", counts)
+	}
+	logger.Info("Reading processed")
+	logger.Error("Error in reading")
+	if counts := levels(t, &out); counts["info"] != 2 || counts["error"] != 1 {
+		t.Errorf("expected the error to flush the buffer, got %v", counts)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+Package preflight runs cheap checks of the resources a Lambda depends on,
+so that a deployment mistake (wrong table name, missing IAM permission,
+nonexistent bucket) shows up once at cold start with a clear message
+instead of failing every event deep in the logs.
+*/
+package preflight
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of Check, a named verification of a single resource
+type Check struct {
+	Name string
+	Run  func() error
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// run every check and log a pass/fail summary, returning an error if any failed
+func Run(checks []Check) error {
+	failed := 0
+	results := log.Fields{}
+	for _, check := range checks {
+		if err := check.Run(); err != nil {
+			failed++
+			results[check.Name] = fmt.Sprintf("fail: %s", err)
+			log.Errorf("Preflight check %s failed: %s", check.Name, err)
+			continue
+		}
+		results[check.Name] = "pass"
+	}
+	log.WithFields(results).Infof("Preflight completed: %d of %d checks passed", len(checks)-failed, len(checks))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d preflight checks failed", failed, len(checks))
+	}
+	return nil
+}
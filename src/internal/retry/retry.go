@@ -0,0 +1,78 @@
+/*
+Package retry runs an operation again when it fails with a transient error,
+waiting an exponential backoff with jitter between the attempts, so that
+the resilience of the AWS calls of the serverless-iot-stack components is
+written once instead of at every call site.
+
+The delay doubles at every attempt, up to an optional maximum, and is
+randomized by a jitter fraction, so that concurrent callers failing at the
+same time do not retry in lockstep.
+*/
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of Policy, how many times, how long apart and for which errors an operation is attempted
+type Policy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64
+	IsRetryable func(err error) bool
+	OnRetry     func(err error, retry int, delay time.Duration)
+}
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// delay before the given retry (starting from 1), doubled at every retry, capped by the maximum delay
+// if set and randomized by the jitter
+func (p Policy) Delay(retry int) time.Duration {
+	delay := float64(p.BaseDelay) * float64(uint(1)<<uint(retry-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay = delay * (1 - p.Jitter + 2*p.Jitter*rand.Float64())
+	}
+	return time.Duration(delay)
+}
+
+// report whether the error is worth another attempt, any error if the policy has no predicate
+func (p Policy) retryable(err error) bool {
+	return p.IsRetryable == nil || p.IsRetryable(err)
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// run the operation until it succeeds, fails with an error that is not retryable, runs out of attempts
+// or the context is done, returning the last error; OnRetry, if set, is told about every retry
+func Do(ctx context.Context, policy Policy, fn func() error) error {
+	err := fn()
+	for retry := 1; err != nil && policy.retryable(err) && retry < policy.MaxAttempts; retry++ {
+		delay := policy.Delay(retry)
+		if policy.OnRetry != nil {
+			policy.OnRetry(err, retry, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		err = fn()
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var (
+	errTransient = errors.New("transient")
+	errPermanent = errors.New("permanent")
+)
+
+// operation failing with the given errors, in order, before succeeding, counting its calls
+func failing(calls *int, errs ...error) func() error {
+	return func() error {
+		*calls++
+		if *calls <= len(errs) {
+			return errs[*calls-1]
+		}
+		return nil
+	}
+}
+
+func policy(attempts int) Policy {
+	return Policy{
+		MaxAttempts: attempts,
+		BaseDelay:   time.Millisecond,
+		IsRetryable: func(err error) bool { return err == errTransient },
+	}
+}
+
+func TestSuccessAfterRetries(t *testing.T) {
+	var calls, retries int
+	p := policy(3)
+	p.OnRetry = func(err error, retry int, delay time.Duration) { retries = retry }
+	if err := Do(context.Background(), p, failing(&calls, errTransient, errTransient)); err != nil {
+		t.Fatalf("expected success after the retries, got %v", err)
+	}
+	if calls != 3 || retries != 2 {
+		t.Errorf("expected 3 calls and 2 retries, got %d and %d", calls, retries)
+	}
+}
+
+func TestExhaustion(t *testing.T) {
+	var calls int
+	if err := Do(context.Background(), policy(3), failing(&calls, errTransient, errTransient, errTransient, errTransient)); err != errTransient {
+		t.Fatalf("expected the last error, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestNonRetryableFailsImmediately(t *testing.T) {
+	var calls int
+	if err := Do(context.Background(), policy(3), failing(&calls, errPermanent)); err != errPermanent {
+		t.Fatalf("expected the permanent error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected a single call, got %d", calls)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	var calls int
+	ctx, cancel := context.WithCancel(context.Background())
+	p := policy(5)
+	p.BaseDelay = time.Hour
+	p.OnRetry = func(err error, retry int, delay time.Duration) { cancel() }
+	start := time.Now()
+	if err := Do(ctx, p, failing(&calls, errTransient)); err != context.Canceled {
+		t.Fatalf("expected the cancellation, got %v", err)
+	}
+	if calls != 1 || time.Since(start) > time.Second {
+		t.Errorf("expected the wait abandoned after a single call, got %d calls in %s", calls, time.Since(start))
+	}
+}
+
+func TestDelay(t *testing.T) {
+	p := Policy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for retry, expected := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 4: 50 * time.Millisecond, 10: 50 * time.Millisecond} {
+		if delay := p.Delay(retry); delay != expected {
+			t.Errorf("retry %d: expected %s, got %s", retry, expected, delay)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := p.Delay(1); delay < 5*time.Millisecond || delay > 15*time.Millisecond {
+			t.Fatalf("delay %s out of the jitter of 10ms", delay)
+		}
+	}
+}
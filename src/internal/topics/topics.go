@@ -0,0 +1,74 @@
+/*
+Package topics derives the MQTT topics shared by the serverless-iot-stack
+components, so that the device and the remediation function agree on the
+topic closing the control loop instead of configuring it twice.
+
+The remediation topic of a device is <device>/remediation-<building>: the
+device subscribes to it and the remediation function publishes to it,
+unless both are explicitly given another one.
+*/
+package topics
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+const (
+	DEVICE   = "monitoring-device"
+	BUILDING = "1"
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// topic filter without the $share/<group>/ prefix of a shared subscription
+func unshared(filter string) string {
+	if strings.HasPrefix(filter, "$share/") {
+		if parts := strings.SplitN(filter, "/", 3); len(parts) == 3 {
+			return parts[2]
+		}
+	}
+	return filter
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// canonical topic the remediation messages of the device of the building are sent to
+func Remediation(device string, building string) string {
+	return fmt.Sprintf("%s/remediation-%s", device, building)
+}
+
+// report whether a message published on the topic is received by a subscription to the filter,
+// with the + and # wildcards and the $share/<group>/<filter> syntax of the shared subscriptions
+func Matches(filter string, topic string) bool {
+	filterLevels := strings.Split(unshared(filter), "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if strings.Compare(level, "#") == 0 {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if strings.Compare(level, "+") != 0 && strings.Compare(level, topicLevels[i]) != 0 {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// check that the remediation messages published on the topic reach the device subscribed to the filter
+func VerifyLoop(filter string, topic string) error {
+	if !Matches(filter, topic) {
+		return fmt.Errorf("remediation loop not closed: messages published on %s are not received by the subscription %s", topic, filter)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+Package tracing wires the OpenTelemetry SDK used to follow a reading from
+the monitoring device to the cloud.
+
+The device starts a span for every publish and carries its W3C trace
+context inside the published Information, so that the worker can extract it
+and continue the same trace. Tracing is disabled (no-op) unless an OTLP
+endpoint is configured.
+*/
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+var (
+	propagator = propagation.TraceContext{}
+)
+
+const (
+	TRACEPARENT = "traceparent"
+)
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// setup the global tracer provider exporting to the OTLP/HTTP endpoint, a no-op if the endpoint is empty;
+// synchronous export is meant for Lambda, where the container may be frozen before a batch is sent
+func Setup(endpoint string, service string, synchronous bool) (func(context.Context) error, error) {
+	if strings.Compare(endpoint, "") == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{}
+	if strings.HasPrefix(endpoint, "http://") {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+	opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	export := sdktrace.WithBatcher(exporter)
+	if synchronous {
+		export = sdktrace.WithSyncer(exporter)
+	}
+	provider := sdktrace.NewTracerProvider(
+		export,
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(service))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracer of the given component from the global provider
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// W3C traceparent of the span in the context, empty if not sampled or tracing is disabled
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(TRACEPARENT)
+}
+
+// context continuing the trace described by the W3C traceparent
+func Extract(ctx context.Context, traceParent string) context.Context {
+	if strings.Compare(traceParent, "") == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{TRACEPARENT: traceParent})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+const (
+	// FOR TESTS ONLY: the generated CA is trusted by nothing but the simulator and a local broker
+	TEST_CERT_VALIDITY    = 365 * 24 * time.Hour
+	TEST_CA_NAME          = "siot test CA (not for production)"
+	TEST_BROKER_CERT_PATH = "broker.cert.pem"
+	TEST_BROKER_KEY_PATH  = "broker.private.key"
+	TEST_BROKER_HOST      = "localhost"
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// generate a P-256 key and a certificate from the template, signed by the parent (self-signed if nil)
+func newCertificate(template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(TEST_CERT_VALIDITY)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// write the certificate and, if a path is given, its key in PEM format, the key readable by the owner only
+func writeCertificate(dir string, certPath string, keyPath string, cert *x509.Certificate, key *ecdsa.PrivateKey) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := ioutil.WriteFile(filepath.Join(dir, certPath), certPEM, 0644); err != nil {
+		return err
+	}
+	if strings.Compare(keyPath, "") == 0 {
+		return nil
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return ioutil.WriteFile(filepath.Join(dir, keyPath), keyPEM, 0600)
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// generate, FOR TESTS ONLY, a CA and the device and broker certificates it signs, named as newTLSConfig
+// expects them, so that the mutual TLS path can be run against a local broker without AWS
+func generateTestCerts(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	ca, caKey, err := newCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: TEST_CA_NAME},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	if err != nil {
+		return err
+	}
+	device, deviceKey, err := newCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: MONITORING_DEVICE_NAME},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	if err != nil {
+		return err
+	}
+	// the broker is verified against the endpoint given to the simulator: localhost or the machine host name
+	hosts := []string{TEST_BROKER_HOST}
+	if hostname, err := os.Hostname(); err == nil && strings.Compare(hostname, "") != 0 {
+		hosts = append(hosts, hostname)
+	}
+	broker, brokerKey, err := newCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: TEST_BROKER_HOST},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    hosts,
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}, ca, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writeCertificate(dir, filepath.Base(ROOT_CA_PATH), "", ca, nil); err != nil {
+		return err
+	}
+	if err := writeCertificate(dir, filepath.Base(DEVICE_CA_PATH), filepath.Base(DEVICE_PRIVATE_KEY_PATH), device, deviceKey); err != nil {
+		return err
+	}
+	if err := writeCertificate(dir, TEST_BROKER_CERT_PATH, TEST_BROKER_KEY_PATH, broker, brokerKey); err != nil {
+		return err
+	}
+	log.Warnf("Test certificates written to %s: FOR LOCAL TESTS ONLY, never use them with a real broker", dir)
+	return nil
+}
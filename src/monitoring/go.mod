@@ -1,10 +1,16 @@
 require (
-	github.com/eclipse/paho.mqtt.golang v1.3.5 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	github.com/urfave/cli/v2 v2.8.1 // indirect
-	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
+	github.com/aws/aws-sdk-go v1.44.24
+	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/fxamacker/cbor/v2 v2.4.0 // indirect
+	github.com/sirupsen/logrus v1.8.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5 // indirect
+	go.opentelemetry.io/otel/trace v1.11.2
+	gopkg.in/yaml.v3 v3.0.1
+	siot v0.0.0
 )
 
-module monitoring
+module siot/monitoring
 
 go 1.13
+
+replace siot => ../
@@ -0,0 +1,275 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of Broker, in-process MQTT 3.1.1 broker on the loopback interface, enough for the simulator and a
+// consumer: QoS 0 and 1 publishes, delivered at QoS 0 to the matching subscriptions, without retained
+// messages nor sessions
+type Broker struct {
+	listener net.Listener
+	mu       sync.Mutex
+	sessions map[*brokerSession]bool
+}
+
+// type of brokerSession, connection of a client to the broker and its subscriptions
+type brokerSession struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	filters []string
+}
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+const (
+	INTEGRATION_ITERATIONS = 5
+	INTEGRATION_TIMEOUT    = 30 * time.Second
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// start a broker on a free port of the loopback interface, stopped at the end of the test
+func startBroker(t *testing.T) *Broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the broker: %v", err)
+	}
+	b := &Broker{listener: listener, sessions: make(map[*brokerSession]bool)}
+	t.Cleanup(b.Close)
+	go b.serve()
+	return b
+}
+
+// port the broker listens on
+func (b *Broker) Port() int {
+	return b.listener.Addr().(*net.TCPAddr).Port
+}
+
+// stop accepting connections and close the open ones
+func (b *Broker) Close() {
+	b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.sessions {
+		s.conn.Close()
+	}
+}
+
+func (b *Broker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		s := &brokerSession{conn: conn}
+		b.mu.Lock()
+		b.sessions[s] = true
+		b.mu.Unlock()
+		go b.handle(s)
+	}
+}
+
+// answer the control packets of the session until it disconnects
+func (b *Broker) handle(s *brokerSession) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.sessions, s)
+		b.mu.Unlock()
+		s.conn.Close()
+	}()
+	for {
+		packet, err := packets.ReadPacket(s.conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			s.send(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			for i, filter := range p.Topics {
+				s.subscribe(filter)
+				ack.ReturnCodes = append(ack.ReturnCodes, minQoS(p.Qoss[i], 1))
+			}
+			s.send(ack)
+		case *packets.UnsubscribePacket:
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			s.send(ack)
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				s.send(ack)
+			}
+			b.deliver(p.TopicName, p.Payload)
+		case *packets.PingreqPacket:
+			s.send(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// deliver the message at QoS 0 to every brokerSession subscribed to its topic
+func (b *Broker) deliver(topic string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.sessions {
+		if !s.subscribed(topic) {
+			continue
+		}
+		message := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		message.TopicName, message.Payload = topic, payload
+		s.send(message)
+	}
+}
+
+func (s *brokerSession) send(packet packets.ControlPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	packet.Write(s.conn)
+}
+
+func (s *brokerSession) subscribe(filter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filters = append(s.filters, filter)
+}
+
+func (s *brokerSession) subscribed(topic string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, filter := range s.filters {
+		if matches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// report whether the topic matches the filter, with the + and # wildcards
+func matches(filter string, topic string) bool {
+	filterLevels, topicLevels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if strings.Compare(level, "#") == 0 {
+			return true
+		}
+		if i >= len(topicLevels) || strings.Compare(level, "+") != 0 && strings.Compare(level, topicLevels[i]) != 0 {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func minQoS(requested byte, max byte) byte {
+	if requested > max {
+		return max
+	}
+	return requested
+}
+
+// build the simulator into the temporary directory of the test
+func buildSimulator(t *testing.T) string {
+	bin := filepath.Join(t.TempDir(), "monitoring")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the simulator: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// ****************************************************
+// ********************* TESTS ************************
+// ****************************************************
+
+func TestSimulatorPublishesToBroker(t *testing.T) {
+	broker := startBroker(t)
+	bin := buildSimulator(t)
+
+	// the consumer subscribes before the simulator starts, the broker keeps no message
+	received := make(chan mqtt.Message, 2*INTEGRATION_ITERATIONS)
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("tcp://127.0.0.1:%d", broker.Port())).SetClientID("consumer")
+	consumer := mqtt.NewClient(opts)
+	if token := consumer.Connect(); !token.WaitTimeout(INTEGRATION_TIMEOUT) || token.Error() != nil {
+		t.Fatalf("failed to connect the consumer: %v", token.Error())
+	}
+	defer consumer.Disconnect(250)
+	topic := fmt.Sprintf("%s/building-%s", MONITORING_DEVICE_NAME, BUILDING)
+	token := consumer.Subscribe(topic, 1, func(c mqtt.Client, m mqtt.Message) { received <- m })
+	if !token.WaitTimeout(INTEGRATION_TIMEOUT) || token.Error() != nil {
+		t.Fatalf("failed to subscribe the consumer: %v", token.Error())
+	}
+
+	simulator := exec.Command(bin,
+		"--insecure",
+		"--iot-endpoint", "127.0.0.1",
+		"--mqtt-port", fmt.Sprint(broker.Port()),
+		"--iterations", fmt.Sprint(INTEGRATION_ITERATIONS),
+		"--update-frequency", "0.1",
+		"--publish-on-start",
+	)
+	done := make(chan error, 1)
+	var output []byte
+	go func() {
+		var err error
+		output, err = simulator.CombinedOutput()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("simulator failed: %v\n%s", err, output)
+		}
+	case <-time.After(INTEGRATION_TIMEOUT):
+		simulator.Process.Kill()
+		t.Fatalf("simulator still running after %s", INTEGRATION_TIMEOUT)
+	}
+
+	for i := 0; i < INTEGRATION_ITERATIONS; i++ {
+		select {
+		case m := <-received:
+			var event IoTEvent
+			if err := json.Unmarshal(m.Payload(), &event); err != nil || event.Body == nil {
+				t.Fatalf("message %d not a well-formed IoTEvent: %v: %s", i+1, err, m.Payload())
+			}
+			body := event.Body
+			if body.Device != DEVICE_ID || body.Action != Monitor.String() || body.Timestamp == 0 {
+				t.Errorf("message %d with unexpected fields: %+v", i+1, body)
+			}
+			if body.Temp < MIN_TEMP-VELOCITY || body.Temp > MIN_TEMP+VELOCITY || body.Hum < MIN_HUM-VELOCITY || body.Hum > MIN_HUM+VELOCITY {
+				t.Errorf("message %d with an implausible reading: temperature %g, humidity %g", i+1, body.Temp, body.Hum)
+			}
+		case <-time.After(INTEGRATION_TIMEOUT):
+			t.Fatalf("received %d messages, expected %d\n%s", i, INTEGRATION_ITERATIONS, output)
+		}
+	}
+	select {
+	case m := <-received:
+		t.Errorf("unexpected message after %d iterations: %s", INTEGRATION_ITERATIONS, m.Payload())
+	case <-time.After(500 * time.Millisecond):
+	}
+}
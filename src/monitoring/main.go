@@ -1,5 +1,4 @@
 /*
-
 This CLI is used to simulate two device at the same time in a simulated
 environment. The environment is subjected to temperature and humidity
 change.
@@ -18,25 +17,49 @@ enrivonment variation.
 The overall scope of this CLI is to provide a good monitor/actuator device
 to support the scenario described in the README (root level) of this
 repository.
-
 */
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+
+	"siot/internal/codec"
+	"siot/internal/config"
+	"siot/internal/logging"
+	"siot/internal/topics"
+	"siot/internal/tracing"
 )
 
 // ****************************************************
@@ -46,6 +69,9 @@ import (
 // type of action
 type Action int
 
+// type of Waveform, periodic shape of unit amplitude over a phase in radians
+type Waveform func(phase float64) float64
+
 // type of IoTEvent
 type IoTEvent struct {
 	Body *Information `json:"body"`
@@ -53,10 +79,123 @@ type IoTEvent struct {
 
 // type of Information
 type Information struct {
-	Device string  `json:"device"`
-	Temp   float64 `json:"temperature"`
-	Hum    float64 `json:"humidity"`
-	Action string  `json:"action"`
+	Device      string  `json:"device"`
+	Temp        float64 `json:"temperature"`
+	Hum         float64 `json:"humidity"`
+	Pressure    float64 `json:"pressure,omitempty"`
+	Action      string  `json:"action"`
+	Building    string  `json:"building,omitempty"`
+	Timestamp   int64   `json:"timestamp,omitempty"`
+	TraceParent string  `json:"traceparent,omitempty"`
+	Sequence    int64   `json:"sequence,omitempty"`
+	Severity    string  `json:"severity,omitempty"`
+	Tags        Tags    `json:"tags,omitempty"`
+	// software version of the device, to correlate the anomalies with a rollout
+	FirmwareVersion string `json:"fw_version,omitempty"`
+	// identifier of a remediation message, the same when it is delivered again
+	MessageID string `json:"message_id,omitempty"`
+	// identifier of the reading, logged by every component handling it and echoed by its remediation
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// type of Tags, key/value attributes of the device attached to every reading
+type Tags map[string]string
+
+// type of RuleMetric, a metric of a reading in the shape read by the cloudwatchMetric action of an IoT rule
+type RuleMetric struct {
+	MetricName string            `json:"metricName"`
+	Value      float64           `json:"value"`
+	Unit       string            `json:"unit"`
+	Timestamp  int64             `json:"timestamp,omitempty"`
+	Dimensions map[string]string `json:"dimensions"`
+}
+
+// type of Status, sent on the status topic when the simulation ends
+type Status struct {
+	Device string `json:"device"`
+	Status string `json:"status"`
+	Count  uint64 `json:"count"`
+}
+
+// type of Ack, sent on the ack topic when a remediation is received, telling if it was applied
+type Ack struct {
+	Device        string `json:"device"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	MessageID     string `json:"message_id,omitempty"`
+	Applied       bool   `json:"applied"`
+	Reason        string `json:"reason,omitempty"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+// type of Heartbeat, sent on the heartbeat topic at every interval while the simulation runs
+type Heartbeat struct {
+	Device     string  `json:"device"`
+	Uptime     float64 `json:"uptime"`
+	Count      uint64  `json:"count"`
+	ConfigHash string  `json:"config_hash"`
+}
+
+// type of SimConfig, parameters driving the simulated environment
+type SimConfig struct {
+	Device            string
+	Building          string
+	MinTemp           float64
+	MinHum            float64
+	Velocity          float64
+	RemediationFactor float64
+	RemediationLogic  int16
+	StartPhase        float64
+	Waveform          Waveform
+	HumWaveform       Waveform
+	HumAmplitude      float64
+	HumPeriod         float64
+	MinPressure       float64
+	PressureVelocity  float64
+	PressureWaveform  Waveform
+	Setpoint          float64
+	HasSetpoint       bool
+	SetpointWeight    float64
+	AmbientTemp       float64
+	DecayRate         float64
+	Calm              float64
+	Tags              Tags
+	FirmwareVersion   string
+}
+
+// type of SimulationState, shared between the publishing loop and the remediation handler
+type SimulationState struct {
+	mu               sync.RWMutex
+	lastTemp         float64
+	lastHum          float64
+	remediationLogic int16
+	sequences        map[string]int64
+	seenMessages     map[string]time.Time
+	connectedOnce    bool
+	reconnected      bool
+	setpoint         float64
+	hasSetpoint      bool
+}
+
+// type of Latency, count, total and maximum of a latency observed several times
+type Latency struct {
+	count uint64
+	total uint64
+	max   uint64
+}
+
+// type of Stats, counters collected during the whole run of the simulator
+type Stats struct {
+	published          uint64
+	publishErrors      uint64
+	remediations       uint64
+	remediationsLost   uint64
+	qosDowngraded      uint64
+	staleCommands      uint64
+	duplicateCommands  uint64
+	malformedCommands  uint64
+	ackLatency         Latency
+	remediationLatency Latency
+	startedAt          time.Time
 }
 
 // ****************************************************
@@ -64,46 +203,145 @@ type Information struct {
 // ****************************************************
 
 var (
-	err               error
+	// version of the build, set with -ldflags "-X main.version=..."
+	version           = "dev"
+	fwVersion         string
+	correlationIDs    bool
 	deviceId          string
 	iotCoreEndpoint   string
-	lastTemp          float64
-	lastHum           float64
 	minTemp           float64
 	maxTemp           float64
 	minHum            float64
 	maxHum            float64
 	velocity          float64
 	updateFrequency   float64
+	publishTimeout    float64
+	publishOnStart    bool
+	startPhase        float64
 	remediationFactor float64
-	remediationLogic  int16
 	logLevel          string
+	quiet             bool
+	logSampleRate     int64
+	logFlushInterval  time.Duration
+	rollupInterval    float64
+	otelEndpoint      string
+	payloadSchema     string
+	encoding          string
+	topicMode         string
+	fieldTopic        string
+	ordered           bool
+	startupDelay      float64
+	basicIngestRule   string
+	subscription      string
+	waveform          string
+	humWaveform       string
+	humAmplitude      float64
+	humPeriod         float64
+	minPressure       float64
+	pressureVelocity  float64
+	pressureWaveform  string
+	certExpiryWarning time.Duration
+	failOnExpiring    bool
+	publishComplete   bool
+	heartbeatInterval time.Duration
+	ackTopic          string
+	maxRuntime        time.Duration
+	reconnectGrace    time.Duration
+	maxPayloadBytes   int
+	insecure          bool
+	mqttPort          int
+	iterations        int
+	setpointURL       string
+	setpointInterval  time.Duration
+	setpointWeight    float64
+	ambientTemp       float64
+	minInterval       time.Duration
+	maxInterval       time.Duration
+	significantChange float64
+	warmupBurst       int
+	warmupInterval    time.Duration
+	decayRate         float64
+	publishQoS        int
+	brokerMaxQoS      int
+	strictQoS         bool
+	replaySource      string
+	replaySpeed       string
+	replayLoop        bool
+	replayFrom        string
+	replayTo          string
+	tags              = Tags{}
+	tagsErr           error
+	pprofAddr         string
+	maxCommandAge     time.Duration
+	dedupWindow       time.Duration
+	remediationTopic  string
+	verifyLoop        bool
+	deviceProfiles    string
+	cwRuleTopic       string
+	profilesErr       error
+	tracer            trace.Tracer
+	ruleNamePattern   = regexp.MustCompile(`^[a-zA-Z0-9_]{1,128}$`)
+	tagKeyPattern     = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+	state             = &SimulationState{}
+	stats             = &Stats{startedAt: time.Now()}
+	waveforms         = map[string]Waveform{
+		"sine":     math.Sin,
+		"square":   func(phase float64) float64 { return math.Copysign(1, math.Sin(phase)) },
+		"triangle": func(phase float64) float64 { return 2 / math.Pi * math.Asin(math.Sin(phase)) },
+		"sawtooth": func(phase float64) float64 { return 2 * (phase/(2*math.Pi) - math.Floor(phase/(2*math.Pi)+0.5)) },
+	}
 )
 
 const (
 	Monitor Action = iota
 	Remediate
-	DEVICE_ID               = "381938912"
-	UPDATE_FREQUENCY        = 2
-	VELOCITY                = 1.1
-	REMEDIATION_FACTOR      = 0.3
-	MIN_TEMP                = 27.0
-	MIN_HUM                 = 60.0
-	MONITORING_DEVICE_NAME  = "monitoring-device"
-	BUILDING                = "1"
-	IOT_CORE_ENDPOINT       = "CHANGE_ME"
-	ROOT_CA_PATH            = "./certs/AmazonRootCA1.pem"
-	DEVICE_CA_PATH          = "./certs/monitoring-device.cert.pem"
-	DEVICE_PRIVATE_KEY_PATH = "./certs/monitoring-device.private.key"
+	DEVICE_ID                = "381938912"
+	UPDATE_FREQUENCY         = 2
+	PUBLISH_TIMEOUT          = 5
+	PUBLISH_ON_START         = true
+	START_PHASE              = 0.0
+	PAYLOAD_SCHEMA           = "nested"
+	TOPIC_MODE               = "json"
+	FIELD_TOPIC              = "{topic}/{field}"
+	ORDERED                  = true
+	STARTUP_DELAY            = 0.0
+	ROLLUP_INTERVAL          = 60.0
+	CERT_EXPIRY_WARNING      = 30 * 24 * time.Hour
+	RECONNECT_GRACE          = time.Second
+	HEARTBEAT_INTERVAL       = 30 * time.Second
+	REMEDIATION_DEDUP_WINDOW = 5 * time.Minute
+	MAX_PAYLOAD_BYTES        = 128 * 1024
+	MQTT_PORT                = 8883
+	SETPOINT_INTERVAL        = 10 * time.Second
+	SETPOINT_WEIGHT          = 1.0
+	AMBIENT_TEMP             = 20.0
+	SIGNIFICANT_CHANGE       = 0.5
+	WARMUP_INTERVAL          = time.Second
+	PUBLISH_QOS              = 1
+	BROKER_MAX_QOS           = 1
+	WAVEFORM                 = "sine"
+	PERIOD                   = 80 * math.Pi
+	VELOCITY                 = 1.1
+	REMEDIATION_FACTOR       = 0.3
+	MIN_TEMP                 = 27.0
+	MIN_HUM                  = 60.0
+	MIN_PRESSURE             = 1013.25
+	PRESSURE_VELOCITY        = 5.0
+	MONITORING_DEVICE_NAME   = "monitoring-device"
+	BUILDING                 = "1"
+	IOT_CORE_ENDPOINT        = "CHANGE_ME"
+	ROOT_CA_PATH             = "./certs/AmazonRootCA1.pem"
+	DEVICE_CA_PATH           = "./certs/monitoring-device.cert.pem"
+	DEVICE_PRIVATE_KEY_PATH  = "./certs/monitoring-device.private.key"
 )
 
 // ****************************************************
 // ********************* HELPERS **********************
 // ****************************************************
 
-// environment simulator
-func environmentSimulator(y float64, x float64) float64 {
-	return y * math.Sin((1.0/40.0)*x)
+// environment simulator, the waveform stretched to the amplitude y and the period (iterations) at iteration x
+func environmentSimulator(wave Waveform, y float64, period float64, x float64) float64 {
+	return y * wave(2*math.Pi*x/period)
 }
 
 // map the integer value of an action to its corresponding value
@@ -111,6 +349,207 @@ func (d Action) String() string {
 	return [...]string{"Monitor", "Remediate"}[d]
 }
 
+// read the last simulated temperature and humidity
+func (s *SimulationState) Last() (float64, float64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastTemp, s.lastHum
+}
+
+// save the last simulated temperature and humidity
+func (s *SimulationState) SetLast(temp float64, hum float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastTemp = temp
+	s.lastHum = hum
+}
+
+// read the remediation logic currently applied
+func (s *SimulationState) RemediationLogic() int16 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.remediationLogic
+}
+
+// set the remediation logic to apply
+func (s *SimulationState) SetRemediationLogic(logic int16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remediationLogic = logic
+}
+
+// record a connection to the broker, flagging it as a reconnection if it is not the first one
+func (s *SimulationState) Connected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconnected = s.connectedOnce
+	s.connectedOnce = true
+}
+
+// report whether the client reconnected since the last call, clearing the flag
+func (s *SimulationState) TakeReconnected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reconnected := s.reconnected
+	s.reconnected = false
+	return reconnected
+}
+
+// record the sequence number of a remediation message of the device, returning how many messages were
+// skipped since the last one seen; a sequence going backwards (e.g. a reset counter) is not a loss
+func (s *SimulationState) ObserveSequence(device string, seq int64) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sequences == nil {
+		s.sequences = map[string]int64{}
+	}
+	last, seen := s.sequences[device]
+	s.sequences[device] = seq
+	if !seen || seq <= last+1 {
+		return 0
+	}
+	return uint64(seq - last - 1)
+}
+
+// report whether the remediation message was already received within the window, remembering it otherwise;
+// the messages older than the window are forgotten on the way
+func (s *SimulationState) SeenMessage(id string, window time.Duration, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seenMessages == nil {
+		s.seenMessages = map[string]time.Time{}
+	}
+	for seen, at := range s.seenMessages {
+		if now.Sub(at) > window {
+			delete(s.seenMessages, seen)
+		}
+	}
+	if _, ok := s.seenMessages[id]; ok {
+		return true
+	}
+	s.seenMessages[id] = now
+	return false
+}
+
+// increment the number of messages published
+func (s *Stats) IncPublished() {
+	atomic.AddUint64(&s.published, 1)
+}
+
+// increment the number of publish errors
+func (s *Stats) IncPublishErrors() {
+	atomic.AddUint64(&s.publishErrors, 1)
+}
+
+// increment the number of remediation messages received
+func (s *Stats) IncRemediations() {
+	atomic.AddUint64(&s.remediations, 1)
+}
+
+// increment the number of messages published with a lower QoS than requested
+func (s *Stats) IncQoSDowngraded() {
+	atomic.AddUint64(&s.qosDowngraded, 1)
+}
+
+// count a remediation command dropped because stale
+func (s *Stats) IncStaleCommands() {
+	atomic.AddUint64(&s.staleCommands, 1)
+}
+
+// increment the number of remediation commands received again
+func (s *Stats) IncDuplicateCommands() {
+	atomic.AddUint64(&s.duplicateCommands, 1)
+}
+
+// increment the number of remediation commands that could not be decoded
+func (s *Stats) IncMalformedCommands() {
+	atomic.AddUint64(&s.malformedCommands, 1)
+}
+
+// add to the number of remediation messages lost
+func (s *Stats) AddRemediationsLost(lost uint64) {
+	atomic.AddUint64(&s.remediationsLost, lost)
+}
+
+// record a new observation of the latency
+func (l *Latency) Observe(latency time.Duration) {
+	atomic.AddUint64(&l.count, 1)
+	atomic.AddUint64(&l.total, uint64(latency))
+	for {
+		max := atomic.LoadUint64(&l.max)
+		if uint64(latency) <= max || atomic.CompareAndSwapUint64(&l.max, max, uint64(latency)) {
+			return
+		}
+	}
+}
+
+// average and maximum of the observed latency
+func (l *Latency) Summary() (time.Duration, time.Duration) {
+	count := atomic.LoadUint64(&l.count)
+	if count == 0 {
+		return 0, 0
+	}
+	return time.Duration(atomic.LoadUint64(&l.total) / count), time.Duration(atomic.LoadUint64(&l.max))
+}
+
+// time elapsed since the simulator started
+func (s *Stats) Uptime() time.Duration {
+	return time.Since(s.startedAt)
+}
+
+// log a single structured entry summarizing the whole run
+func (s *Stats) LogSummary() {
+	avgAck, maxAck := s.ackLatency.Summary()
+	avgRemediation, maxRemediation := s.remediationLatency.Summary()
+	log.WithFields(log.Fields{
+		"publish_ack_latency_avg":   avgAck.Seconds(),
+		"publish_ack_latency_max":   maxAck.Seconds(),
+		"remediation_latency_avg":   avgRemediation.Seconds(),
+		"remediation_latency_max":   maxRemediation.Seconds(),
+		"published":                 atomic.LoadUint64(&s.published),
+		"publish_errors":            atomic.LoadUint64(&s.publishErrors),
+		"remediations":              atomic.LoadUint64(&s.remediations),
+		"remediation_messages_lost": atomic.LoadUint64(&s.remediationsLost),
+		"qos_downgraded":            atomic.LoadUint64(&s.qosDowngraded),
+		"stale_remediations":        atomic.LoadUint64(&s.staleCommands),
+		"duplicate_remediations":    atomic.LoadUint64(&s.duplicateCommands),
+		"malformed_remediations":    atomic.LoadUint64(&s.malformedCommands),
+		"uptime":                    s.Uptime().Round(time.Millisecond).String(),
+	}).Info("Simulation summary")
+}
+
+// log the validity window of the device certificate, warning if it is expired or about to expire;
+// the returned error is set only when failOnExpiring is enabled
+func checkCertificate(cert tls.Certificate, now time.Time) error {
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"not_before": leaf.NotBefore.Format(time.RFC3339),
+		"not_after":  leaf.NotAfter.Format(time.RFC3339),
+	}).Infof("Device certificate %s loaded", leaf.Subject.CommonName)
+	var problem string
+	switch {
+	case now.Before(leaf.NotBefore):
+		problem = fmt.Sprintf("device certificate not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	case now.After(leaf.NotAfter):
+		problem = fmt.Sprintf("device certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	case leaf.NotAfter.Sub(now) < certExpiryWarning:
+		problem = fmt.Sprintf("device certificate expires on %s, in %s", leaf.NotAfter.Format(time.RFC3339), leaf.NotAfter.Sub(now).Round(time.Minute))
+	default:
+		return nil
+	}
+	if failOnExpiring {
+		return fmt.Errorf("%s", problem)
+	}
+	log.Warnf("The %s: renew it from the IoT Core console", problem)
+	return nil
+}
+
 // create a TLS configuration object for MQTT communication
 func newTLSConfig() (config *tls.Config, err error) {
 
@@ -127,6 +566,9 @@ func newTLSConfig() (config *tls.Config, err error) {
 	if err != nil {
 		return
 	}
+	if err = checkCertificate(cert, time.Now()); err != nil {
+		return
+	}
 
 	// create config object
 	config = &tls.Config{
@@ -144,28 +586,89 @@ func newTLSConfig() (config *tls.Config, err error) {
 
 // simulate the remediation logic in the environment
 func remediationLogicSimulator(client mqtt.Client, msg mqtt.Message) {
-	log.Info("Remediation logic activated...")
+	logging.Verbosef("Remediation logic activated...")
 	log.Debugf("New remediation message in topic %s: %s\n", msg.Topic(), string(msg.Payload()))
 	var iotEvent IoTEvent
-	json.Unmarshal([]byte(msg.Payload()), &iotEvent)
-	remediationLogic = 1
+	// a panic here would kill the paho callback goroutine, and with it every remediation to come
+	if err := json.Unmarshal([]byte(msg.Payload()), &iotEvent); err != nil || iotEvent.Body == nil {
+		if err == nil {
+			err = fmt.Errorf("no body")
+		}
+		stats.IncMalformedCommands()
+		log.WithField("topic", msg.Topic()).Warnf("Ignoring malformed remediation message: %s", err)
+		return
+	}
+	// a message delivered again upstream would shift the environment twice
+	if dedupWindow > 0 && strings.Compare(iotEvent.Body.MessageID, "") != 0 && state.SeenMessage(iotEvent.Body.MessageID, dedupWindow, time.Now()) {
+		stats.IncDuplicateCommands()
+		log.WithField("message_id", iotEvent.Body.MessageID).Infof("Ignoring duplicate remediation of %s", iotEvent.Body.Device)
+		return
+	}
+	stats.IncRemediations()
+	if strings.Compare(iotEvent.Body.CorrelationID, "") != 0 {
+		log.WithField("correlation_id", iotEvent.Body.CorrelationID).Infof("Remediation for correlation %s received", iotEvent.Body.CorrelationID)
+	}
+	var latency time.Duration
+	if iotEvent.Body.Timestamp > 0 {
+		latency = time.Since(time.Unix(0, iotEvent.Body.Timestamp*int64(time.Millisecond)))
+		stats.remediationLatency.Observe(latency)
+		log.WithField("remediation_latency", latency.Seconds()).Infof("Remediation received %0.3fs after the triggering reading", latency.Seconds())
+	}
+	if iotEvent.Body.Sequence > 0 {
+		if lost := state.ObserveSequence(iotEvent.Body.Device, iotEvent.Body.Sequence); lost > 0 {
+			stats.AddRemediationsLost(lost)
+			log.WithField("remediation_messages_lost", lost).Warnf("Lost %d remediation messages of %s before sequence %d", lost, iotEvent.Body.Device, iotEvent.Body.Sequence)
+		}
+	}
+	// the environment has moved on since the reading the command corrects, applying it would do harm
+	if maxCommandAge > 0 && latency > maxCommandAge {
+		stats.IncStaleCommands()
+		log.WithField("remediation_latency", latency.Seconds()).Warnf("Dropping stale remediation of %s, older than %s", iotEvent.Body.Device, maxCommandAge)
+		go publishAck(client, ackTopic, iotEvent.Body, false, "stale")
+		return
+	}
+	if strings.Compare(iotEvent.Body.Severity, "") != 0 {
+		logging.Verbosef("Remediation of severity %s", iotEvent.Body.Severity)
+	}
+	lastTemp, _ := state.Last()
 	if iotEvent.Body.Temp < lastTemp {
-		remediationLogic = -1
+		state.SetRemediationLogic(-1)
+	} else {
+		state.SetRemediationLogic(1)
 	}
+	go publishAck(client, ackTopic, iotEvent.Body, true, "")
 }
 
 // prepare the simulator by setting message handling
 func prepareSimulatedDevices() mqtt.Client {
 
-	// create TLS configuration
-	tlsconfig, err := newTLSConfig()
-	if err != nil {
-		log.Fatalf("Failed to create TLS configuration: %v", err)
-	}
 	opts := mqtt.NewClientOptions()
-	log.Debugf("MQTT Broker endpoint tls://%s:8883", iotCoreEndpoint)
-	opts.AddBroker(fmt.Sprintf("tls://%s:8883", iotCoreEndpoint))
-	opts.SetClientID(MONITORING_DEVICE_NAME).SetTLSConfig(tlsconfig)
+	scheme := "tcp"
+	if !insecure {
+		// create TLS configuration
+		tlsconfig, err := newTLSConfig()
+		if err != nil {
+			log.Fatalf("Failed to create TLS configuration: %v", err)
+		}
+		opts.SetTLSConfig(tlsconfig)
+		scheme = "tls"
+	}
+	// paho tries the brokers in order on every (re)connection; the TLS configuration carries no server
+	// name, so the handshake verifies each broker against its own host name
+	for _, endpoint := range brokerEndpoints() {
+		log.Debugf("MQTT Broker endpoint %s://%s:%d", scheme, endpoint, mqttPort)
+		opts.AddBroker(fmt.Sprintf("%s://%s:%d", scheme, endpoint, mqttPort))
+	}
+	opts.SetClientID(MONITORING_DEVICE_NAME)
+	opts.SetAutoReconnect(true)
+	opts.SetOrderMatters(ordered)
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		code, reason := disconnectReason(err)
+		log.WithFields(log.Fields{"disconnect_reason": code, "error": err.Error()}).Warnf("Connection lost (%s), pausing simulation", reason)
+	})
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		state.Connected()
+	})
 
 	// message handler
 	opts.SetDefaultPublishHandler(remediationLogicSimulator)
@@ -173,160 +676,982 @@ func prepareSimulatedDevices() mqtt.Client {
 	// Start the connection.
 	c := mqtt.NewClient(opts)
 	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Failed to create connection: %v", token.Error())
+		code, reason := disconnectReason(token.Error())
+		log.WithFields(log.Fields{"disconnect_reason": code, "error": token.Error().Error()}).Fatalf("Failed to create connection (%s)", reason)
 	}
 	return c
 }
 
+// classify the error a connection was refused or lost with, as a short code and a human readable reason;
+// MQTT 3.1.1 carries no reason on a disconnection, so the common causes on AWS IoT Core are inferred
+func disconnectReason(err error) (string, string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, packets.ErrorRefusedNotAuthorised), errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword):
+		return "not_authorized", "the certificate or the policy does not allow the connection"
+	case errors.Is(err, packets.ErrorRefusedIDRejected):
+		return "client_id_rejected", "the client ID is not accepted by the broker"
+	case errors.Is(err, packets.ErrorRefusedServerUnavailable):
+		return "server_unavailable", "the broker is unavailable"
+	case errors.Is(err, packets.ErrorRefusedBadProtocolVersion):
+		return "bad_protocol_version", "the broker does not support the MQTT protocol version"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "closed_by_broker", "the broker closed the connection: on AWS IoT Core another client connected with the same client ID, " +
+			"the policy denied a publish or subscribe, or the client was throttled"
+	case strings.Contains(err.Error(), "pingresp not received"):
+		return "keepalive_timeout", "the broker did not answer the keepalive ping in time"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "network_timeout", "the network timed out"
+	case errors.As(err, &netErr), strings.HasPrefix(err.Error(), packets.ErrorNetworkError.Error()):
+		// paho reports the failures to dial the broker as text, wrapping the network error
+		return "network", "the network connection failed"
+	}
+	return "unknown", err.Error()
+}
+
+// endpoints of the brokers, primary first, given comma separated
+func brokerEndpoints() []string {
+	var endpoints []string
+	for _, endpoint := range strings.Split(iotCoreEndpoint, ",") {
+		if endpoint = strings.TrimSpace(endpoint); strings.Compare(endpoint, "") != 0 {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// endpoint masked for printing, showing only its last characters
+func maskEndpoint(endpoint string) string {
+	if len(endpoint) <= 10 {
+		return endpoint
+	}
+	return "**********" + endpoint[10:]
+}
+
+// topic the readings are sent to, through basic ingest if a rule is configured
+func publishTopic() string {
+	topic := fmt.Sprintf("%s/building-%s", MONITORING_DEVICE_NAME, BUILDING)
+	if strings.Compare(basicIngestRule, "") != 0 {
+		return fmt.Sprintf("$aws/rules/%s/%s", basicIngestRule, topic)
+	}
+	return topic
+}
+
+// topic filter the remediation messages are received from, the device own topic if not configured
+func subscriptionTopic() string {
+	if strings.Compare(subscription, "") != 0 {
+		return subscription
+	}
+	return topics.Remediation(MONITORING_DEVICE_NAME, BUILDING)
+}
+
+// check a topic filter, including the $share/<group>/<filter> syntax of the shared subscriptions
+func validSubscription(topic string) error {
+	filter := topic
+	if strings.HasPrefix(topic, "$share/") {
+		parts := strings.SplitN(topic, "/", 3)
+		if len(parts) < 3 || strings.Compare(parts[1], "") == 0 || strings.ContainsAny(parts[1], "+#") {
+			return fmt.Errorf("invalid shared subscription, expected $share/<group>/<filter>: %s", topic)
+		}
+		filter = parts[2]
+	}
+	if strings.Compare(filter, "") == 0 {
+		return fmt.Errorf("empty subscription topic filter: %s", topic)
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if (strings.Contains(level, "#") && (strings.Compare(level, "#") != 0 || i != len(levels)-1)) ||
+			(strings.Contains(level, "+") && strings.Compare(level, "+") != 0) {
+			return fmt.Errorf("invalid wildcard in subscription topic filter: %s", topic)
+		}
+	}
+	return nil
+}
+
+// QoS the broker can honor for the requested one, according to the broker capability hint
+func effectiveQoS(requested byte) byte {
+	if int(requested) > brokerMaxQoS {
+		return byte(brokerMaxQoS)
+	}
+	return requested
+}
+
+// publish a message, abandoning it if the broker does not complete it within the publish timeout;
+// a QoS over the capability of the broker is downgraded, since some (e.g. AWS IoT Core) drop the connection
+func publish(c mqtt.Client, topic string, qos byte, payload []byte) error {
+	if effective := effectiveQoS(qos); effective != qos {
+		log.Debugf("Publishing on %s with QoS %d instead of %d", topic, effective, qos)
+		stats.IncQoSDowngraded()
+		qos = effective
+	}
+	// the broker would reject it without telling the client, so it is dropped here where it can be seen
+	if len(payload) > maxPayloadBytes {
+		log.Warnf("Dropping message of %d bytes for %s, over the limit of %d bytes", len(payload), topic, maxPayloadBytes)
+		return fmt.Errorf("payload of %d bytes over the limit of %d bytes", len(payload), maxPayloadBytes)
+	}
+	start := time.Now()
+	token := c.Publish(topic, qos, false, payload)
+	if !token.WaitTimeout(time.Duration(publishTimeout * float64(time.Second))) {
+		return fmt.Errorf("publish timed out after %0.1fs", publishTimeout)
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+	// with QoS 0 the token completes as soon as the message is sent, there is no ack to wait for
+	if qos > 0 {
+		latency := time.Since(start)
+		stats.ackLatency.Observe(latency)
+		log.WithField("publish_ack_latency", latency.Seconds()).Debugf("Publish on %s acknowledged", topic)
+	}
+	return nil
+}
+
+// marshal the update in the configured payload schema and encoding
+func encodeUpdate(update *IoTEvent) ([]byte, error) {
+	if strings.Compare(payloadSchema, "flat") == 0 {
+		return codec.Marshal(encoding, update.Body)
+	}
+	return codec.Marshal(encoding, update)
+}
+
+// topic a single field of the reading is sent to in split mode, from the field topic template
+func splitTopic(field string, reading *Information) string {
+	return strings.NewReplacer("{topic}", publishTopic(), "{device}", reading.Device, "{building}", reading.Building, "{field}", field).Replace(fieldTopic)
+}
+
+// check the topic mode and the field topic template, which must tell the fields apart
+func validTopicMode() error {
+	switch topicMode {
+	case "json", "split", "both":
+	default:
+		return fmt.Errorf("unknown topic mode: %s", topicMode)
+	}
+	if !strings.Contains(fieldTopic, "{field}") {
+		return fmt.Errorf("field topic template without {field}: %s", fieldTopic)
+	}
+	if strings.ContainsAny(fieldTopic, "+#") {
+		return fmt.Errorf("wildcard in field topic template: %s", fieldTopic)
+	}
+	return nil
+}
+
+// publish the reading as a single message, as one plain numeric message per field, or both, as the topic mode says
+func publishReading(c mqtt.Client, update *IoTEvent) error {
+	if strings.Compare(topicMode, "split") != 0 {
+		updateMessage, _ := encodeUpdate(update)
+		if err := publish(c, publishTopic(), byte(publishQoS), updateMessage); err != nil {
+			return err
+		}
+	}
+	if strings.Compare(topicMode, "json") != 0 {
+		if err := publishFields(c, update.Body); err != nil {
+			return err
+		}
+	}
+	if strings.Compare(cwRuleTopic, "") != 0 {
+		return publishRuleMetrics(c, update.Body)
+	}
+	return nil
+}
+
+// publish every field of the reading as a plain number on a topic of its own
+func publishFields(c mqtt.Client, reading *Information) error {
+	fields := []struct {
+		name  string
+		value float64
+	}{{"temperature", reading.Temp}, {"humidity", reading.Hum}, {"pressure", reading.Pressure}}
+	for _, field := range fields {
+		// a reading without pressure (a replayed one, for instance) does not publish it, as in JSON
+		if strings.Compare(field.name, "pressure") == 0 && field.value == 0 {
+			continue
+		}
+		payload := []byte(strconv.FormatFloat(field.value, 'f', -1, 64))
+		if err := publish(c, splitTopic(field.name, reading), byte(publishQoS), payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish every metric of the reading on the CloudWatch rule topic, shaped for the cloudwatchMetric action of an IoT rule
+func publishRuleMetrics(c mqtt.Client, reading *Information) error {
+	metrics := []RuleMetric{
+		{MetricName: "Temperature", Value: reading.Temp, Unit: "None"},
+		{MetricName: "Humidity", Value: reading.Hum, Unit: "Percent"},
+	}
+	if reading.Pressure != 0 {
+		metrics = append(metrics, RuleMetric{MetricName: "Pressure", Value: reading.Pressure, Unit: "None"})
+	}
+	for _, metric := range metrics {
+		metric.Timestamp = reading.Timestamp / 1000
+		metric.Dimensions = map[string]string{"Device": reading.Device}
+		payload, _ := json.Marshal(&metric)
+		if err := publish(c, cwRuleTopic, byte(publishQoS), payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// string representation of the tags, as accepted by Set
+func (t Tags) String() string {
+	var pairs []string
+	for key, value := range t {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// add the tags given in the key=value form, several of them comma separated
+func (t Tags) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); strings.Compare(pair, "") == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !tagKeyPattern.MatchString(strings.TrimSpace(parts[0])) {
+			return fmt.Errorf("invalid tag, expected key=value with a key of letters, digits, _ . -: %s", pair)
+		}
+		t[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return nil
+}
+
+// snapshot of the simulation parameters currently in use
+func simConfig() SimConfig {
+	setpoint, hasSetpoint := state.Setpoint()
+	return SimConfig{
+		Device:            deviceId,
+		Building:          BUILDING,
+		MinTemp:           minTemp,
+		MinHum:            minHum,
+		Velocity:          velocity,
+		RemediationFactor: remediationFactor,
+		RemediationLogic:  state.RemediationLogic(),
+		StartPhase:        startPhase,
+		Waveform:          waveforms[waveform],
+		HumWaveform:       waveforms[humWaveform],
+		HumAmplitude:      humAmplitude,
+		HumPeriod:         humPeriod,
+		MinPressure:       minPressure,
+		PressureVelocity:  pressureVelocity,
+		PressureWaveform:  waveforms[pressureWaveform],
+		Setpoint:          setpoint,
+		HasSetpoint:       hasSetpoint,
+		SetpointWeight:    setpointWeight,
+		AmbientTemp:       ambientTemp,
+		DecayRate:         decayRate,
+		Tags:              tags,
+		FirmwareVersion:   fwVersion,
+	}
+}
+
+// simulate the reading at the given iteration, without any I/O
+func simulateReading(cfg SimConfig, x float64) Information {
+	var simulatedMove float64
+	switch cfg.RemediationLogic {
+	case -1, 1:
+		simulatedMove = environmentSimulator(cfg.Waveform, cfg.RemediationFactor, PERIOD, x)
+	default:
+		// simulate delta with provided function in given "time" (iteration)
+		simulatedMove = environmentSimulator(cfg.Waveform, cfg.Velocity, PERIOD, x)
+	}
+	// humidity follows the temperature unless it has a waveform of its own
+	humMove := simulatedMove
+	if cfg.HumWaveform != nil {
+		humMove = environmentSimulator(cfg.HumWaveform, cfg.HumAmplitude, cfg.HumPeriod, x)
+	}
+	// pressure has a curve of its own, not affected by the remediation
+	pressure := cfg.MinPressure + environmentSimulator(cfg.PressureWaveform, cfg.PressureVelocity, PERIOD, x)
+	// an external setpoint pulls the base of the temperature curve toward it, by the setpoint weight
+	baseTemp := cfg.MinTemp
+	if cfg.HasSetpoint {
+		baseTemp = baseTemp + cfg.SetpointWeight*(cfg.Setpoint-cfg.MinTemp)
+	}
+	// without a remediation the base decays toward the ambient temperature, more the longer it lasts
+	if cfg.DecayRate > 0 && cfg.RemediationLogic == 0 {
+		baseTemp = baseTemp + (1-math.Exp(-cfg.DecayRate*cfg.Calm))*(cfg.AmbientTemp-baseTemp)
+	}
+	return Information{Device: cfg.Device, Building: cfg.Building, Temp: baseTemp + simulatedMove, Hum: cfg.MinHum + humMove, Pressure: pressure, Action: Monitor.String(), Tags: cfg.Tags, FirmwareVersion: cfg.FirmwareVersion}
+}
+
+// interval before the next reading with the adaptive rate, the shorter the faster the temperature curve
+// changes over an update-frequency period, from the maximum when flat to the minimum at the significant change
+func adaptiveInterval(cfg SimConfig, x float64) time.Duration {
+	slope := math.Abs(simulateReading(cfg, x+1).Temp - simulateReading(cfg, x).Temp)
+	ratio := math.Min(slope/significantChange, 1)
+	return maxInterval - time.Duration(ratio*float64(maxInterval-minInterval))
+}
+
+// interval before the next reading and the step of the curve over it: the update frequency and a step of 1,
+// or, for the adaptive rate and the warm-up burst, their interval and the fraction of the period it covers
+func nextStep(cfg SimConfig, x float64, published int) (time.Duration, float64) {
+	// with the adaptive rate the curve moves by the fraction of the update-frequency period elapsed
+	interval, step := time.Second*time.Duration(updateFrequency), 1.0
+	if maxInterval > 0 {
+		interval = adaptiveInterval(cfg, x)
+		if nominal := time.Duration(updateFrequency * float64(time.Second)); nominal > 0 {
+			step = float64(interval) / float64(nominal)
+		}
+		log.Debugf("Next reading in %s", interval)
+	}
+	// during the warm-up burst the curve moves by the same fraction, so it is continuous when the burst ends
+	if published < warmupBurst {
+		interval, step = warmupInterval, 1.0
+		if nominal := time.Duration(updateFrequency * float64(time.Second)); nominal > 0 {
+			step = float64(warmupInterval) / float64(nominal)
+		}
+		if published+1 == warmupBurst {
+			log.Infof("Warm-up burst of %d readings completed, resuming the normal rate", warmupBurst)
+		}
+	}
+	return interval, step
+}
+
+// generate the first n readings the simulation would publish, starting from the configured phase and moving
+// along the curve by the steps of the publishing loop, the adaptive rate and the warm-up burst included
+func GenerateReadings(cfg SimConfig, n int) []Information {
+	readings := make([]Information, 0, n)
+	x := cfg.StartPhase
+	for i := 0; i < n; i++ {
+		cfg.Calm = x - cfg.StartPhase
+		readings = append(readings, simulateReading(cfg, x))
+		_, step := nextStep(cfg, x, i)
+		x += step
+	}
+	return readings
+}
+
 // simulate monitoring logic using the specificied parameters
-func monitoringLogicSimulator(c mqtt.Client) {
+func monitoringLogicSimulator(c mqtt.Client, done chan<- struct{}) {
 	log.Debug("Sending monitoring update...")
-	x := 0.0
+	x := startPhase
+	// the warm-up burst starts right away, that is its point
+	if !publishOnStart && warmupBurst == 0 {
+		time.Sleep(time.Second * time.Duration(updateFrequency))
+	}
+	paused := false
+	published := 0
+	// iteration since which no remediation is active, the decay toward the ambient starts from there
+	calmSince := x
 	for true {
-		var simulatedMove, simulatedMoveWithoutRemediaton float64
-		switch action := remediationLogic; action {
+		// hold the simulation curve while disconnected, so no reading is lost on reconnect
+		if !c.IsConnected() {
+			if !paused {
+				log.Infof("Broker not connected, simulation paused at iteration %0.1f", x)
+				paused = true
+			}
+			time.Sleep(time.Second * time.Duration(updateFrequency))
+			continue
+		}
+		// give the broker the time to establish the session again before the next publish
+		if state.TakeReconnected() && reconnectGrace > 0 {
+			log.Infof("Reconnected to the broker, waiting %s before publishing again", reconnectGrace)
+			time.Sleep(reconnectGrace)
+			continue
+		}
+		if paused {
+			log.Infof("Broker connected again, resuming simulation at iteration %0.1f", x)
+			paused = false
+		}
+		cfg := simConfig()
+		if cfg.RemediationLogic != 0 {
+			calmSince = x
+		}
+		cfg.Calm = x - calmSince
+		switch cfg.RemediationLogic {
 		case -1:
-			log.Info("Simulate cool down...")
-			simulatedMove = environmentSimulator(remediationFactor, x)
-			simulatedMoveWithoutRemediaton = environmentSimulator(velocity, x)
-			log.Debugf("Temperature comparison (no remediation: %0.4f, remediation: %0.4f)...", minTemp+simulatedMove, minTemp+simulatedMoveWithoutRemediaton)
+			logging.Verbosef("Simulate cool down...")
+			log.Debugf("Temperature comparison (no remediation: %0.4f, remediation: %0.4f)...", cfg.MinTemp+environmentSimulator(cfg.Waveform, cfg.RemediationFactor, PERIOD, x), cfg.MinTemp+environmentSimulator(cfg.Waveform, cfg.Velocity, PERIOD, x))
 		case 1:
-			log.Info("Simulate warm up...")
-			simulatedMove = environmentSimulator(remediationFactor, x)
-			simulatedMoveWithoutRemediaton = environmentSimulator(velocity, x)
-			log.Debugf("Temperature comparison (no remediation: %0.4f, remediation: %0.4f)...", minTemp+simulatedMove, minTemp+simulatedMoveWithoutRemediaton)
+			logging.Verbosef("Simulate warm up...")
+			log.Debugf("Temperature comparison (no remediation: %0.4f, remediation: %0.4f)...", cfg.MinTemp+environmentSimulator(cfg.Waveform, cfg.RemediationFactor, PERIOD, x), cfg.MinTemp+environmentSimulator(cfg.Waveform, cfg.Velocity, PERIOD, x))
 		default:
-			log.Info("Simulate environment...")
-			// simulate delta with provided function in given "time" (iteration)
-			simulatedMove = environmentSimulator(velocity, x)
+			logging.Verbosef("Simulate environment...")
 		}
 
 		// compute new temperature and humidity, save previous
-		simulatedTemp := minTemp + simulatedMove
-		simulatedHum := minHum + simulatedMove
-		lastTemp = simulatedTemp
-		lastHum = simulatedHum
+		reading := simulateReading(cfg, x)
+		reading.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+		state.SetLast(reading.Temp, reading.Hum)
 
-		// prepare monitoring message
-		update := &IoTEvent{Body: &Information{Device: deviceId, Temp: simulatedTemp, Hum: simulatedHum, Action: Monitor.String()}}
-		updateMessage, _ := json.Marshal(update)
+		// prepare monitoring message, carrying the trace context of the publish
+		ctx, span := tracer.Start(context.Background(), "publish")
+		reading.TraceParent = tracing.TraceParent(ctx)
+		fields := log.Fields{}
+		if correlationIDs {
+			reading.CorrelationID = newCorrelationID()
+			fields["correlation_id"] = reading.CorrelationID
+		}
+		update := &IoTEvent{Body: &reading}
 
-		log.Infof("Sending %s %s update: temperature %0.4fC°, humidity %0.4f", update.Body.Device, update.Body.Action, update.Body.Temp, update.Body.Hum)
-		if token := c.Publish(fmt.Sprintf("%s/building-%s", MONITORING_DEVICE_NAME, BUILDING), 1, false, updateMessage); token.Wait() && token.Error() != nil {
-			log.Fatalf("Failed to send update: %v", token.Error())
+		logging.EventWithFields(fields, "Sending %s %s update: temperature %0.4fC°, humidity %0.4f, pressure %0.2fhPa", update.Body.Device, update.Body.Action, update.Body.Temp, update.Body.Hum, update.Body.Pressure)
+		if err := publishReading(c, update); err != nil {
+			log.Errorf("Failed to send update: %v", err)
+			span.RecordError(err)
+			stats.IncPublishErrors()
+		} else {
+			stats.IncPublished()
 		}
-		x = x + 1.0
-		time.Sleep(time.Second * time.Duration(updateFrequency))
+		span.End()
+		interval, step := nextStep(cfg, x, published)
+		x = x + step
+		if published++; iterations > 0 && published >= iterations {
+			break
+		}
+		time.Sleep(interval)
+	}
+	log.Infof("Simulation completed after %d iterations", published)
+	close(done)
+
+}
+
+// announce on the status topic that the simulation is complete, with the number of readings published
+func publishCompletion(c mqtt.Client) {
+	payload, _ := json.Marshal(&Status{Device: deviceId, Status: "complete", Count: atomic.LoadUint64(&stats.published)})
+	topic := fmt.Sprintf("%s/status-%s", MONITORING_DEVICE_NAME, BUILDING)
+	if err := publish(c, topic, byte(publishQoS), payload); err != nil {
+		log.Errorf("Failed to send completion status: %v", err)
+		return
+	}
+	log.Infof("Completion status sent on %s", topic)
+}
+
+// random identifier of a reading, 16 hex characters
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// hash of the value of every flag, the environment and the profile included, that changes with the configuration
+func configHash() string {
+	digest := sha256.New()
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(digest, "%s=%s\n", f.Name, f.Value.String())
+	})
+	return hex.EncodeToString(digest.Sum(nil))[:16]
+}
+
+// tell the cloud on the ack topic whether the remediation took effect; best effort, called on its own goroutine
+// so that waiting for the publish never holds the remediation handler, with the topic read by the caller
+func publishAck(c mqtt.Client, topic string, remediation *Information, applied bool, reason string) {
+	if strings.Compare(topic, "") == 0 {
+		return
+	}
+	payload, _ := json.Marshal(&Ack{
+		Device:        deviceId,
+		CorrelationID: remediation.CorrelationID,
+		MessageID:     remediation.MessageID,
+		Applied:       applied,
+		Reason:        reason,
+		Timestamp:     time.Now().UnixNano() / int64(time.Millisecond),
+	})
+	if err := publish(c, topic, 0, payload); err != nil {
+		log.Warnf("Failed to acknowledge the remediation: %v", err)
 	}
+}
 
+// announce on the heartbeat topic at every interval that the device is alive, with its uptime, the number of
+// readings published and the hash of its configuration, so that a monitor can also tell when it changed
+func publishHeartbeats(c mqtt.Client, interval time.Duration) {
+	topic := fmt.Sprintf("%s/heartbeat-%s", MONITORING_DEVICE_NAME, BUILDING)
+	hash := configHash()
+	log.Infof("Sending heartbeats on %s every %s", topic, interval)
+	for range time.Tick(interval) {
+		payload, _ := json.Marshal(&Heartbeat{
+			Device:     deviceId,
+			Uptime:     stats.Uptime().Seconds(),
+			Count:      atomic.LoadUint64(&stats.published),
+			ConfigHash: hash,
+		})
+		if err := publish(c, topic, 0, payload); err != nil {
+			log.Warnf("Failed to send heartbeat: %v", err)
+		}
+	}
 }
 
 // simulate actuation logic using the specificied parameters
 func remediationListener(c mqtt.Client) {
 	log.Info("Listening for new remediation events...")
-	if token := c.Subscribe(fmt.Sprintf("%s/remediation-%s", MONITORING_DEVICE_NAME, BUILDING), 0, nil); token.Wait() && token.Error() != nil {
+	// the handler is bound to the filter itself: paho strips the $share/<group> prefix of a shared
+	// subscription when matching the topic of the incoming messages against it
+	token := c.Subscribe(subscriptionTopic(), 0, remediationLogicSimulator)
+	if token.Wait() && token.Error() != nil {
 		log.Fatalf("Failed to create subscription: %v", token.Error())
 	}
+	// the broker answers with the QoS it grants to the subscription, 0x80 if it refuses it
+	if granted, ok := token.(*mqtt.SubscribeToken).Result()[subscriptionTopic()]; ok && granted == 0x80 {
+		log.Errorf("Subscription to %s refused by the broker", subscriptionTopic())
+	}
 }
 
-// run everything
-func main() {
-	logLevel = "INFO"
-	remediationLogic = 0
-
-	// set logger
-	log.SetFormatter(&log.JSONFormatter{})
-	log.SetOutput(os.Stdout)
-	log.SetLevel(log.InfoLevel)
-	logLevelStr := os.Getenv("LOG_LEVEL")
-	if strings.Compare(logLevelStr, "ERROR") == 0 {
-		logLevel = "ERROR"
-		log.SetLevel(log.ErrorLevel)
+// check the parameters and the certificates, without connecting to the broker
+func validateConfig() []error {
+	var problems []error
+	if len(brokerEndpoints()) == 0 {
+		problems = append(problems, fmt.Errorf("IoT endpoint not configured"))
 	}
-	if strings.Compare(logLevelStr, "WARNING") == 0 {
-		logLevel = "WARNING"
-		log.SetLevel(log.WarnLevel)
+	for _, endpoint := range brokerEndpoints() {
+		// a local broker may well have a short name, only the placeholder is refused
+		if (!insecure && len(endpoint) <= 10) || strings.Compare(endpoint, IOT_CORE_ENDPOINT) == 0 {
+			problems = append(problems, fmt.Errorf("IoT endpoint not configured: %s", endpoint))
+		}
+	}
+	if !insecure {
+		for _, path := range []string{ROOT_CA_PATH, DEVICE_CA_PATH, DEVICE_PRIVATE_KEY_PATH} {
+			if _, err := os.Stat(path); err != nil {
+				problems = append(problems, fmt.Errorf("certificate not readable: %v", err))
+			}
+		}
 	}
-	if strings.Compare(logLevelStr, "DEBUG") == 0 {
-		logLevel = "DEBUG"
-		log.SetLevel(log.DebugLevel)
+	if mqttPort <= 0 || mqttPort > 65535 {
+		problems = append(problems, fmt.Errorf("invalid MQTT port: %d", mqttPort))
+	}
+	if strings.Compare(setpointURL, "") != 0 {
+		if u, err := url.Parse(setpointURL); err != nil || (strings.Compare(u.Scheme, "http") != 0 && strings.Compare(u.Scheme, "https") != 0) {
+			problems = append(problems, fmt.Errorf("invalid setpoint URL: %s", setpointURL))
+		}
 	}
+	if setpointInterval <= 0 {
+		problems = append(problems, fmt.Errorf("setpoint interval must be positive: %s", setpointInterval))
+	}
+	if setpointWeight < 0 || setpointWeight > 1 {
+		problems = append(problems, fmt.Errorf("setpoint weight must be between 0 and 1: %g", setpointWeight))
+	}
+	if minInterval != 0 || maxInterval != 0 {
+		if minInterval <= 0 || maxInterval < minInterval {
+			problems = append(problems, fmt.Errorf("adaptive intervals must be positive and increasing: min %s, max %s", minInterval, maxInterval))
+		}
+		if significantChange <= 0 {
+			problems = append(problems, fmt.Errorf("significant change must be positive: %g", significantChange))
+		}
+	}
+	if warmupBurst < 0 {
+		problems = append(problems, fmt.Errorf("warm-up burst must not be negative: %d", warmupBurst))
+	}
+	if warmupBurst > 0 && warmupInterval <= 0 {
+		problems = append(problems, fmt.Errorf("warm-up interval must be positive: %s", warmupInterval))
+	}
+	if decayRate < 0 {
+		problems = append(problems, fmt.Errorf("decay rate must not be negative: %g", decayRate))
+	}
+	if publishQoS < 0 || publishQoS > 2 || brokerMaxQoS < 0 || brokerMaxQoS > 2 {
+		problems = append(problems, fmt.Errorf("QoS must be 0, 1 or 2: publish %d, broker %d", publishQoS, brokerMaxQoS))
+	} else if publishQoS > brokerMaxQoS && strictQoS {
+		problems = append(problems, fmt.Errorf("QoS %d not supported by the broker (max %d)", publishQoS, brokerMaxQoS))
+	}
+	if iterations < 0 {
+		problems = append(problems, fmt.Errorf("iterations must not be negative: %d", iterations))
+	}
+	if strings.Compare(basicIngestRule, "") != 0 && !ruleNamePattern.MatchString(basicIngestRule) {
+		problems = append(problems, fmt.Errorf("invalid basic ingest rule name: %s", basicIngestRule))
+	}
+	if err := validSubscription(subscriptionTopic()); err != nil {
+		problems = append(problems, err)
+	} else if verifyLoop {
+		if err := topics.VerifyLoop(subscriptionTopic(), remediationTopic); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if _, ok := waveforms[waveform]; !ok {
+		problems = append(problems, fmt.Errorf("unknown waveform: %s", waveform))
+	}
+	if _, ok := waveforms[humWaveform]; !ok && strings.Compare(humWaveform, "") != 0 {
+		problems = append(problems, fmt.Errorf("unknown humidity waveform: %s", humWaveform))
+	}
+	if _, ok := waveforms[pressureWaveform]; !ok {
+		problems = append(problems, fmt.Errorf("unknown pressure waveform: %s", pressureWaveform))
+	}
+	if humPeriod <= 0 {
+		problems = append(problems, fmt.Errorf("humidity period must be positive: %g", humPeriod))
+	}
+	if strings.Compare(payloadSchema, "nested") != 0 && strings.Compare(payloadSchema, "flat") != 0 {
+		problems = append(problems, fmt.Errorf("unknown payload schema: %s", payloadSchema))
+	}
+	if err := codec.Valid(encoding); err != nil {
+		problems = append(problems, err)
+	}
+	if profilesErr != nil {
+		problems = append(problems, profilesErr)
+	}
+	if tagsErr != nil {
+		problems = append(problems, fmt.Errorf("TAGS: %v", tagsErr))
+	}
+	if err := validTopicMode(); err != nil {
+		problems = append(problems, err)
+	}
+	if strings.ContainsAny(cwRuleTopic, "+#") {
+		problems = append(problems, fmt.Errorf("wildcard in CloudWatch rule topic: %s", cwRuleTopic))
+	}
+	if _, err := parseSpeed(replaySpeed); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := parseWindowBound(replayFrom); err != nil {
+		problems = append(problems, fmt.Errorf("invalid replay window start: %v", err))
+	}
+	if _, err := parseWindowBound(replayTo); err != nil {
+		problems = append(problems, fmt.Errorf("invalid replay window end: %v", err))
+	}
+	if publishTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("publish timeout must be positive: %0.1fs", publishTimeout))
+	}
+	if maxPayloadBytes <= 0 {
+		problems = append(problems, fmt.Errorf("max payload bytes must be positive: %d", maxPayloadBytes))
+	}
+	if dedupWindow < 0 {
+		problems = append(problems, fmt.Errorf("remediation dedup window must not be negative: %s", dedupWindow))
+	}
+	if maxCommandAge < 0 {
+		problems = append(problems, fmt.Errorf("max command age must not be negative: %s", maxCommandAge))
+	}
+	if reconnectGrace < 0 {
+		problems = append(problems, fmt.Errorf("reconnect grace must not be negative: %s", reconnectGrace))
+	}
+	if updateFrequency <= 0 {
+		problems = append(problems, fmt.Errorf("update frequency must be positive: %g", updateFrequency))
+	}
+	if logSampleRate < 1 {
+		problems = append(problems, fmt.Errorf("log sample rate must be at least 1: %d", logSampleRate))
+	}
+	if logFlushInterval < 0 {
+		problems = append(problems, fmt.Errorf("log flush interval must not be negative: %s", logFlushInterval))
+	}
+	if strings.ContainsAny(ackTopic, "+#") {
+		problems = append(problems, fmt.Errorf("ack topic must not contain wildcards: %s", ackTopic))
+	}
+	if heartbeatInterval < 0 {
+		problems = append(problems, fmt.Errorf("heartbeat interval must not be negative: %s", heartbeatInterval))
+	}
+	if maxRuntime < 0 {
+		problems = append(problems, fmt.Errorf("max runtime must not be negative: %s", maxRuntime))
+	}
+	return problems
+}
+
+// run everything
+func main() {
+	// set logger
+	logLevel = logging.Setup(config.Lookup("LOG_LEVEL"))
+	quiet = config.Bool("QUIET", false)
+	// init sampling and batching of the log lines
+	logSampleRate = config.Int("LOG_SAMPLE_RATE", 1)
+	logFlushInterval = config.Duration("LOG_FLUSH_INTERVAL", 0)
+	rollupInterval = config.Float("ROLLUP_INTERVAL", ROLLUP_INTERVAL)
 
 	// set device ID from environment variable or default
-	deviceId = os.Getenv("DEVICE_ID")
-	if strings.Compare(deviceId, "") == 0 {
-		deviceId = DEVICE_ID
-	}
+	deviceId = config.String("DEVICE_ID", DEVICE_ID)
 	// set IOT Broker endpoint from environment variable or default
-	iotCoreEndpoint = os.Getenv("IOT_CORE_ENDPOINT")
-	if strings.Compare(iotCoreEndpoint, "") == 0 {
-		iotCoreEndpoint = IOT_CORE_ENDPOINT
-	}
+	iotCoreEndpoint = config.String("IOT_CORE_ENDPOINT", IOT_CORE_ENDPOINT)
 	// init velocity for environment simulation
-	velocity, err = strconv.ParseFloat(os.Getenv("VELOCITY"), 64)
-	if err != nil {
-		velocity = VELOCITY
-	}
+	velocity = config.Float("VELOCITY", VELOCITY)
 	// init remediation factor for remediate simulation
-	remediationFactor, err = strconv.ParseFloat(os.Getenv("REMEDIATION_FACTOR"), 64)
-	if err != nil {
-		remediationFactor = REMEDIATION_FACTOR
-	}
+	remediationFactor = config.Float("REMEDIATION_FACTOR", REMEDIATION_FACTOR)
+	// init shape of the temperature curve
+	waveform = config.String("WAVEFORM", WAVEFORM)
+	// init shape, amplitude and period of the humidity curve, following the temperature if no shape is set
+	humWaveform = config.Lookup("HUM_WAVEFORM")
+	humAmplitude = config.Float("HUM_AMPLITUDE", VELOCITY)
+	humPeriod = config.Float("HUM_PERIOD", PERIOD)
 	// init min temperature for environment simulation
-	minTemp, err = strconv.ParseFloat(os.Getenv("MIN_TEMP"), 64)
-	if err != nil {
-		minTemp = MIN_TEMP
-	}
+	minTemp = config.Float("MIN_TEMP", MIN_TEMP)
 	// init min humidity for environment simulation
-	minHum, err = strconv.ParseFloat(os.Getenv("MIN_HUM"), 64)
-	if err != nil {
-		minHum = MIN_HUM
-	}
+	minHum = config.Float("MIN_HUM", MIN_HUM)
+	// init min pressure, amplitude and shape of the pressure curve
+	minPressure = config.Float("MIN_PRESSURE", MIN_PRESSURE)
+	pressureVelocity = config.Float("PRESSURE_VELOCITY", PRESSURE_VELOCITY)
+	pressureWaveform = config.String("PRESSURE_WAVEFORM", WAVEFORM)
 	// init monitoring frequency update for environment simulation
-	updateFrequency, err = strconv.ParseFloat(os.Getenv("UPDATE_FREQUENCY"), 64)
-	if err != nil {
-		updateFrequency = UPDATE_FREQUENCY
-	}
+	updateFrequency = config.Float("UPDATE_FREQUENCY", UPDATE_FREQUENCY)
+	// init publish timeout after which a publish is abandoned
+	publishTimeout = config.Float("PUBLISH_TIMEOUT", PUBLISH_TIMEOUT)
+	// init publication of the first reading as soon as the device starts
+	publishOnStart = config.Bool("PUBLISH_ON_START", PUBLISH_ON_START)
+	// init starting point on the simulation curve
+	startPhase = config.Float("START_PHASE", START_PHASE)
+	// init schema of the published payload
+	payloadSchema = config.String("PAYLOAD_SCHEMA", PAYLOAD_SCHEMA)
+	// init encoding of the published payload
+	encoding = config.String("ENCODING", codec.JSON)
+	// init publication of the reading as a single message, one message per field, or both
+	topicMode = config.String("TOPIC_MODE", TOPIC_MODE)
+	fieldTopic = config.String("FIELD_TOPIC", FIELD_TOPIC)
+	// init the topic of the metrics routed to CloudWatch by an IoT rule, disabled if empty
+	cwRuleTopic = config.Lookup("CW_RULE_TOPIC")
+	// init tags of the device attached to every reading, added to by every --tag
+	tagsErr = tags.Set(config.Lookup("TAGS"))
+	// init the software version reported in every reading, the one of the build if not given
+	fwVersion = config.String("FW_VERSION", version)
+	// init the correlation ID generated for every reading
+	correlationIDs = config.Bool("CORRELATION_ID", true)
+	// init in-order delivery of the messages
+	ordered = config.Bool("ORDERED", ORDERED)
+	// init pause after the setup banner, to let an interactive user read it
+	startupDelay = config.Float("STARTUP_DELAY", STARTUP_DELAY)
+	// init basic ingest rule the readings are published to, broker topic if empty
+	basicIngestRule = config.Lookup("BASIC_INGEST_RULE")
+	// init topic filter of the remediation subscription, possibly shared ($share/<group>/<filter>)
+	subscription = config.Lookup("REMEDIATION_SUBSCRIPTION")
+	// init the check that the topic the remediation function publishes to reaches the subscription
+	remediationTopic = config.String("REMEDIATION_TOPIC", topics.Remediation(MONITORING_DEVICE_NAME, BUILDING))
+	verifyLoop = config.Bool("VERIFY_LOOP", false)
+	// init OpenTelemetry collector endpoint, tracing disabled if empty
+	otelEndpoint = config.Lookup("OTEL_ENDPOINT")
+	// init warning window before the device certificate expires
+	certExpiryWarning = config.Duration("CERT_EXPIRY_WARNING", CERT_EXPIRY_WARNING)
+	failOnExpiring = config.Bool("FAIL_ON_EXPIRING_CERT", false)
+	// init announcement of the end of the simulation on the status topic
+	publishComplete = config.Bool("PUBLISH_COMPLETE", false)
+	// init the liveness heartbeat on the heartbeat topic, disabled if zero
+	heartbeatInterval = config.Duration("HEARTBEAT_INTERVAL", HEARTBEAT_INTERVAL)
+	// init the topic the remediations are acknowledged on, disabled if empty
+	ackTopic = config.Lookup("ACK_TOPIC")
+	// init the bound on the duration of the run, unbounded if zero
+	maxRuntime = config.Duration("MAX_RUNTIME", 0)
+	// init pause after a reconnection before publishing again
+	reconnectGrace = config.Duration("RECONNECT_GRACE", RECONNECT_GRACE)
+	// init maximum size of a published message
+	maxPayloadBytes = int(config.Int("MAX_PAYLOAD_BYTES", MAX_PAYLOAD_BYTES))
+	// init connection to a local broker, in plain text if insecure
+	insecure = config.Bool("INSECURE", false)
+	mqttPort = int(config.Int("MQTT_PORT", MQTT_PORT))
+	// init number of readings simulated before stopping, forever if 0
+	iterations = int(config.Int("ITERATIONS", 0))
+	// init external setpoint the temperature is driven toward, disabled if empty
+	setpointURL = config.Lookup("SETPOINT_URL")
+	setpointInterval = config.Duration("SETPOINT_INTERVAL", SETPOINT_INTERVAL)
+	setpointWeight = config.Float("SETPOINT_WEIGHT", SETPOINT_WEIGHT)
+	// init the decay of the temperature toward the ambient one without remediation, disabled if zero
+	ambientTemp = config.Float("AMBIENT_TEMP", AMBIENT_TEMP)
+	decayRate = config.Float("DECAY_RATE", 0)
+	// init the adaptive publish rate, between the two intervals, disabled if they are not set
+	minInterval = config.Duration("MIN_INTERVAL", 0)
+	maxInterval = config.Duration("MAX_INTERVAL", 0)
+	significantChange = config.Float("SIGNIFICANT_CHANGE", SIGNIFICANT_CHANGE)
+	// init the burst of readings published on start to populate the baseline quickly, disabled if zero
+	warmupBurst = int(config.Int("WARMUP_BURST", 0))
+	warmupInterval = config.Duration("WARMUP_INTERVAL", WARMUP_INTERVAL)
+	// init QoS of the published messages, checked against the highest QoS the broker supports
+	publishQoS = int(config.Int("QOS", PUBLISH_QOS))
+	brokerMaxQoS = int(config.Int("BROKER_MAX_QOS", BROKER_MAX_QOS))
+	strictQoS = config.Bool("STRICT_QOS", false)
+	// init replay of recorded readings instead of the simulation
+	replaySource = config.Lookup("REPLAY")
+	replaySpeed = config.String("REPLAY_SPEED", "1x")
+	replayLoop = config.Bool("REPLAY_LOOP", false)
+	replayFrom = config.Lookup("REPLAY_FROM")
+	replayTo = config.Lookup("REPLAY_TO")
+	// init maximum age of a remediation command, applied whatever its age if zero
+	maxCommandAge = config.Duration("MAX_COMMAND_AGE", 0)
+	// init the window the remediation messages already received are ignored in, disabled if zero
+	dedupWindow = config.Duration("REMEDIATION_DEDUP_WINDOW", REMEDIATION_DEDUP_WINDOW)
+	// init file of the per-device simulation parameters, overriding the global ones
+	deviceProfiles = config.Lookup("DEVICE_PROFILES")
+	// init address of the profiling endpoints, disabled if empty
+	pprofAddr = config.Lookup("PPROF_ADDR")
 
-	flag.StringVar(&iotCoreEndpoint, "iot-endpoint", iotCoreEndpoint, "IOT broker endpoint")
+	flag.StringVar(&iotCoreEndpoint, "iot-endpoint", iotCoreEndpoint, "IOT broker endpoint, or comma separated endpoints tried in order for failover")
 	flag.StringVar(&deviceId, "device-id", deviceId, "Device ID")
 	flag.Float64Var(&minTemp, "min-temp", minTemp, "Minimum environment temperature")
 	flag.Float64Var(&minHum, "min-hum", minHum, "Minimum environment relative humidity")
+	flag.Float64Var(&minPressure, "min-pressure", minPressure, "Minimum environment barometric pressure (hPa)")
+	flag.Float64Var(&pressureVelocity, "pressure-velocity", pressureVelocity, "Amplitude (hPa) of the pressure curve")
+	flag.StringVar(&pressureWaveform, "pressure-waveform", pressureWaveform, "Shape of the pressure curve (sine, square, triangle, sawtooth)")
 	flag.Float64Var(&velocity, "velocity", velocity, "Frequency update (seconds) from the environment monitoring device")
 	flag.Float64Var(&updateFrequency, "update-frequency", updateFrequency, "Frequency update (seconds) from the environment monitoring device")
+	flag.Float64Var(&publishTimeout, "publish-timeout", publishTimeout, "Timeout (seconds) after which a pending publish is abandoned")
 	flag.Float64Var(&remediationFactor, "remediation-factor", remediationFactor, "Frequency update (seconds) from the environment monitoring device")
+	flag.StringVar(&deviceProfiles, "device-profiles", deviceProfiles, "YAML file of simulation parameters by device ID, overriding the global ones for the simulated device")
+	flag.StringVar(&waveform, "waveform", waveform, "Shape of the temperature curve (sine, square, triangle, sawtooth)")
+	flag.StringVar(&humWaveform, "hum-waveform", humWaveform, "Shape of the humidity curve (sine, square, triangle, sawtooth), following the temperature if empty")
+	flag.Float64Var(&humAmplitude, "hum-amplitude", humAmplitude, "Amplitude of the humidity curve, negative to move opposite to a temperature of the same shape")
+	flag.Float64Var(&humPeriod, "hum-period", humPeriod, "Period (iterations) of the humidity curve")
+	flag.BoolVar(&publishOnStart, "publish-on-start", publishOnStart, "Publish the first reading as soon as the device starts")
+	flag.Float64Var(&startPhase, "start-phase", startPhase, "Starting point (iteration) on the simulated environment curve")
+	flag.StringVar(&encoding, "encoding", encoding, "Encoding of the published payload (json, cbor, msgpack)")
+	flag.StringVar(&topicMode, "topic-mode", topicMode, "Publish the reading as a single message (json), as a plain number per field (split), or both")
+	flag.StringVar(&fieldTopic, "field-topic", fieldTopic, "Topic template of a field in split mode, with {topic}, {device}, {building} and {field} placeholders")
+	flag.Var(tags, "tag", "Tag key=value of the device attached to every reading, repeatable")
+	flag.BoolVar(&correlationIDs, "correlation-id", correlationIDs, "Generate a correlation ID for every reading, logged by the worker and echoed by its remediation")
+	flag.StringVar(&fwVersion, "fw-version", fwVersion, "Software version of the device reported in every reading (the version of the build if empty)")
+	flag.StringVar(&cwRuleTopic, "cw-rule-topic", cwRuleTopic, "Topic every metric of the reading is also published to, shaped for the CloudWatch action of an IoT rule (disabled if empty)")
+	flag.StringVar(&payloadSchema, "payload-schema", payloadSchema, "Schema of the published payload (nested wraps the reading in body, flat does not)")
+	flag.BoolVar(&ordered, "ordered", ordered, "Deliver messages in order, handling one remediation message at a time")
+	flag.Float64Var(&startupDelay, "startup-delay", startupDelay, "Pause (seconds) after printing the setup, before starting the simulation")
+	flag.StringVar(&basicIngestRule, "basic-ingest-rule", basicIngestRule, "IoT rule receiving the readings through basic ingest, bypassing the broker (disabled if empty)")
+	flag.StringVar(&subscription, "remediation-subscription", subscription, "Topic filter of the remediation messages, $share/<group>/<filter> for a shared subscription (device own topic if empty)")
+	flag.StringVar(&remediationTopic, "remediation-topic", remediationTopic, "Topic the remediation function publishes to, checked by --verify-loop")
+	flag.BoolVar(&verifyLoop, "verify-loop", verifyLoop, "Refuse to start if the remediation topic does not reach the remediation subscription")
+	flag.StringVar(&otelEndpoint, "otel-endpoint", otelEndpoint, "OTLP/HTTP endpoint receiving the traces of every publish (disabled if empty)")
+	flag.DurationVar(&certExpiryWarning, "cert-expiry-warning", certExpiryWarning, "Warn if the device certificate expires within this window")
+	flag.BoolVar(&failOnExpiring, "fail-on-expiring-cert", failOnExpiring, "Refuse to start if the device certificate is expired or expires within the warning window")
+	flag.DurationVar(&dedupWindow, "remediation-dedup-window", dedupWindow, "Ignore a remediation message with the ID of one received within this window (0 to disable)")
+	flag.DurationVar(&maxCommandAge, "max-command-age", maxCommandAge, "Drop the remediation commands received longer than this after their triggering reading (0 to disable)")
+	flag.DurationVar(&reconnectGrace, "reconnect-grace", reconnectGrace, "Pause after a reconnection to the broker before publishing again")
+	flag.BoolVar(&insecure, "insecure", insecure, "Connect in plain text without certificates, to a local broker only (FOR TESTS ONLY)")
+	flag.IntVar(&mqttPort, "mqtt-port", mqttPort, "Port of the MQTT brokers")
+	flag.IntVar(&iterations, "iterations", iterations, "Readings simulated before stopping (0 to run forever)")
+	flag.StringVar(&setpointURL, "setpoint-url", setpointURL, "HTTP endpoint polled for a target temperature the simulation is driven toward (disabled if empty)")
+	flag.DurationVar(&setpointInterval, "setpoint-interval", setpointInterval, "Interval between two polls of the setpoint endpoint")
+	flag.Float64Var(&setpointWeight, "setpoint-weight", setpointWeight, "Fraction (0-1) of the way the temperature curve is moved from min-temp to the setpoint")
+	flag.Float64Var(&ambientTemp, "ambient-temp", ambientTemp, "Temperature the curve decays toward while no remediation is active")
+	flag.DurationVar(&minInterval, "min-interval", minInterval, "Shortest interval of the adaptive rate, used while the temperature changes by the significant change or more")
+	flag.DurationVar(&maxInterval, "max-interval", maxInterval, "Longest interval of the adaptive rate, used while the temperature is stable (adaptive rate disabled if not set)")
+	flag.IntVar(&warmupBurst, "warmup-burst", warmupBurst, "Readings published on start at the warm-up interval before the normal rate (0 to disable)")
+	flag.DurationVar(&warmupInterval, "warmup-interval", warmupInterval, "Interval between the readings of the warm-up burst")
+	flag.Float64Var(&significantChange, "significant-change", significantChange, "Change of the temperature (degrees) over an update-frequency period that publishes at the shortest interval")
+	flag.Float64Var(&decayRate, "decay-rate", decayRate, "Rate, per iteration, of the decay toward the ambient temperature (0 to disable)")
+	flag.IntVar(&publishQoS, "qos", publishQoS, "QoS of the published messages (0, 1, 2)")
+	flag.IntVar(&brokerMaxQoS, "broker-max-qos", brokerMaxQoS, "Highest QoS the broker supports (1 for AWS IoT Core), a higher one is downgraded")
+	flag.BoolVar(&strictQoS, "strict-qos", strictQoS, "Refuse to start if the QoS is higher than the broker supports")
+	flag.IntVar(&maxPayloadBytes, "max-payload-bytes", maxPayloadBytes, "Maximum size (bytes) of a published message, larger ones are dropped")
+	flag.BoolVar(&publishComplete, "publish-complete", publishComplete, "Publish a completion status with the readings count before disconnecting")
+	flag.DurationVar(&maxRuntime, "max-runtime", maxRuntime, "Stop the simulation gracefully after this duration, whatever the frequency (0 to run until stopped)")
+	flag.StringVar(&ackTopic, "ack-topic", ackTopic, "Topic every remediation received is acknowledged on, applied or not (disabled if empty)")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", heartbeatInterval, "Interval of the heartbeat with uptime, readings count and configuration hash (0 to disable)")
+	flag.StringVar(&replaySource, "replay", replaySource, "Republish the readings recorded in a CSV file or under an s3://bucket/prefix instead of simulating them")
+	flag.StringVar(&replaySpeed, "speed", replaySpeed, "Replay speed as a multiplier of the recorded timeline (2x, 0.5x, ...)")
+	flag.BoolVar(&replayLoop, "loop", replayLoop, "Start the replay again once the recorded readings are over")
+	flag.StringVar(&replayFrom, "replay-from", replayFrom, "Replay only the readings recorded from this time (RFC3339)")
+	flag.StringVar(&replayTo, "replay-to", replayTo, "Replay only the readings recorded up to this time (RFC3339)")
+	flag.StringVar(&pprofAddr, "pprof-addr", pprofAddr, "Address (host:port) serving the net/http/pprof profiles of the running simulator (disabled if empty)")
 	flag.StringVar(&logLevel, "log-level", logLevel, "Logging level")
+	flag.BoolVar(&quiet, "quiet", quiet, "Log every reading at debug level, with a periodic rollup at info level")
+	flag.Float64Var(&rollupInterval, "rollup-interval", rollupInterval, "Interval (seconds) of the rollup of the readings published in quiet mode")
 
+	flag.Int64Var(&logSampleRate, "log-sample-rate", logSampleRate, "Keep one in every N info and debug lines, all the warnings and errors (1 keeps every line)")
+	flag.DurationVar(&logFlushInterval, "log-flush-interval", logFlushInterval, "Buffer the log lines and write them in batches at this interval (0 to write every line at once)")
+	validateOnly := config.ValidateOnlyFlag()
+	printSample := flag.Bool("print-sample-payload", false, "Print an example of the payload published with the current parameters and exit")
+	genCerts := flag.String("gen-certs", "", "Write a test CA, device and broker certificates to the directory and exit (FOR LOCAL TESTS ONLY)")
+	config.PrefixFlag()
 	flag.Parse()
 
-	if strings.Compare(logLevel, "ERROR") == 0 {
-		logLevel = "ERROR"
-		log.SetLevel(log.ErrorLevel)
+	// the profile of the device takes precedence over the global parameters
+	if strings.Compare(deviceProfiles, "") != 0 {
+		profilesErr = applyProfile(deviceProfiles, deviceId)
 	}
-	if strings.Compare(logLevel, "WARNING") == 0 {
-		logLevel = "WARNING"
-		log.SetLevel(log.WarnLevel)
+
+	if strings.Compare(*genCerts, "") != 0 {
+		if err := generateTestCerts(*genCerts); err != nil {
+			log.Fatalf("Failed to generate the test certificates: %v", err)
+		}
+		return
 	}
-	if strings.Compare(logLevel, "DEBUG") == 0 {
-		logLevel = "DEBUG"
-		log.SetLevel(log.DebugLevel)
+
+	if *printSample {
+		reading := simulateReading(simConfig(), startPhase)
+		reading.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+		payload, _ := encodeUpdate(&IoTEvent{Body: &reading})
+		// the binary encodings are printed as a hex dump, with their size to compare with JSON
+		if strings.Compare(encoding, codec.JSON) != 0 {
+			fmt.Printf("%d bytes of %s:\n%s", len(payload), encoding, hex.Dump(payload))
+			return
+		}
+		var out bytes.Buffer
+		json.Indent(&out, payload, "", "  ")
+		fmt.Println(out.String())
+		return
+	}
+
+	logLevel = logging.SetLevel(logLevel)
+	logging.SetQuiet(quiet)
+	logging.SetSampleRate(logSampleRate)
+	logging.SetBuffering(logFlushInterval)
+
+	if err := config.Validate(validateConfig(), *validateOnly); err != nil {
+		log.Fatal(err)
+	}
+	if publishQoS > brokerMaxQoS {
+		log.Warnf("QoS %d not supported by the broker, the messages are published with QoS %d", publishQoS, brokerMaxQoS)
 	}
 
 	fmt.Printf("Setup given:\n\n")
-	fmt.Printf("\tiot-endpoint: **********%6s\n", iotCoreEndpoint[10:])
+	for _, endpoint := range brokerEndpoints() {
+		fmt.Printf("\tiot-endpoint: %16s\n", maskEndpoint(endpoint))
+	}
 	fmt.Printf("\tdevice-id: %13s\n", deviceId)
 	fmt.Printf("\tmin-temp: %11.2f C°\n", minTemp)
 	fmt.Printf("\tmin-hum: %13.2f %%\n", minHum)
+	fmt.Printf("\tmin-pressure: %8.2f hPa\n", minPressure)
+	fmt.Printf("\tpressure-velocity: %5.1f\n", pressureVelocity)
 	fmt.Printf("\tvelocity: %14.1f\n", velocity)
 	fmt.Printf("\tupdate-frequency: %5.1fs\n", updateFrequency)
+	fmt.Printf("\tpublish-timeout: %6.1fs\n", publishTimeout)
+	fmt.Printf("\tpublish-on-start: %6t\n", publishOnStart)
+	fmt.Printf("\tstart-phase: %11.1f\n", startPhase)
 	fmt.Printf("\tremediation-factor: %4.2f\n", remediationFactor)
+	fmt.Printf("\twaveform: %14s\n", waveform)
+	if strings.Compare(humWaveform, "") != 0 {
+		fmt.Printf("\thum-waveform: %10s\n", humWaveform)
+		fmt.Printf("\thum-amplitude: %9.2f\n", humAmplitude)
+		fmt.Printf("\thum-period: %12.1f\n", humPeriod)
+	}
 	fmt.Printf("\tlog-level: %13s\n\nStarting simulation...", logLevel)
-	time.Sleep(time.Second * 5)
+	time.Sleep(time.Duration(startupDelay * float64(time.Second)))
+
+	shutdownTracing, err := tracing.Setup(otelEndpoint, MONITORING_DEVICE_NAME, false)
+	if err != nil {
+		log.Fatalf("Failed to setup tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+	tracer = tracing.Tracer(MONITORING_DEVICE_NAME)
+
+	// load the recorded readings before connecting, to fail fast on a wrong source
+	var recorded []Information
+	if strings.Compare(replaySource, "") != 0 {
+		from, _ := parseWindowBound(replayFrom)
+		to, _ := parseWindowBound(replayTo)
+		if recorded, err = loadRecorded(replaySource, from, to); err != nil {
+			log.Fatalf("Failed to load recorded readings: %v", err)
+		}
+	}
 
+	if strings.Compare(pprofAddr, "") != 0 {
+		go func() {
+			log.Infof("Serving the profiles on http://%s/debug/pprof/", pprofAddr)
+			if err := http.ListenAndServe(pprofAddr, nil); err != nil {
+				log.Errorf("Failed to serve the profiles: %v", err)
+			}
+		}()
+	}
+	logging.StartRollup(time.Duration(rollupInterval*float64(time.Second)), "Readings published")
 	c := prepareSimulatedDevices()
-	go monitoringLogicSimulator(c)
+	defer logging.Flush()
+	defer stats.LogSummary()
+	finished := make(chan struct{})
+	if strings.Compare(replaySource, "") != 0 {
+		speed, _ := parseSpeed(replaySpeed)
+		go replayRecorded(c, recorded, speed, replayLoop, finished)
+	} else {
+		if strings.Compare(setpointURL, "") != 0 {
+			go pollSetpoint(setpointURL, setpointInterval)
+		}
+		go monitoringLogicSimulator(c, finished)
+	}
 	go remediationListener(c)
+	if heartbeatInterval > 0 {
+		go publishHeartbeats(c, heartbeatInterval)
+	}
 
-	time.Sleep(time.Second * 10000)
+	// wait for a termination signal, the end of the simulation or the maximum runtime, whichever comes first
+	ctx, cancel := context.WithCancel(context.Background())
+	if maxRuntime > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), maxRuntime)
+	}
+	defer cancel()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-stop:
+		log.Infof("Received %s, stopping simulation...", sig)
+	case <-finished:
+	case <-ctx.Done():
+		log.Infof("Maximum runtime of %s elapsed, stopping simulation...", maxRuntime)
+	}
+	if publishComplete {
+		publishCompletion(c)
+	}
 	c.Disconnect(250)
 }
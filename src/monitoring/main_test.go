@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	"siot/internal/codec"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of fakeClient, MQTT client recording the published messages, every other call is unexpected
+type fakeClient struct {
+	mqtt.Client
+	mu       sync.Mutex
+	messages []fakeMessage
+}
+
+// type of fakeMessage, message published on the fake client
+type fakeMessage struct {
+	topic   string
+	qos     byte
+	payload []byte
+}
+
+// type of doneToken, token of a flow completed at once without error
+type doneToken struct{}
+
+// type of receivedMessage, message delivered to a subscription of the device
+type receivedMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, fakeMessage{topic: topic, qos: qos, payload: payload.([]byte)})
+	return doneToken{}
+}
+
+// messages published, in order
+func (c *fakeClient) published() []fakeMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakeMessage(nil), c.messages...)
+}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (m receivedMessage) Topic() string   { return m.topic }
+func (m receivedMessage) Payload() []byte { return m.payload }
+
+// remediation message received on the remediation topic
+func remediationMessage(payload string) receivedMessage {
+	return receivedMessage{topic: fmt.Sprintf("%s/building-%s/remediation", MONITORING_DEVICE_NAME, BUILDING), payload: []byte(payload)}
+}
+
+// start the test from a fresh simulation state and fresh statistics, restoring them after
+func withSimulationState(t *testing.T) {
+	savedState, savedStats, savedWindow, savedAge := state, stats, dedupWindow, maxCommandAge
+	t.Cleanup(func() { state, stats, dedupWindow, maxCommandAge = savedState, savedStats, savedWindow, savedAge })
+	state, stats = &SimulationState{}, &Stats{startedAt: time.Now()}
+	dedupWindow, maxCommandAge = REMEDIATION_DEDUP_WINDOW, 0
+}
+
+// set the publishing parameters to their defaults for the test, restoring them after
+func withPublishDefaults(t *testing.T) {
+	savedSchema, savedEncoding, savedMode, savedField := payloadSchema, encoding, topicMode, fieldTopic
+	savedQoS, savedMaxQoS, savedTimeout, savedMax := publishQoS, brokerMaxQoS, publishTimeout, maxPayloadBytes
+	savedRule, savedIngest := cwRuleTopic, basicIngestRule
+	t.Cleanup(func() {
+		payloadSchema, encoding, topicMode, fieldTopic = savedSchema, savedEncoding, savedMode, savedField
+		publishQoS, brokerMaxQoS, publishTimeout, maxPayloadBytes = savedQoS, savedMaxQoS, savedTimeout, savedMax
+		cwRuleTopic, basicIngestRule = savedRule, savedIngest
+	})
+	payloadSchema, encoding, topicMode, fieldTopic = PAYLOAD_SCHEMA, codec.JSON, TOPIC_MODE, FIELD_TOPIC
+	publishQoS, brokerMaxQoS, publishTimeout, maxPayloadBytes = PUBLISH_QOS, BROKER_MAX_QOS, PUBLISH_TIMEOUT, MAX_PAYLOAD_BYTES
+	cwRuleTopic, basicIngestRule = "", ""
+}
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.FatalLevel)
+	os.Exit(m.Run())
+}
+
+// simulation of the default parameters, without remediation
+func testConfig() SimConfig {
+	return SimConfig{
+		Device:           DEVICE_ID,
+		Building:         BUILDING,
+		MinTemp:          MIN_TEMP,
+		MinHum:           MIN_HUM,
+		Velocity:         VELOCITY,
+		Waveform:         waveforms["sine"],
+		MinPressure:      MIN_PRESSURE,
+		PressureVelocity: PRESSURE_VELOCITY,
+		PressureWaveform: waveforms["sine"],
+	}
+}
+
+// ****************************************************
+// ********************* TESTS ************************
+// ****************************************************
+
+func TestHumidityFollowsTemperatureWithoutWaveform(t *testing.T) {
+	for _, reading := range GenerateReadings(testConfig(), 200) {
+		if math.Abs((reading.Temp-MIN_TEMP)-(reading.Hum-MIN_HUM)) > 1e-9 {
+			t.Fatalf("humidity %g not following temperature %g", reading.Hum, reading.Temp)
+		}
+	}
+}
+
+func TestHumidityWaveformIsIndependent(t *testing.T) {
+	cfg := testConfig()
+	cfg.HumWaveform, cfg.HumAmplitude, cfg.HumPeriod = waveforms["square"], 5, 40
+	var hum, temp = map[float64]bool{}, map[float64]bool{}
+	for _, reading := range GenerateReadings(cfg, 200) {
+		hum[math.Round((reading.Hum-MIN_HUM)*1e6)/1e6] = true
+		temp[math.Round((reading.Temp-MIN_TEMP)*1e6)/1e6] = true
+		if math.Abs(reading.Hum-MIN_HUM) > 5+1e-9 || math.Abs(reading.Temp-MIN_TEMP) > VELOCITY+1e-9 {
+			t.Fatalf("reading out of its amplitude: temperature %g, humidity %g", reading.Temp, reading.Hum)
+		}
+	}
+	// a square wave only takes its two extremes, with the zero of its start, while the sine sweeps its range
+	for value := range hum {
+		if value != 5 && value != -5 && value != 0 {
+			t.Errorf("humidity move %g not on the square wave", value)
+		}
+	}
+	if len(temp) < 50 {
+		t.Errorf("expected the temperature to sweep a sine, got %d distinct values", len(temp))
+	}
+}
+
+func TestHumidityWaveformHasItsOwnPeriod(t *testing.T) {
+	cfg := testConfig()
+	cfg.HumWaveform, cfg.HumAmplitude, cfg.HumPeriod = waveforms["sine"], VELOCITY, PERIOD/4
+	readings := GenerateReadings(cfg, 100)
+	// same shape and amplitude, a period a quarter of the temperature one: a quarter of its period in, the
+	// humidity is at its peak while the temperature is still rising
+	quarter := int(math.Round(cfg.HumPeriod / 4))
+	hum, temp := readings[quarter].Hum-MIN_HUM, readings[quarter].Temp-MIN_TEMP
+	if math.Abs(hum-VELOCITY) > 0.01 || temp >= hum {
+		t.Errorf("expected the humidity at its peak and the temperature below it, got %g and %g", hum, temp)
+	}
+}
+
+func TestWaveformShapes(t *testing.T) {
+	cases := []struct {
+		name  string
+		phase float64
+		value float64
+	}{
+		{"sine", math.Pi / 2, 1},
+		{"square", math.Pi / 4, 1},
+		{"square", 5 * math.Pi / 4, -1},
+		{"triangle", math.Pi / 4, 0.5},
+		{"sawtooth", math.Pi / 2, 0.5},
+	}
+	for _, c := range cases {
+		if value := waveforms[c.name](c.phase); math.Abs(value-c.value) > 1e-9 {
+			t.Errorf("%s at %g: expected %g, got %g", c.name, c.phase, c.value, value)
+		}
+	}
+}
+
+// self-signed device certificate valid for an hour from now
+func shortLivedCertificate(t *testing.T) (tls.Certificate, time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: MONITORING_DEVICE_NAME},
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, notAfter
+}
+
+func TestCheckCertificate(t *testing.T) {
+	cert, notAfter := shortLivedCertificate(t)
+	savedWarning, savedFail := certExpiryWarning, failOnExpiring
+	t.Cleanup(func() { certExpiryWarning, failOnExpiring = savedWarning, savedFail })
+	cases := []struct {
+		name    string
+		now     time.Time
+		warning time.Duration
+		fails   bool
+	}{
+		{"valid outside the warning window", notAfter.Add(-time.Hour), time.Minute, false},
+		{"expiring within the warning window", notAfter.Add(-time.Hour), CERT_EXPIRY_WARNING, true},
+		{"expired", notAfter.Add(time.Minute), time.Minute, true},
+		{"not yet valid", notAfter.Add(-3 * time.Hour), time.Minute, true},
+	}
+	for _, c := range cases {
+		certExpiryWarning = c.warning
+		failOnExpiring = false
+		if err := checkCertificate(cert, c.now); err != nil {
+			t.Errorf("%s: only a warning expected, got %v", c.name, err)
+		}
+		failOnExpiring = true
+		if err := checkCertificate(cert, c.now); (err != nil) != c.fails {
+			t.Errorf("%s: expected failure %t with --fail-on-expiring-cert, got %v", c.name, c.fails, err)
+		}
+	}
+}
+
+func TestOversizedMessageIsDropped(t *testing.T) {
+	withPublishDefaults(t)
+	reading := simulateReading(testConfig(), 0)
+	payload, _ := encodeUpdate(&IoTEvent{Body: &reading})
+
+	client := &fakeClient{}
+	if err := publish(client, publishTopic(), 1, payload); err != nil {
+		t.Fatalf("publish within the limit failed: %v", err)
+	}
+	if messages := client.published(); len(messages) != 1 || string(messages[0].payload) != string(payload) {
+		t.Fatalf("expected the reading published as it is, got %d messages", len(messages))
+	}
+
+	maxPayloadBytes = len(payload) - 1
+	client = &fakeClient{}
+	if err := publish(client, publishTopic(), 1, payload); err == nil {
+		t.Error("expected the oversized message reported as a publish error")
+	}
+	if messages := client.published(); len(messages) != 0 {
+		t.Errorf("oversized message sent to the broker: %s", messages[0].payload)
+	}
+}
+
+func TestPublishTimeoutMustBePositive(t *testing.T) {
+	withPublishDefaults(t)
+	for _, timeout := range []float64{0, -1} {
+		publishTimeout = timeout
+		found := false
+		for _, problem := range validateConfig() {
+			found = found || strings.Contains(problem.Error(), "publish timeout must be positive")
+		}
+		if !found {
+			t.Errorf("publish timeout %g not reported", timeout)
+		}
+	}
+	publishTimeout = PUBLISH_TIMEOUT
+	for _, problem := range validateConfig() {
+		if strings.Contains(problem.Error(), "publish timeout") {
+			t.Errorf("default publish timeout reported: %v", problem)
+		}
+	}
+}
+
+func TestTagsRoundTrip(t *testing.T) {
+	tags := Tags{}
+	if err := tags.Set("env=prod, floor=3"); err != nil {
+		t.Fatalf("valid tags rejected: %v", err)
+	}
+	if err := tags.Set("room=3.14"); err != nil {
+		t.Fatalf("tag of a second --tag rejected: %v", err)
+	}
+	if tags.String() != "env=prod,floor=3,room=3.14" {
+		t.Errorf("unexpected tags %s", tags)
+	}
+	for _, invalid := range []string{"env", "bad key=1"} {
+		if err := (Tags{}).Set(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+	cfg := testConfig()
+	cfg.Tags = tags
+	reading := simulateReading(cfg, 0)
+	payload, err := json.Marshal(&IoTEvent{Body: &reading})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded IoTEvent
+	if err := json.Unmarshal(payload, &decoded); err != nil || decoded.Body == nil {
+		t.Fatalf("reading not decoded: %v", err)
+	}
+	if decoded.Body.Tags.String() != tags.String() {
+		t.Errorf("expected the tags %s carried by the reading, got %s", tags, decoded.Body.Tags)
+	}
+}
+
+func TestTemperatureDecaysTowardAmbient(t *testing.T) {
+	cfg := testConfig()
+	cfg.MinTemp, cfg.Velocity, cfg.AmbientTemp, cfg.DecayRate = 30, 0.1, 20, 0.1
+	readings := GenerateReadings(cfg, 100)
+	previous := math.Inf(1)
+	for i := 0; i < len(readings); i += 10 {
+		distance := math.Abs(readings[i].Temp - cfg.AmbientTemp)
+		if distance > previous {
+			t.Errorf("reading %d moved away from the ambient: %g from it, %g before", i, distance, previous)
+		}
+		previous = distance
+	}
+	if last := readings[len(readings)-1].Temp; math.Abs(last-cfg.AmbientTemp) > 0.2 {
+		t.Errorf("expected the temperature converged to %g, got %g", cfg.AmbientTemp, last)
+	}
+
+	// a remediation holds the curve on its own base
+	cfg.RemediationLogic = 1
+	cfg.Calm = 100
+	if reading := simulateReading(cfg, 0); math.Abs(reading.Temp-cfg.AmbientTemp) < 5 {
+		t.Errorf("temperature decayed during a remediation: %g", reading.Temp)
+	}
+}
+
+func TestAdaptiveIntervalFollowsTheSlope(t *testing.T) {
+	savedMin, savedMax, savedChange := minInterval, maxInterval, significantChange
+	t.Cleanup(func() { minInterval, maxInterval, significantChange = savedMin, savedMax, savedChange })
+	minInterval, maxInterval, significantChange = time.Second, 10*time.Second, 0.02
+	cfg := testConfig()
+	// the sine is steepest where it crosses its base and flat at its peak, a quarter of its period later
+	steep, flat := adaptiveInterval(cfg, 0), adaptiveInterval(cfg, PERIOD/4-0.5)
+	if steep != minInterval {
+		t.Errorf("expected the shortest interval on the steep segment, got %s", steep)
+	}
+	if flat < 9*time.Second || flat > maxInterval {
+		t.Errorf("expected about the longest interval on the flat segment, got %s", flat)
+	}
+	cfg.Waveform = func(float64) float64 { return 0 }
+	if stable := adaptiveInterval(cfg, 0); stable != maxInterval {
+		t.Errorf("expected the longest interval on a constant curve, got %s", stable)
+	}
+}
+
+func TestDuplicateRemediationShiftsOnce(t *testing.T) {
+	withSimulationState(t)
+	message := remediationMessage(`{"body":{"device":"930129302","temperature":21.5,"action":"Remediate","message_id":"c4ca4238a0b923820dcc509a6f75849b"}}`)
+	state.SetLast(24.5, 40)
+	remediationLogicSimulator(&fakeClient{}, message)
+	if logic := state.RemediationLogic(); logic != -1 {
+		t.Fatalf("expected the environment cooling down, got %d", logic)
+	}
+	// the simulation resumes its curve, the redelivered message must not shift it again
+	state.SetRemediationLogic(0)
+	remediationLogicSimulator(&fakeClient{}, message)
+	if logic := state.RemediationLogic(); logic != 0 {
+		t.Errorf("duplicate remediation applied again: %d", logic)
+	}
+	if stats.remediations != 1 || stats.duplicateCommands != 1 {
+		t.Errorf("expected 1 remediation and 1 duplicate, got %d and %d", stats.remediations, stats.duplicateCommands)
+	}
+	// outside the window the same ID is a new remediation
+	dedupWindow = 0
+	remediationLogicSimulator(&fakeClient{}, message)
+	if stats.remediations != 2 {
+		t.Errorf("expected the remediation applied with the deduplication disabled, got %d", stats.remediations)
+	}
+}
+
+func TestWarmupBurstKeepsTheWaveformContinuous(t *testing.T) {
+	savedBurst, savedInterval, savedFrequency, savedMax := warmupBurst, warmupInterval, updateFrequency, maxInterval
+	t.Cleanup(func() {
+		warmupBurst, warmupInterval, updateFrequency, maxInterval = savedBurst, savedInterval, savedFrequency, savedMax
+	})
+	warmupBurst, warmupInterval, updateFrequency, maxInterval = 4, 250*time.Millisecond, 1, 0
+	cfg := testConfig()
+	// the steepest move of the curve over a whole update period
+	maxMove := VELOCITY * 2 * math.Pi / PERIOD
+	x, elapsed, burst := 0.0, time.Duration(0), 0
+	previous := simulateReading(cfg, x).Temp
+	for published := 0; published < 10; published++ {
+		interval, step := nextStep(cfg, x, published)
+		if interval == warmupInterval {
+			burst++
+		}
+		x, elapsed = x+step, elapsed+interval
+		// the curve is where the normal rate would have it after the same time
+		if math.Abs(x-elapsed.Seconds()/updateFrequency) > 1e-9 {
+			t.Fatalf("reading %d at %g of the curve after %s", published+1, x, elapsed)
+		}
+		temp := simulateReading(cfg, x).Temp
+		if math.Abs(temp-previous) > maxMove*step+1e-9 {
+			t.Errorf("reading %d jumps by %g", published+1, temp-previous)
+		}
+		previous = temp
+	}
+	if burst != warmupBurst {
+		t.Errorf("expected %d readings in the burst, got %d", warmupBurst, burst)
+	}
+}
+
+func TestGeneratedReadingsFollowTheWarmupBurst(t *testing.T) {
+	savedBurst, savedInterval, savedFrequency, savedMax := warmupBurst, warmupInterval, updateFrequency, maxInterval
+	t.Cleanup(func() {
+		warmupBurst, warmupInterval, updateFrequency, maxInterval = savedBurst, savedInterval, savedFrequency, savedMax
+	})
+	warmupBurst, warmupInterval, updateFrequency, maxInterval = 4, 250*time.Millisecond, 1, 0
+	cfg := testConfig()
+	// the burst moves the curve by a quarter of a step, then the normal rate by whole steps
+	xs := []float64{0, 0.25, 0.5, 0.75, 1, 2, 3, 4}
+	readings := GenerateReadings(cfg, len(xs))
+	for i, x := range xs {
+		if expected := simulateReading(cfg, x).Temp; readings[i].Temp != expected {
+			t.Errorf("reading %d: expected %g, at %g of the curve, got %g", i, expected, x, readings[i].Temp)
+		}
+	}
+}
+
+func TestMalformedRemediationIsIgnored(t *testing.T) {
+	withSimulationState(t)
+	state.SetLast(24.5, 40)
+	state.SetRemediationLogic(1)
+	for _, payload := range []string{"", "garbage", "{}", `{"body":null}`, `{"body":"21.5"}`} {
+		remediationLogicSimulator(&fakeClient{}, remediationMessage(payload))
+		if logic := state.RemediationLogic(); logic != 1 {
+			t.Fatalf("%q: remediation logic changed to %d", payload, logic)
+		}
+	}
+	if stats.malformedCommands != 5 || stats.remediations != 0 {
+		t.Errorf("expected 5 malformed messages and no remediation, got %d and %d", stats.malformedCommands, stats.remediations)
+	}
+	// the handler keeps working for the next well-formed message
+	remediationLogicSimulator(&fakeClient{}, remediationMessage(`{"body":{"device":"930129302","temperature":21.5,"action":"Remediate"}}`))
+	if logic := state.RemediationLogic(); logic != -1 || stats.remediations != 1 {
+		t.Errorf("expected the next remediation applied, got logic %d", logic)
+	}
+}
+
+func TestCorrelationIDIsPublishedWithTheReading(t *testing.T) {
+	withPublishDefaults(t)
+	first, second := newCorrelationID(), newCorrelationID()
+	if len(first) != 16 || strings.Compare(first, second) == 0 {
+		t.Fatalf("expected distinct 16 hex digit IDs, got %s and %s", first, second)
+	}
+	reading := simulateReading(testConfig(), 0)
+	reading.CorrelationID = first
+	client := &fakeClient{}
+	if err := publishReading(client, &IoTEvent{Body: &reading}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	var published struct {
+		Body map[string]interface{} `json:"body"`
+	}
+	messages := client.published()
+	if len(messages) != 1 || json.Unmarshal(messages[0].payload, &published) != nil || published.Body["correlation_id"] != first {
+		t.Errorf("expected the correlation_id %s in the published reading, got %+v", first, published.Body)
+	}
+}
+
+func TestRemediationIsAcknowledged(t *testing.T) {
+	withPublishDefaults(t)
+	savedTopic := ackTopic
+	t.Cleanup(func() { ackTopic = savedTopic })
+	remediation := &Information{Device: deviceId, CorrelationID: "9f2c4e1ab37d0c55", MessageID: "c4ca4238a0b923820dcc509a6f75849b"}
+
+	// without an ack topic nothing is published
+	ackTopic = ""
+	client := &fakeClient{}
+	publishAck(client, ackTopic, remediation, true, "")
+	if messages := client.published(); len(messages) != 0 {
+		t.Fatalf("expected no ack without a topic, got %d", len(messages))
+	}
+
+	ackTopic = "monitoring-device/acks"
+	publishAck(client, ackTopic, remediation, false, "stale")
+	messages := client.published()
+	if len(messages) != 1 || messages[0].topic != ackTopic {
+		t.Fatalf("expected one ack on %s, got %+v", ackTopic, messages)
+	}
+	var ack Ack
+	if err := json.Unmarshal(messages[0].payload, &ack); err != nil {
+		t.Fatalf("invalid ack %s: %v", messages[0].payload, err)
+	}
+	if ack.Applied || ack.Reason != "stale" || ack.CorrelationID != remediation.CorrelationID || ack.MessageID != remediation.MessageID || ack.Timestamp == 0 {
+		t.Errorf("unexpected ack %+v", ack)
+	}
+}
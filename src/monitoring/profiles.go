@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of DeviceProfile, simulation parameters of a device, the global ones for the fields not given
+type DeviceProfile struct {
+	MinTemp           *float64 `yaml:"min_temp"`
+	MinHum            *float64 `yaml:"min_hum"`
+	Velocity          *float64 `yaml:"velocity"`
+	RemediationFactor *float64 `yaml:"remediation_factor"`
+	Waveform          *string  `yaml:"waveform"`
+}
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// load the profiles of the file, keyed by device ID, refusing unknown fields and waveforms
+func loadProfiles(path string) (map[string]DeviceProfile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	profiles := make(map[string]DeviceProfile)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&profiles); err != nil {
+		return nil, fmt.Errorf("invalid device profiles %s: %v", path, err)
+	}
+	for device, profile := range profiles {
+		if profile.Waveform != nil {
+			if _, ok := waveforms[*profile.Waveform]; !ok {
+				return nil, fmt.Errorf("unknown waveform of device %s: %s", device, *profile.Waveform)
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// apply the profile of the simulated device over the global parameters, if the file has one
+func applyProfile(path string, device string) error {
+	profiles, err := loadProfiles(path)
+	if err != nil {
+		return err
+	}
+	profile, ok := profiles[device]
+	if !ok {
+		log.Warnf("No profile of device %s in %s, using the global parameters", device, path)
+		return nil
+	}
+	if profile.MinTemp != nil {
+		minTemp = *profile.MinTemp
+	}
+	if profile.MinHum != nil {
+		minHum = *profile.MinHum
+	}
+	if profile.Velocity != nil {
+		velocity = *profile.Velocity
+	}
+	if profile.RemediationFactor != nil {
+		remediationFactor = *profile.RemediationFactor
+	}
+	if profile.Waveform != nil {
+		waveform = *profile.Waveform
+	}
+	log.Infof("Profile of device %s applied from %s", device, path)
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	"siot/internal/logging"
+	"siot/internal/tracing"
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// parse a replay speed as a multiplier, with or without the trailing x (2x, 0.5, ...)
+func parseSpeed(value string) (float64, error) {
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid replay speed: %s", value)
+	}
+	return speed, nil
+}
+
+// parse a bound of the replay window, zero if empty
+func parseWindowBound(value string) (time.Time, error) {
+	if strings.Compare(value, "") == 0 {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// decode a recorded reading, in both the nested ({"body":{...}}) and the flat schema
+func decodeRecorded(data []byte) (Information, error) {
+	var event IoTEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return Information{}, err
+	}
+	if event.Body != nil {
+		return *event.Body, nil
+	}
+	var reading Information
+	err := json.Unmarshal(data, &reading)
+	return reading, err
+}
+
+// read the readings of a CSV file whose header names the Information fields (device, temperature, humidity, ...)
+func readCSV(r io.Reader) ([]Information, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	columns := map[string]int{}
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	var readings []Information
+	for n, row := range rows[1:] {
+		reading := Information{Device: field(row, "device"), Action: field(row, "action"), Building: field(row, "building")}
+		if strings.Compare(reading.Action, "") == 0 {
+			reading.Action = Monitor.String()
+		}
+		if reading.Temp, err = strconv.ParseFloat(field(row, "temperature"), 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid temperature: %v", n+2, err)
+		}
+		if reading.Hum, err = strconv.ParseFloat(field(row, "humidity"), 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid humidity: %v", n+2, err)
+		}
+		if value := field(row, "pressure"); strings.Compare(value, "") != 0 {
+			if reading.Pressure, err = strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid pressure: %v", n+2, err)
+			}
+		}
+		if reading.Timestamp, err = strconv.ParseInt(field(row, "timestamp"), 10, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid timestamp: %v", n+2, err)
+		}
+		readings = append(readings, reading)
+	}
+	return readings, nil
+}
+
+// read the history objects stored by the worker under the s3://bucket/prefix location
+func readS3(location string) ([]Information, error) {
+	bucket := strings.TrimPrefix(location, "s3://")
+	prefix := ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, prefix = bucket[:i], bucket[i+1:]
+	}
+	svc := s3.New(session.Must(session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})))
+	var readings []Information
+	var failed error
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			out, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: object.Key})
+			if err != nil {
+				failed = err
+				return false
+			}
+			data, err := ioutil.ReadAll(out.Body)
+			out.Body.Close()
+			if err != nil {
+				failed = err
+				return false
+			}
+			reading, err := decodeRecorded(data)
+			if err != nil {
+				log.Warnf("Skipping object %s: %v", aws.StringValue(object.Key), err)
+				continue
+			}
+			readings = append(readings, reading)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readings, failed
+}
+
+// load the recorded readings from a CSV file or an S3 location, keeping those in the window sorted by timestamp
+func loadRecorded(source string, from time.Time, to time.Time) ([]Information, error) {
+	var readings []Information
+	var err error
+	if strings.HasPrefix(source, "s3://") {
+		readings, err = readS3(source)
+	} else {
+		var f *os.File
+		if f, err = os.Open(source); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		readings, err = readCSV(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var selected []Information
+	for _, reading := range readings {
+		at := time.Unix(0, reading.Timestamp*int64(time.Millisecond))
+		if (!from.IsZero() && at.Before(from)) || (!to.IsZero() && at.After(to)) {
+			continue
+		}
+		selected = append(selected, reading)
+	}
+	sort.SliceStable(selected, func(i, j int) bool { return selected[i].Timestamp < selected[j].Timestamp })
+	return selected, nil
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// republish the recorded readings keeping their spacing divided by the speed, restamped with the current time;
+// done is closed once the readings are over, unless looping
+func replayRecorded(c mqtt.Client, readings []Information, speed float64, loop bool, done chan<- struct{}) {
+	log.Infof("Replaying %d recorded readings at %gx...", len(readings), speed)
+	for {
+		for i, recorded := range readings {
+			if i > 0 {
+				gap := time.Duration(recorded.Timestamp-readings[i-1].Timestamp) * time.Millisecond
+				time.Sleep(time.Duration(float64(gap) / speed))
+			}
+			reading := recorded
+			reading.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+			state.SetLast(reading.Temp, reading.Hum)
+
+			ctx, span := tracer.Start(context.Background(), "replay")
+			reading.TraceParent = tracing.TraceParent(ctx)
+			update := &IoTEvent{Body: &reading}
+
+			logging.Eventf("Replaying %s %s update: temperature %0.4fC°, humidity %0.4f", reading.Device, reading.Action, reading.Temp, reading.Hum)
+			if err := publishReading(c, update); err != nil {
+				log.Errorf("Failed to replay update: %v", err)
+				span.RecordError(err)
+				stats.IncPublishErrors()
+			} else {
+				stats.IncPublished()
+			}
+			span.End()
+		}
+		if !loop || len(readings) == 0 {
+			break
+		}
+		log.Info("Recorded readings over, replaying from the start...")
+	}
+	log.Info("Replay completed")
+	close(done)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// target temperature set from outside, and whether one was ever received
+func (s *SimulationState) Setpoint() (float64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.setpoint, s.hasSetpoint
+}
+
+// set the target temperature received from outside
+func (s *SimulationState) SetSetpoint(setpoint float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setpoint = setpoint
+	s.hasSetpoint = true
+}
+
+// parse a setpoint given as a bare number (22.5) or as a JSON object ({"setpoint": 22.5})
+func parseSetpoint(data []byte) (float64, error) {
+	text := strings.TrimSpace(string(data))
+	if setpoint, err := strconv.ParseFloat(text, 64); err == nil {
+		return setpoint, nil
+	}
+	var body struct {
+		Setpoint *float64 `json:"setpoint"`
+	}
+	if err := json.Unmarshal([]byte(text), &body); err != nil || body.Setpoint == nil {
+		return 0, fmt.Errorf("no setpoint in response: %.64s", text)
+	}
+	return *body.Setpoint, nil
+}
+
+// fetch the current setpoint from the endpoint
+func fetchSetpoint(client *http.Client, url string) (float64, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	return parseSetpoint(data)
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// poll the setpoint endpoint at every interval, keeping the last known setpoint while it is unavailable
+func pollSetpoint(url string, interval time.Duration) {
+	client := &http.Client{Timeout: interval}
+	for {
+		setpoint, err := fetchSetpoint(client, url)
+		if err != nil {
+			log.Warnf("Failed to fetch the setpoint, keeping the last known one: %v", err)
+		} else if last, ok := state.Setpoint(); !ok || last != setpoint {
+			log.Infof("Temperature setpoint changed to %0.2fC°", setpoint)
+			state.SetSetpoint(setpoint)
+		}
+		time.Sleep(interval)
+	}
+}
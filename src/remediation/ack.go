@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	log "github.com/sirupsen/logrus"
+
+	"siot/internal/dynamo"
+	"siot/internal/logging"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of Ack, sent by the device on the ack topic when it receives a remediation, telling if it was applied
+type Ack struct {
+	Device        string `json:"device"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	MessageID     string `json:"message_id,omitempty"`
+	Applied       bool   `json:"applied"`
+	Reason        string `json:"reason,omitempty"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+const (
+	// ack rows share the remediation table, keyed apart from the remediation records
+	ACK_KEY = "ack#"
+)
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// record the ack in the remediation table, keyed by device and remediation message; the time is stored as
+// acked_at, not timestamp, so that the acks stay out of the history index
+func recordAck(ack *Ack) error {
+	id := ack.MessageID
+	if strings.Compare(id, "") == 0 {
+		id = strconv.FormatInt(ack.Timestamp, 10)
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		"digest":   {S: aws.String(ACK_KEY + ack.Device + "#" + id)},
+		"device":   {S: aws.String(ack.Device)},
+		"applied":  {BOOL: aws.Bool(ack.Applied)},
+		"acked_at": {N: aws.String(strconv.FormatInt(ack.Timestamp, 10))},
+	}
+	for name, value := range map[string]string{"correlation_id": ack.CorrelationID, "message_id": ack.MessageID, "reason": ack.Reason} {
+		if strings.Compare(value, "") != 0 {
+			item[name] = &dynamodb.AttributeValue{S: aws.String(value)}
+		}
+	}
+	_, err := dynamo.PutItem(dynamodbsvc, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	}, dynamoRetry)
+	return err
+}
+
+// lambda handler of the acks, invoked by the IoT rule of the ack topic
+func ackHandler(ack Ack) error {
+
+	defer logging.Flush()
+
+	if strings.Compare(ack.Device, "") == 0 {
+		log.Warn("Ignoring ack without device")
+		return nil
+	}
+	if ack.Timestamp == 0 {
+		ack.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	if err := recordAck(&ack); err != nil {
+		return fmt.Errorf("failed to record the ack of %s: %s", ack.Device, err)
+	}
+	fields := log.Fields{"applied": ack.Applied}
+	if strings.Compare(ack.CorrelationID, "") != 0 {
+		fields["correlation_id"] = ack.CorrelationID
+	}
+	logging.EventWithFields(fields, "Remediation of %s acknowledged, applied: %t", ack.Device, ack.Applied)
+	return nil
+}
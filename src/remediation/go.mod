@@ -1,11 +1,17 @@
 require (
-	github.com/aws/aws-lambda-go v1.32.0 // indirect
-	github.com/aws/aws-sdk-go v1.44.24 // indirect
+	github.com/aws/aws-lambda-go v1.32.0
+	github.com/aws/aws-sdk-go v1.44.24
+	github.com/sirupsen/logrus v1.8.1
+	siot v0.0.0
+)
+
+require (
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+	golang.org/x/sys v0.0.0-20220919091848-fb04ddd9f9c8 // indirect
 )
 
-module remediation
+module siot/remediation
 
 go 1.17
+
+replace siot => ../
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+const (
+	HISTORY_INDEX = "device-timestamp-index"
+	HISTORY_LIMIT = 20
+)
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// the last remediations of the device, at most limit, oldest first, read from the index of the table keyed by
+// device and timestamp; the cooldown and sequence items have no timestamp, so they are not in the index
+func queryRemediationHistory(device string, limit int) ([]Item, error) {
+	out, err := dynamodbsvc.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String(historyIndex),
+		KeyConditionExpression: aws.String("#device = :device"),
+		ExpressionAttributeNames: map[string]*string{
+			"#device": aws.String("device"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":device": {S: aws.String(device)},
+		},
+		// the most recent first, to stop at the limit
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(int64(limit)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	items := []Item{}
+	if err := dynamodbattribute.UnmarshalListOfMaps(out.Items, &items); err != nil {
+		return nil, fmt.Errorf("invalid remediation record of %s: %s", device, err)
+	}
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return items, nil
+}
+
+// print the last remediations of the device as JSON lines, oldest first, or say there is none
+func printRemediationHistory(device string, limit int, out io.Writer) error {
+	items, err := queryRemediationHistory(device, limit)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		fmt.Fprintf(out, "No remediation recorded for device %s\n", device)
+		return nil
+	}
+	for _, item := range items {
+		line, _ := json.Marshal(item)
+		fmt.Fprintln(out, string(line))
+	}
+	return nil
+}
@@ -2,21 +2,36 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"math"
+	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/iot"
 	"github.com/aws/aws-sdk-go/service/iotdataplane"
 
 	log "github.com/sirupsen/logrus"
+
+	"siot/internal/awsfactory"
+	"siot/internal/config"
+	"siot/internal/dynamo"
+	"siot/internal/logging"
+	"siot/internal/preflight"
+	"siot/internal/topics"
 )
 
 // ****************************************************
@@ -33,20 +48,96 @@ type IoTEvent struct {
 
 // type of Information
 type Information struct {
-	Device string  `json:"device"`
-	Temp   float64 `json:"temperature"`
-	Hum    float64 `json:"humidity"`
-	Action string  `json:"action"`
+	Device    string  `json:"device"`
+	Temp      float64 `json:"temperature"`
+	Hum       float64 `json:"humidity"`
+	Pressure  float64 `json:"pressure,omitempty"`
+	Action    string  `json:"action"`
+	Timestamp int64   `json:"timestamp,omitempty"`
+	Sequence  int64   `json:"sequence,omitempty"`
+	Severity  string  `json:"severity,omitempty"`
+	// software version of the device the reading comes from
+	FirmwareVersion string `json:"fw_version,omitempty"`
+	// identifier of the message, the ID of the stream record that triggered it, the same when it is redelivered
+	MessageID string `json:"message_id,omitempty"`
+	// identifier of the reading that triggered the remediation, given by the device
+	CorrelationID string `json:"correlation_id,omitempty"`
 }
 
 // type of Item
 type Item struct {
-	Digest string  `json:"digest"`
-	Device string  `json:"device"`
-	Temp   float64 `json:"temperature"`
-	Hum    float64 `json:"humidity"`
-	Action string  `json:"action"`
-	TTL    int64   `json:"ttl"`
+	Digest    string  `json:"digest"`
+	Device    string  `json:"device"`
+	Temp      float64 `json:"temperature"`
+	Hum       float64 `json:"humidity"`
+	Pressure  float64 `json:"pressure,omitempty"`
+	Action    string  `json:"action"`
+	Timestamp int64   `json:"timestamp,omitempty"`
+	TTL       int64   `json:"ttl,omitempty"`
+	// software version of the device remediated, to correlate the corrections with a rollout
+	FirmwareVersion string `json:"fw_version,omitempty"`
+	CorrelationID   string `json:"correlation_id,omitempty"`
+	// items without it were written before it was introduced, with schema version 1
+	SchemaVersion int `json:"schema_version"`
+}
+
+// type of dynamoClient, satisfied by the DynamoDB client
+type dynamoClient interface {
+	PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
+	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+}
+
+// type of iotPublisher, satisfied by the IoT data client
+type iotPublisher interface {
+	Publish(input *iotdataplane.PublishInput) (*iotdataplane.PublishOutput, error)
+}
+
+// type of DedupCache, remembers the stream records already processed by the container
+type DedupCache struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	seen map[string]time.Time
+	// records in the order they were seen, the oldest first, to expire them without scanning the whole cache
+	order []dedupEntry
+}
+
+// type of dedupEntry, a record seen by the cache and when
+type dedupEntry struct {
+	id string
+	at time.Time
+}
+
+// type of Sightings, devices whose first reading was seen, kept in memory when there is no table to claim it in,
+// or in front of the table to spare it the devices already known by the container
+type Sightings struct {
+	mu      sync.Mutex
+	devices map[string]bool
+}
+
+// type of Smoother, exponential moving average of the readings of every device seen by the container
+type Smoother struct {
+	mu     sync.Mutex
+	alpha  float64
+	values map[string][2]float64
+}
+
+// type of TokenBucket, paces the remediation messages of the container, refilled at rate tokens a second
+// up to burst; the tokens go negative for the callers waiting on a reservation
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// type of TrendWindow, last readings of the temperature of every device seen by the container
+type TrendWindow struct {
+	mu       sync.Mutex
+	size     int
+	readings map[string][]float64
 }
 
 // ****************************************************
@@ -54,17 +145,79 @@ type Item struct {
 // ****************************************************
 
 var (
-	remediationTopic string
-	tableName        string
-	unixNow          string
-	logger           *log.Logger
-	dynamodbsvc      *dynamodb.DynamoDB
-	iotsvc           *iotdataplane.IoTDataPlane
+	remediationTopic  string
+	subscription      string
+	verifyLoop        bool
+	tableName         string
+	unixNow           string
+	dedupTTL          time.Duration
+	dedup             *DedupCache
+	triggerOn         string
+	firstReading      string
+	sightings         *Sightings
+	firstSeen         *Sightings
+	firstReadingTTL   time.Duration
+	setpoint          float64
+	remediationOn     bool
+	recordAcks        bool
+	cooldown          time.Duration
+	emaAlpha          float64
+	smoother          *Smoother
+	trendSize         int
+	trendWindow       *TrendWindow
+	globalRate        float64
+	globalBurst       int
+	globalWait        time.Duration
+	limiter           *TokenBucket
+	throttled         uint64
+	dynamoRetry       dynamo.RetryPolicy
+	preflightEnabled  bool
+	preflightFailFast bool
+	maxIdleConns      int
+	idleConnTimeout   time.Duration
+	tcpKeepAlive      time.Duration
+	keepWarm          time.Duration
+	severityMajor     float64
+	severityCritical  float64
+	replayEvents      string
+	historyIndex      string
+	historyDevice     string
+	historyLimit      int
+	logSampleRate     int64
+	logFlushInterval  time.Duration
+	factory           awsfactory.Factory
+	sess              *session.Session
+	logger            *log.Logger
+	dynamodbsvc       dynamoClient
+	iotsvc            iotPublisher
 )
 
 const (
 	Monitor Action = iota
 	Remediate
+	DEDUP_TTL  = 5 * time.Minute
+	TRIGGER_ON = "Monitor"
+	// no remediation on the first reading of a device, the one without old image, unless a policy acts on it
+	FIRST_READING_POLICY = "skip"
+	SETPOINT             = 20.0
+	// connections of the IoT client, kept open across the invocations of a warm container
+	MAX_IDLE_CONNS    = 10
+	IDLE_CONN_TIMEOUT = 5 * time.Minute
+	TCP_KEEPALIVE     = 30 * time.Second
+	// deviations of the temperature, in degrees, from which a remediation is major or critical
+	SEVERITY_MAJOR    = 1.0
+	SEVERITY_CRITICAL = 3.0
+	// cooldown rows share the remediation table, keyed apart from the remediation records
+	COOLDOWN_KEY = "cooldown#"
+	// sequence rows count the remediation messages sent to every device
+	SEQUENCE_KEY = "sequence#"
+	// first reading rows mark the devices whose first reading was handled, the policy applies once per device
+	FIRST_KEY = "first#"
+	// time a first reading row is kept, the next reading of the device after it is handled as its first again
+	FIRST_READING_TTL = 30 * 24 * time.Hour
+	// pace of the remediation messages of the container, when a global rate is set
+	GLOBAL_REMEDIATION_BURST = 1
+	GLOBAL_REMEDIATION_WAIT  = time.Second
 )
 
 // ****************************************************
@@ -77,80 +230,574 @@ func (d Action) String() string {
 }
 
 func init() {
-	log.SetFormatter(&log.JSONFormatter{})
-	log.SetOutput(os.Stdout)
-	log.SetLevel(log.InfoLevel)
-	logLevelStr := os.Getenv("LOG_LEVEL")
-	if strings.Compare(logLevelStr, "ERROR") == 0 {
-		log.SetLevel(log.ErrorLevel)
-	}
-	if strings.Compare(logLevelStr, "WARNING") == 0 {
-		log.SetLevel(log.WarnLevel)
-	}
-	if strings.Compare(logLevelStr, "DEBUG") == 0 {
-		log.SetLevel(log.DebugLevel)
-	}
-	remediationTopic = os.Getenv("REMEDIATION_TOPIC")
-	tableName = os.Getenv("REMEDIATION_TABLE")
-	iotsvc = iotdataplane.New(session.Must(session.NewSession(&aws.Config{
-		Region:   aws.String(os.Getenv("REGION")),
-		Endpoint: aws.String(os.Getenv("IOT_CORE_ENDPOINT")),
-	})))
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(os.Getenv("AWS_REGION")),
-	}))
+	logging.Setup(config.Lookup("LOG_LEVEL"))
+	logging.SetQuiet(config.Bool("QUIET", false))
+	// init sampling and batching of the log lines
+	logSampleRate = config.Int("LOG_SAMPLE_RATE", 1)
+	logFlushInterval = config.Duration("LOG_FLUSH_INTERVAL", 0)
+	// init the topic of the remediation messages, the canonical one of the device and building if not given
+	canonical := topics.Remediation(config.String("REMEDIATION_DEVICE", topics.DEVICE), config.String("BUILDING", topics.BUILDING))
+	remediationTopic = config.String("REMEDIATION_TOPIC", canonical)
+	// init the check that the topic reaches the subscription of the device
+	subscription = config.String("REMEDIATION_SUBSCRIPTION", canonical)
+	verifyLoop = config.Bool("VERIFY_LOOP", false)
+	tableName = config.Lookup("REMEDIATION_TABLE")
+	// init the index of the table answering the remediation history of a device
+	historyIndex = config.String("REMEDIATION_HISTORY_INDEX", HISTORY_INDEX)
+	historyLimit = HISTORY_LIMIT
+
+	// init dedup ttl for already processed stream records
+	dedupTTL = config.Duration("DEDUP_TTL", DEDUP_TTL)
+
+	// init preflight checks of the resources at cold start
+	preflightEnabled = config.Bool("PREFLIGHT", false)
+	preflightFailFast = config.Bool("PREFLIGHT_FAIL_FAST", false)
+
+	// init the actions that trigger a remediation
+	triggerOn = config.String("TRIGGER_ON", TRIGGER_ON)
+	// init the handling of the first reading of a device, and the temperature it is remediated to if asked
+	firstReading = config.String("FIRST_READING_POLICY", FIRST_READING_POLICY)
+	setpoint = config.Float("SETPOINT", SETPOINT)
+	firstReadingTTL = config.Duration("FIRST_READING_TTL", FIRST_READING_TTL)
+	// init the remediation switch, resolved once at cold start
+	remediationOn = strings.Compare(config.Lookup("REMEDIATION_LOGIC"), "true") == 0
+	// init the consumer of the acks of the devices, in place of the remediation of the stream
+	recordAcks = config.Bool("RECORD_ACKS", false)
+	// init the smoothing of the readings the remediation is based on, disabled if zero
+	emaAlpha = config.Float("EMA_ALPHA", 0)
+	// init the readings a trend must span before the remediation, disabled if below 2
+	trendSize = int(config.Int("TREND_WINDOW", 0))
+	// init the pace of the remediation messages of the container, disabled if zero
+	globalRate = config.Float("GLOBAL_REMEDIATION_RATE", 0)
+	globalBurst = int(config.Int("GLOBAL_REMEDIATION_BURST", GLOBAL_REMEDIATION_BURST))
+	globalWait = config.Duration("GLOBAL_REMEDIATION_WAIT", GLOBAL_REMEDIATION_WAIT)
+	// init the minimum time between two remediations of the same device, disabled if zero
+	cooldown = config.Duration("REMEDIATION_COOLDOWN", 0)
+	// init the bands the deviation of a remediation is classified into
+	severityMajor = config.Float("SEVERITY_MAJOR", SEVERITY_MAJOR)
+	severityCritical = config.Float("SEVERITY_CRITICAL", SEVERITY_CRITICAL)
+	// init the reuse of the connections of the IoT client, and their periodic warm up if not zero
+	maxIdleConns = int(config.Int("MAX_IDLE_CONNS", MAX_IDLE_CONNS))
+	idleConnTimeout = config.Duration("IDLE_CONN_TIMEOUT", IDLE_CONN_TIMEOUT)
+	tcpKeepAlive = config.Duration("TCP_KEEPALIVE", TCP_KEEPALIVE)
+	keepWarm = config.Duration("KEEP_WARM", 0)
+
+	// init retry of the throttled dynamo writes
+	dynamoRetry = dynamo.RetryPolicy{
+		MaxRetries: int(config.Int("DYNAMO_MAX_RETRIES", dynamo.MAX_RETRIES)),
+		BaseDelay:  config.Duration("DYNAMO_RETRY_DELAY", dynamo.BASE_DELAY),
+		Jitter:     config.Float("DYNAMO_RETRY_JITTER", dynamo.JITTER),
+	}
+	// init the endpoint and region of the AWS clients, the emulated ones if overridden
+	factory = awsfactory.New()
+	sess = factory.Session()
 	dynamodbsvc = dynamodb.New(sess)
 }
 
+// create the HTTP client of the IoT client, keeping its connections idle long enough to be reused by a warm container
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: tcpKeepAlive,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     idleConnTimeout,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+}
+
+// send a no-op request to the endpoint at every interval, so that the pooled connection does not go idle;
+// an unsigned HEAD needs no permission and has no effect, whatever its status
+func keepConnectionWarm(client *http.Client, endpoint string, interval time.Duration) {
+	for range time.Tick(interval) {
+		res, err := client.Head(endpoint)
+		if err != nil {
+			log.Debugf("Keep warm request to %s failed: %s", endpoint, err)
+			continue
+		}
+		res.Body.Close()
+	}
+}
+
+// create the IoT data client, discovering the ATS data endpoint of the account if none is configured
+func newIoTDataPlane(client *http.Client) (*iotdataplane.IoTDataPlane, error) {
+	endpoint := config.Lookup("IOT_CORE_ENDPOINT")
+	if strings.Compare(endpoint, "") == 0 && factory.Overridden() {
+		endpoint = factory.Endpoint
+		log.Infof("IoT data endpoint overridden: %s", endpoint)
+	} else if strings.Compare(endpoint, "") == 0 {
+		out, err := iot.New(sess).DescribeEndpoint(&iot.DescribeEndpointInput{EndpointType: aws.String("iot:Data-ATS")})
+		if err != nil {
+			return nil, fmt.Errorf("IOT_CORE_ENDPOINT not set and discovery failed: %s", err)
+		}
+		endpoint = aws.StringValue(out.EndpointAddress)
+		log.Infof("IoT data endpoint discovered: %s", endpoint)
+	} else {
+		log.Infof("IoT data endpoint configured: %s", endpoint)
+	}
+	return iotdataplane.New(session.Must(session.NewSession(factory.Config().WithEndpoint(endpoint).WithHTTPClient(client)))), nil
+}
+
+// create a cache of processed records expiring after the given ttl
+func newDedupCache(ttl time.Duration) *DedupCache {
+	return &DedupCache{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// create an empty set of sightings
+func newSightings() *Sightings {
+	return &Sightings{devices: make(map[string]bool)}
+}
+
+// create a smoother weighting every new reading by alpha
+func newSmoother(alpha float64) *Smoother {
+	return &Smoother{alpha: alpha, values: make(map[string][2]float64)}
+}
+
+// create a bucket refilled at rate tokens a second up to burst, full at start
+func newTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take a token, waiting for it if it is available within wait; false, without taking it, otherwise
+func (b *TokenBucket) Take(wait time.Duration) bool {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.mu.Unlock()
+		return true
+	}
+	delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if delay > wait {
+		b.mu.Unlock()
+		return false
+	}
+	b.tokens--
+	b.mu.Unlock()
+	time.Sleep(delay)
+	return true
+}
+
+// create a window of the last size readings of every device
+func newTrendWindow(size int) *TrendWindow {
+	return &TrendWindow{size: size, readings: make(map[string][]float64)}
+}
+
+// add the reading of the device to its window, returning rising or falling if the window is full and every
+// reading in it is above or below the previous one, empty otherwise
+func (w *TrendWindow) Add(device string, temp float64) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	readings := append(w.readings[device], temp)
+	if len(readings) > w.size {
+		readings = readings[len(readings)-w.size:]
+	}
+	w.readings[device] = readings
+	if len(readings) < w.size {
+		return ""
+	}
+	rising, falling := true, true
+	for i := 1; i < len(readings); i++ {
+		rising = rising && readings[i] > readings[i-1]
+		falling = falling && readings[i] < readings[i-1]
+	}
+	switch {
+	case rising:
+		return "rising"
+	case falling:
+		return "falling"
+	}
+	return ""
+}
+
+// add the reading of the device to its average, returning the smoothed temperature and humidity
+func (s *Smoother) Update(device string, temp float64, hum float64) (float64, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.values[device]
+	if !ok {
+		current = [2]float64{temp, hum}
+	} else {
+		current = [2]float64{s.alpha*temp + (1-s.alpha)*current[0], s.alpha*hum + (1-s.alpha)*current[1]}
+	}
+	s.values[device] = current
+	return current[0], current[1]
+}
+
+// report whether the id was already seen within the ttl, remembering it otherwise
+func (d *DedupCache) Seen(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for len(d.order) > 0 && now.Sub(d.order[0].at) > d.ttl {
+		oldest := d.order[0]
+		d.order = d.order[1:]
+		// a record forgotten and seen again since is expired by its later sighting
+		if at, ok := d.seen[oldest.id]; ok && at.Equal(oldest.at) {
+			delete(d.seen, oldest.id)
+		}
+	}
+	if _, ok := d.seen[id]; ok {
+		return true
+	}
+	d.seen[id] = now
+	d.order = append(d.order, dedupEntry{id: id, at: now})
+	return false
+}
+
+// report whether this is the first sighting of the device, remembering it
+func (s *Sightings) Claim(device string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.devices[device] {
+		return false
+	}
+	s.devices[device] = true
+	return true
+}
+
+// report whether the device was already seen, without remembering it
+func (s *Sightings) Known(device string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.devices[device]
+}
+
+// forget the device, so that its next reading is claimed as first again
+func (s *Sightings) Forget(device string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.devices, device)
+}
+
+// forget the records, so that they are processed again when the stream retries them
+func (d *DedupCache) Forget(records []events.DynamoDBEventRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, record := range records {
+		delete(d.seen, record.EventID)
+	}
+}
+
+// drop the records of the stream already processed by this container
+func deduplicate(stream events.DynamoDBEvent) events.DynamoDBEvent {
+	var records []events.DynamoDBEventRecord
+	for _, record := range stream.Records {
+		if dedup.Seen(record.EventID) {
+			log.Infof("Skipping already processed record %s", record.EventID)
+			continue
+		}
+		records = append(records, record)
+	}
+	return events.DynamoDBEvent{Records: records}
+}
+
+// report whether the action of the changed record is allowed to trigger a remediation
+func triggers(record events.DynamoDBEventRecord) bool {
+	action := ""
+	if value, ok := record.Change.NewImage["action"]; ok {
+		action = value.String()
+	}
+	if strings.Compare(action, Remediate.String()) == 0 {
+		return false
+	}
+	for _, allowed := range strings.Split(triggerOn, ",") {
+		if strings.Compare(strings.TrimSpace(allowed), action) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// classify the deviation of the temperature from the level it is compared to into minor, major or critical
+func severity(deviation float64) string {
+	deviation = math.Abs(deviation)
+	switch {
+	case deviation >= severityCritical:
+		return "critical"
+	case deviation >= severityMajor:
+		return "major"
+	}
+	return "minor"
+}
+
 // persist on DynamoDB metrics for the specific device using the information in the message
-func persistOnDynamoDB(event *IoTEvent) {
+func persistOnDynamoDB(event *IoTEvent) error {
 	i := &Item{
-		Digest: unixNow,
-		Device: event.Body.Device,
-		Temp:   event.Body.Temp,
-		Hum:    event.Body.Hum,
-		Action: event.Body.Action,
+		Digest:          unixNow,
+		Device:          event.Body.Device,
+		Temp:            event.Body.Temp,
+		Hum:             event.Body.Hum,
+		Pressure:        event.Body.Pressure,
+		Action:          event.Body.Action,
+		Timestamp:       event.Body.Timestamp,
+		FirmwareVersion: event.Body.FirmwareVersion,
+		CorrelationID:   event.Body.CorrelationID,
+		SchemaVersion:   dynamo.SCHEMA_VERSION,
 	}
 	log.Debugf("Dynamo table name: %s", tableName)
 	dae, err := dynamodbattribute.MarshalMap(i)
 	if err != nil {
 		log.Error(fmt.Sprintf("Error in dynamodbattribute: %s", err))
+		return err
 	}
 	input := &dynamodb.PutItemInput{
 		Item:      dae,
 		TableName: aws.String(tableName),
 	}
-	_, err = dynamodbsvc.PutItem(input)
+	_, err = dynamo.PutItem(dynamodbsvc, input, dynamoRetry)
 	if err != nil {
 		log.Errorf("Error in PutItem: %s", err)
 	}
+	return err
+}
+
+// claim the remediation of the device in the table, false if it was already remediated within the cooldown;
+// the conditional write keeps concurrent containers from remediating the same device twice
+func claimCooldown(device string, now time.Time) (bool, error) {
+	if cooldown <= 0 {
+		return true, nil
+	}
+	at := now.UnixNano() / int64(time.Millisecond)
+	_, err := dynamo.PutItem(dynamodbsvc, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"digest":           {S: aws.String(COOLDOWN_KEY + device)},
+			"device":           {S: aws.String(device)},
+			"last_remediation": {N: aws.String(strconv.FormatInt(at, 10))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(digest) OR last_remediation <= :threshold"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":threshold": {N: aws.String(strconv.FormatInt(at-int64(cooldown/time.Millisecond), 10))},
+		},
+	}, dynamoRetry)
+	if aerr, ok := err.(awserr.Error); ok && strings.Compare(aerr.Code(), dynamodb.ErrCodeConditionalCheckFailedException) == 0 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// claim the first reading of the device for the record, false if one was already seen; in the table the
+// conditional write keeps the policy to one reading per device across the containers, in memory when the
+// sightings are local; the devices known by the container are answered without calling the table
+func claimFirstReading(device string, record string) (bool, error) {
+	if sightings != nil {
+		return sightings.Claim(device), nil
+	}
+	if firstSeen != nil && firstSeen.Known(device) {
+		return false, nil
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		"digest":     {S: aws.String(FIRST_KEY + device)},
+		"device":     {S: aws.String(device)},
+		"claimed_by": {S: aws.String(record)},
+	}
+	if firstReadingTTL > 0 {
+		item["ttl"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(firstReadingTTL).Unix(), 10))}
+	}
+	_, err := dynamo.PutItem(dynamodbsvc, &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(digest)"),
+	}, dynamoRetry)
+	claimed := err == nil
+	if aerr, ok := err.(awserr.Error); ok && strings.Compare(aerr.Code(), dynamodb.ErrCodeConditionalCheckFailedException) == 0 {
+		err = nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if firstSeen != nil {
+		firstSeen.Claim(device)
+	}
+	return claimed, nil
+}
+
+// release the claims of the first readings taken by the records, when they could not be remediated, so that the
+// retry of the stream finds them first again; a claim taken by another record is left in place
+func releaseFirstReadings(records []events.DynamoDBEventRecord) {
+	if sightings != nil {
+		return
+	}
+	for _, record := range records {
+		if _, ok := record.Change.OldImage["temperature"]; ok {
+			continue
+		}
+		value, ok := record.Change.NewImage["device"]
+		if !ok || value.DataType() != events.DataTypeString {
+			continue
+		}
+		device := value.String()
+		if firstSeen != nil {
+			firstSeen.Forget(device)
+		}
+		_, err := dynamo.DeleteItem(dynamodbsvc, &dynamodb.DeleteItemInput{
+			TableName: aws.String(tableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"digest": {S: aws.String(FIRST_KEY + device)},
+			},
+			ConditionExpression: aws.String("claimed_by = :record"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":record": {S: aws.String(record.EventID)},
+			},
+		}, dynamoRetry)
+		if aerr, ok := err.(awserr.Error); ok && strings.Compare(aerr.Code(), dynamodb.ErrCodeConditionalCheckFailedException) == 0 {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Error in release of the first reading of %s: %s", device, err)
+		}
+	}
+}
+
+// release the claim of the remediation of the device taken at now, when the remediation could not be persisted;
+// the claim replaced one older than the cooldown, so removing it lets the retry of the record claim it again,
+// unless another container claimed the device since
+func releaseCooldown(device string, now time.Time) error {
+	if cooldown <= 0 {
+		return nil
+	}
+	_, err := dynamo.DeleteItem(dynamodbsvc, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"digest": {S: aws.String(COOLDOWN_KEY + device)},
+		},
+		ConditionExpression: aws.String("last_remediation = :at"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":at": {N: aws.String(strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10))},
+		},
+	}, dynamoRetry)
+	if aerr, ok := err.(awserr.Error); ok && strings.Compare(aerr.Code(), dynamodb.ErrCodeConditionalCheckFailedException) == 0 {
+		return nil
+	}
+	return err
+}
+
+// increment and return the sequence number of the remediation messages sent to the device, letting it
+// detect the messages lost on the QoS 0 subscription
+func nextSequence(device string) (int64, error) {
+	out, err := dynamo.UpdateItem(dynamodbsvc, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"digest": {S: aws.String(SEQUENCE_KEY + device)},
+		},
+		UpdateExpression: aws.String("ADD #seq :one"),
+		ExpressionAttributeNames: map[string]*string{
+			"#seq": aws.String("sequence"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {N: aws.String("1")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	}, dynamoRetry)
+	if err != nil {
+		return 0, err
+	}
+	seq, ok := out.Attributes["sequence"]
+	if !ok {
+		return 0, fmt.Errorf("no sequence returned for %s", device)
+	}
+	return strconv.ParseInt(aws.StringValue(seq.N), 10, 64)
 }
 
 // ****************************************************
 // ****************** CORE FUNCTION *******************
 // ****************************************************
 
-// remediation logic
-func remediationLogic(stream events.DynamoDBEvent) *IoTEvent {
+// remediation logic, nil if no record of the stream triggers a remediation
+func remediationLogic(stream events.DynamoDBEvent) (*IoTEvent, error) {
 	var newTemperature, oldTemperature float64
 	var newHumidity, oldHumidity float64
-	var deviceId string
+	var newPressure, oldPressure float64
+	var smoothedTemperature, smoothedHumidity float64
+	var deviceId, fwVersion, messageID, correlationID string
+	var timestamp int64
+	var trend string
+	// whether the last record processed is the first reading of its device, remediated to the setpoint
+	var toSetpoint bool
+	processed := 0
 	for _, record := range stream.Records {
+		if !triggers(record) {
+			log.Infof("Skipping record %s: action not in %s", record.EventID, triggerOn)
+			continue
+		}
 		log.Debugf("Processing request data for event ID %s, type %s.\n", record.EventID, record.EventName)
+		// every version of the items carries the fields read here, the unversioned ones are version 1
+		schemaVersion := int64(dynamo.LEGACY_SCHEMA_VERSION)
+		if value, ok := record.Change.NewImage["schema_version"]; ok {
+			schemaVersion, _ = value.Integer()
+		}
+		log.Debugf("Schema version of event ID %s: %d\n", record.EventID, schemaVersion)
+		// the reading is parsed apart from the batch, a first reading skipped must not change the others
+		var device, version, correlation string
+		var at int64
+		var temperature, humidity, pressure float64
 		for name, value := range record.Change.NewImage {
 			if strings.Compare(name, "device") == 0 {
-				deviceId = value.String()
-				log.Debugf("Attribute name: %s, device: %s\n", name, deviceId)
+				device = value.String()
+				log.Debugf("Attribute name: %s, device: %s\n", name, device)
+			}
+			if strings.Compare(name, "fw_version") == 0 {
+				version = value.String()
+			}
+			if strings.Compare(name, "correlation_id") == 0 {
+				correlation = value.String()
+			}
+			if strings.Compare(name, "timestamp") == 0 {
+				at, _ = value.Integer()
+				log.Debugf("Attribute name: %s, value: %d\n", name, at)
 			}
 			if strings.Compare(name, "temperature") == 0 {
-				newTemperature, _ = value.Float()
-				log.Debugf("Attribute name: %s, value: %f\n", name, newTemperature)
+				temperature, _ = value.Float()
+				log.Debugf("Attribute name: %s, value: %f\n", name, temperature)
 			}
 			if strings.Compare(name, "humidity") == 0 {
-				newHumidity, _ = value.Float()
-				log.Debugf("Attribute name: %s, value: %f\n", name, newHumidity)
+				humidity, _ = value.Float()
+				log.Debugf("Attribute name: %s, value: %f\n", name, humidity)
+			}
+			if strings.Compare(name, "pressure") == 0 {
+				pressure, _ = value.Float()
+				log.Debugf("Attribute name: %s, value: %f\n", name, pressure)
 			}
 		}
+		// a missing old image is not enough, the items of the history are all inserted without one
+		first := false
+		if _, ok := record.Change.OldImage["temperature"]; !ok {
+			claimed, err := claimFirstReading(device, record.EventID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check the first reading of %s: %s", device, err)
+			}
+			first = claimed
+		}
+		if first {
+			switch firstReading {
+			case "skip":
+				log.Infof("Skipping record %s: first reading of %s", record.EventID, device)
+				continue
+			case "seed":
+				if smoother != nil {
+					smoother.Update(device, temperature, humidity)
+				}
+				if trendWindow != nil {
+					trendWindow.Add(device, temperature)
+				}
+				log.Infof("Skipping record %s: first reading of %s recorded as baseline", record.EventID, device)
+				continue
+			}
+		}
+		processed++
+		toSetpoint = first
+		messageID = record.EventID
+		deviceId, fwVersion, correlationID, timestamp = device, version, correlation, at
+		newTemperature, newHumidity, newPressure = temperature, humidity, pressure
+		// without old image the reading is its own baseline
+		oldTemperature, oldHumidity, oldPressure = temperature, humidity, pressure
 		for name, value := range record.Change.OldImage {
 			if strings.Compare(name, "temperature") == 0 {
 				oldTemperature, _ = value.Float()
@@ -160,32 +807,103 @@ func remediationLogic(stream events.DynamoDBEvent) *IoTEvent {
 				oldHumidity, _ = value.Float()
 				log.Debugf("Attribute name: %s, value: %f\n", name, oldHumidity)
 			}
+			if strings.Compare(name, "pressure") == 0 {
+				oldPressure, _ = value.Float()
+				log.Debugf("Attribute name: %s, value: %f\n", name, oldPressure)
+			}
+		}
+		if smoother != nil {
+			smoothedTemperature, smoothedHumidity = smoother.Update(deviceId, newTemperature, newHumidity)
 		}
+		if trendWindow != nil {
+			trend = trendWindow.Add(deviceId, newTemperature)
+		}
+	}
+	if processed == 0 {
+		return nil, nil
+	}
+	// without history there is nothing to compare the reading to, the setpoint is the target
+	if toSetpoint {
+		log.Infof("First reading of %s, remediating to the setpoint %g", deviceId, setpoint)
+		return &IoTEvent{Body: &Information{Device: deviceId, Temp: setpoint, Hum: newHumidity, Pressure: newPressure, Action: Remediate.String(), Timestamp: timestamp, Severity: severity(newTemperature - setpoint), FirmwareVersion: fwVersion, MessageID: messageID, CorrelationID: correlationID}}, nil
+	}
+	// with a trend window a single delta is not enough, the last readings must all move the same way
+	if trendWindow != nil {
+		if strings.Compare(trend, "") == 0 {
+			log.Infof("No trend of %s over the last %d readings", deviceId, trendSize)
+			return nil, nil
+		}
+		log.Debugf("Temperature of %s %s over the last %d readings\n", deviceId, trend, trendSize)
+	}
+	// with smoothing the reading is compared to the average level instead of the previous, possibly noisy, one
+	if smoother != nil {
+		log.Debugf("Smoothed temperature: %f, humidity: %f\n", smoothedTemperature, smoothedHumidity)
+		oldTemperature = smoothedTemperature
+		oldHumidity = smoothedHumidity
 	}
 	if newTemperature > oldTemperature {
 		log.Debugf("Remediate by cooling down environment: %f, value: %f\n", oldTemperature, oldHumidity)
 	} else {
 		log.Debugf("Remediate by warming up environment: %f, value: %f\n", oldTemperature, oldHumidity)
 	}
-	if oldTemperature == 0 || oldHumidity == 0 {
-		oldTemperature = newTemperature
-		oldHumidity = newHumidity
-	}
-	remediationMessage := &IoTEvent{Body: &Information{Device: deviceId, Temp: oldTemperature, Hum: oldHumidity, Action: Remediate.String()}}
-	persistOnDynamoDB(remediationMessage)
-	return remediationMessage
+	return &IoTEvent{Body: &Information{Device: deviceId, Temp: oldTemperature, Hum: oldHumidity, Pressure: oldPressure, Action: Remediate.String(), Timestamp: timestamp, Severity: severity(newTemperature - oldTemperature), FirmwareVersion: fwVersion, MessageID: messageID, CorrelationID: correlationID}}, nil
 }
 
 // lambda handler
-func handler(stream events.DynamoDBEvent) {
+func handler(stream events.DynamoDBEvent) error {
+
+	defer logging.Flush()
 
 	// isolate unix timestamp
 	unixNow = strconv.FormatInt(time.Now().Unix(), 10)
 
 	e, _ := json.Marshal(stream)
-	if strings.Compare(os.Getenv("REMEDIATION_LOGIC"), "true") == 0 {
-		log.Infof("Remediation logic enabled for event: %s", string(e))
-		event := remediationLogic(stream)
+	if remediationOn {
+		logging.Verbosef("Remediation logic enabled for event: %s", string(e))
+		stream = deduplicate(stream)
+		if len(stream.Records) == 0 {
+			log.Info("No new records to remediate")
+			return nil
+		}
+		event, err := remediationLogic(stream)
+		if err != nil {
+			releaseFirstReadings(stream.Records)
+			dedup.Forget(stream.Records)
+			return err
+		}
+		if event == nil {
+			log.Info("No records triggering a remediation")
+			return nil
+		}
+		// paced before the cooldown is claimed, so that a dropped remediation does not hold the device
+		if limiter != nil && !limiter.Take(globalWait) {
+			n := atomic.AddUint64(&throttled, 1)
+			log.WithField("throttled_remediations", n).Warnf("Dropping remediation of %s: over the global rate of %g a second", event.Body.Device, globalRate)
+			return nil
+		}
+		claimedAt := time.Now()
+		claimed, err := claimCooldown(event.Body.Device, claimedAt)
+		if err != nil {
+			releaseFirstReadings(stream.Records)
+			dedup.Forget(stream.Records)
+			return fmt.Errorf("failed to check the remediation cooldown: %s", err)
+		}
+		if !claimed {
+			log.Infof("Skipping remediation of %s: already remediated in the last %s", event.Body.Device, cooldown)
+			return nil
+		}
+		if err := persistOnDynamoDB(event); err != nil {
+			// the remediation is not sent, so the device must not be held by its cooldown
+			if rerr := releaseCooldown(event.Body.Device, claimedAt); rerr != nil {
+				log.Errorf("Error in release of the cooldown of %s: %s", event.Body.Device, rerr)
+			}
+			releaseFirstReadings(stream.Records)
+			dedup.Forget(stream.Records)
+			return fmt.Errorf("failed to persist the remediation: %s", err)
+		}
+		if event.Body.Sequence, err = nextSequence(event.Body.Device); err != nil {
+			log.Errorf("Error in sequence update, sending the remediation without sequence: %s", err)
+		}
 		payload, _ := json.Marshal(event)
 		res, err := iotsvc.Publish(&iotdataplane.PublishInput{
 			Topic:   aws.String(remediationTopic),
@@ -193,15 +911,214 @@ func handler(stream events.DynamoDBEvent) {
 			Qos:     aws.Int64(0),
 		})
 		if err != nil {
-			log.Errorf("Error in iot publish: %s", err)
+			// the remediation never reached the device, the retry of the stream must send it again
+			if rerr := releaseCooldown(event.Body.Device, claimedAt); rerr != nil {
+				log.Errorf("Error in release of the cooldown of %s: %s", event.Body.Device, rerr)
+			}
+			releaseFirstReadings(stream.Records)
+			dedup.Forget(stream.Records)
+			return fmt.Errorf("failed to publish the remediation: %s", err)
+		}
+		logging.EventWithFields(log.Fields{"correlation_id": event.Body.CorrelationID}, "Remediation message sent: %s", string(payload))
+		// a critical remediation is logged at warn level with its severity, for the operators to alarm on
+		if strings.Compare(event.Body.Severity, "critical") == 0 {
+			log.WithField("severity", event.Body.Severity).Warnf("Critical remediation of %s sent", event.Body.Device)
 		}
-		log.Infof("Remediation message sent: %s", string(payload))
 		log.Debugf("Result: %s", res)
 	} else {
-		log.Infof("Remediation logic disabled for event: %s", string(e))
+		logging.Verbosef("Remediation logic disabled for event: %s", string(e))
 	}
+	return nil
+}
+
+// check the parameters and the resources the function needs, without calling AWS
+func validateConfig() []error {
+	var problems []error
+	// a replay neither writes nor publishes anything
+	if strings.Compare(replayEvents, "") == 0 {
+		problems = append(problems, config.Required("REMEDIATION_TABLE"))
+	}
+	if strings.Compare(remediationTopic, "") == 0 || strings.ContainsAny(remediationTopic, "+#") {
+		problems = append(problems, fmt.Errorf("invalid remediation topic: %s", remediationTopic))
+	} else if verifyLoop {
+		problems = append(problems, topics.VerifyLoop(subscription, remediationTopic))
+	}
+	if dynamoRetry.MaxRetries < 0 {
+		problems = append(problems, fmt.Errorf("dynamo max retries must not be negative: %d", dynamoRetry.MaxRetries))
+	}
+	if maxIdleConns < 0 {
+		problems = append(problems, fmt.Errorf("max idle connections must not be negative: %d", maxIdleConns))
+	}
+	if firstReadingTTL < 0 {
+		problems = append(problems, fmt.Errorf("first reading ttl must not be negative: %s", firstReadingTTL))
+	}
+	if keepWarm < 0 {
+		problems = append(problems, fmt.Errorf("keep warm interval must not be negative: %s", keepWarm))
+	}
+	switch firstReading {
+	case "skip", "seed", "remediate-to-setpoint":
+	default:
+		problems = append(problems, fmt.Errorf("unknown first reading policy: %s", firstReading))
+	}
+	if severityMajor <= 0 || severityCritical < severityMajor {
+		problems = append(problems, fmt.Errorf("severity thresholds must be positive and increasing: major %g, critical %g", severityMajor, severityCritical))
+	}
+	if historyLimit < 1 {
+		problems = append(problems, fmt.Errorf("history limit must be at least 1: %d", historyLimit))
+	}
+	if globalRate < 0 || globalBurst < 1 || globalWait < 0 {
+		problems = append(problems, fmt.Errorf("global remediation rate and wait must not be negative, burst at least 1: rate %g, burst %d, wait %s", globalRate, globalBurst, globalWait))
+	}
+	if trendSize < 0 {
+		problems = append(problems, fmt.Errorf("trend window must not be negative: %d", trendSize))
+	}
+	if emaAlpha < 0 || emaAlpha > 1 {
+		problems = append(problems, fmt.Errorf("ema alpha must be between 0 and 1: %g", emaAlpha))
+	}
+	if logSampleRate < 1 {
+		problems = append(problems, fmt.Errorf("log sample rate must be at least 1: %d", logSampleRate))
+	}
+	if logFlushInterval < 0 {
+		problems = append(problems, fmt.Errorf("log flush interval must not be negative: %s", logFlushInterval))
+	}
+	return problems
 }
 
 func main() {
+	flag.BoolVar(&recordAcks, "record-acks", recordAcks, "Record the acks of the devices received from the IoT rule of the ack topic, instead of remediating the stream")
+	flag.StringVar(&firstReading, "first-reading-policy", firstReading, "Handling of the first reading of a device, without history: skip, seed (baseline of the smoothing and trend, no action) or remediate-to-setpoint")
+	flag.DurationVar(&firstReadingTTL, "first-reading-ttl", firstReadingTTL, "Time the first reading of a device is remembered, the next reading after it is handled as the first again (0 to keep it forever)")
+	flag.Float64Var(&setpoint, "setpoint", setpoint, "Temperature the first reading of a device is remediated to with the remediate-to-setpoint policy")
+	flag.StringVar(&triggerOn, "trigger-on", triggerOn, "Comma separated actions allowed to trigger a remediation (Remediate is always ignored)")
+	flag.Float64Var(&globalRate, "global-remediation-rate", globalRate, "Remediation messages a second sent by the container, whatever the device (0 for no limit)")
+	flag.IntVar(&globalBurst, "global-remediation-burst", globalBurst, "Remediation messages the container can send at once within the global rate")
+	flag.DurationVar(&globalWait, "global-remediation-wait", globalWait, "Longest wait of a remediation over the global rate before it is dropped")
+	flag.IntVar(&trendSize, "trend-window", trendSize, "Readings of a device that must all rise or all fall before a remediation (0 to react to every reading)")
+	flag.Float64Var(&emaAlpha, "ema-alpha", emaAlpha, "Weight (0-1) of a new reading in the moving average the remediation is based on (0 to disable)")
+	flag.Float64Var(&severityMajor, "severity-major", severityMajor, "Deviation of the temperature (degrees) from which a remediation is major")
+	flag.Float64Var(&severityCritical, "severity-critical", severityCritical, "Deviation of the temperature (degrees) from which a remediation is critical")
+	flag.DurationVar(&cooldown, "remediation-cooldown", cooldown, "Minimum time between two remediations of the same device (0 to disable)")
+	flag.DurationVar(&dedupTTL, "dedup-ttl", dedupTTL, "Time window in which an already processed stream record is skipped")
+	flag.IntVar(&dynamoRetry.MaxRetries, "dynamo-max-retries", dynamoRetry.MaxRetries, "Retries of a throttled or failed DynamoDB write before giving up")
+	flag.DurationVar(&dynamoRetry.BaseDelay, "dynamo-retry-delay", dynamoRetry.BaseDelay, "Delay before the first retry of a DynamoDB write, doubled at every retry")
+	flag.Float64Var(&dynamoRetry.Jitter, "dynamo-retry-jitter", dynamoRetry.Jitter, "Fraction (0-1) of the retry delay randomized to spread the retries")
+	flag.IntVar(&maxIdleConns, "max-idle-conns", maxIdleConns, "Idle connections of the IoT client kept open for reuse")
+	flag.DurationVar(&idleConnTimeout, "idle-conn-timeout", idleConnTimeout, "Time an idle connection of the IoT client is kept open")
+	flag.DurationVar(&tcpKeepAlive, "tcp-keepalive", tcpKeepAlive, "Interval of the TCP keepalive probes of the IoT client connections")
+	flag.DurationVar(&keepWarm, "keep-warm", keepWarm, "Interval of a no-op request keeping the IoT client connection warm (0 to disable)")
+	flag.StringVar(&remediationTopic, "remediation-topic", remediationTopic, "Topic the remediation messages are published to")
+	flag.StringVar(&subscription, "remediation-subscription", subscription, "Topic filter the device receives the remediation messages from, checked by --verify-loop")
+	flag.BoolVar(&verifyLoop, "verify-loop", verifyLoop, "Refuse to start if the remediation topic does not reach the subscription of the device")
+	flag.BoolVar(&preflightEnabled, "preflight", preflightEnabled, "Check table and IoT access at cold start")
+	flag.BoolVar(&preflightFailFast, "preflight-fail-fast", preflightFailFast, "Refuse to start if a preflight check fails")
+	flag.StringVar(&historyDevice, "history", historyDevice, "Print the last remediations of the device, oldest first, and exit")
+	flag.IntVar(&historyLimit, "history-limit", historyLimit, "Number of remediations printed by --history")
+	flag.StringVar(&historyIndex, "history-index", historyIndex, "Index of the remediation table keyed by device and timestamp")
+	flag.StringVar(&replayEvents, "replay-events", replayEvents, "Print the decisions of the remediation logic over the recorded stream events or history readings of the file, as a dry run, and exit")
+	flag.Int64Var(&logSampleRate, "log-sample-rate", logSampleRate, "Keep one in every N info and debug lines, all the warnings and errors (1 keeps every line)")
+	flag.DurationVar(&logFlushInterval, "log-flush-interval", logFlushInterval, "Buffer the log lines and write them in batches at this interval (0 to write every line at once)")
+	validateOnly := config.ValidateOnlyFlag()
+	printSample := flag.Bool("print-sample-payload", false, "Print an example of the DynamoDB stream event expected and exit")
+	config.PrefixFlag()
+	awsfactory.EndpointFlag()
+	flag.Parse()
+
+	// sample and buffer the log lines, now that the flags are known
+	logging.SetSampleRate(logSampleRate)
+	logging.SetBuffering(logFlushInterval)
+
+	if *printSample {
+		now := time.Now()
+		image := func(temp string, hum string, at time.Time) map[string]events.DynamoDBAttributeValue {
+			return map[string]events.DynamoDBAttributeValue{
+				"digest":      events.NewStringAttribute(strconv.FormatInt(at.Unix(), 10)),
+				"device":      events.NewStringAttribute("930129302"),
+				"temperature": events.NewNumberAttribute(temp),
+				"humidity":    events.NewNumberAttribute(hum),
+				"action":      events.NewStringAttribute(Monitor.String()),
+				"timestamp":   events.NewNumberAttribute(strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)),
+			}
+		}
+		sample, _ := json.MarshalIndent(events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{{
+			EventID:     "c4ca4238a0b923820dcc509a6f75849b",
+			EventName:   "MODIFY",
+			EventSource: "aws:dynamodb",
+			AWSRegion:   "eu-west-1",
+			Change: events.DynamoDBStreamRecord{
+				ApproximateCreationDateTime: events.SecondsEpochTime{Time: now},
+				NewImage:                    image("27.4312", "60.4312", now),
+				OldImage:                    image("27.3801", "60.3801", now.Add(-2*time.Second)),
+				StreamViewType:              "NEW_AND_OLD_IMAGES",
+			},
+		}}}, "", "  ")
+		fmt.Println(string(sample))
+		return
+	}
+
+	if err := config.Validate(validateConfig(), *validateOnly); err != nil {
+		log.Fatal(err)
+	}
+	if emaAlpha > 0 && emaAlpha < 1 {
+		smoother = newSmoother(emaAlpha)
+	}
+	if trendSize > 1 {
+		trendWindow = newTrendWindow(trendSize)
+	}
+	if globalRate > 0 {
+		limiter = newTokenBucket(globalRate, globalBurst)
+	}
+
+	if strings.Compare(historyDevice, "") != 0 {
+		if err := printRemediationHistory(historyDevice, historyLimit, os.Stdout); err != nil {
+			log.Fatalf("Failed to query the remediation history: %s", err)
+		}
+		return
+	}
+
+	if strings.Compare(replayEvents, "") != 0 {
+		streams, err := loadStreamEvents(replayEvents)
+		if err != nil {
+			log.Fatalf("Failed to load the recorded events: %s", err)
+		}
+		if err := replayDecisions(streams, os.Stdout); err != nil {
+			log.Fatalf("Failed to replay the recorded events: %s", err)
+		}
+		return
+	}
+
+	if preflightEnabled {
+		err := preflight.Run([]preflight.Check{
+			{Name: "table", Run: func() error {
+				_, err := dynamodb.New(sess).DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+				return err
+			}},
+			{Name: "iot", Run: func() error {
+				_, err := iot.New(sess).DescribeEndpoint(&iot.DescribeEndpointInput{EndpointType: aws.String("iot:Data-ATS")})
+				return err
+			}},
+		})
+		if err != nil && preflightFailFast {
+			log.Fatalf("Refusing to start: %s", err)
+		}
+	}
+
+	// the acks are only written to the table, no IoT client is needed
+	if recordAcks {
+		lambda.Start(ackHandler)
+		return
+	}
+
+	httpClient := newHTTPClient()
+	client, err := newIoTDataPlane(httpClient)
+	if err != nil {
+		log.Fatalf("Refusing to start: %s", err)
+	}
+	iotsvc = client
+	if keepWarm > 0 {
+		go keepConnectionWarm(httpClient, client.Endpoint, keepWarm)
+	}
+	dedup = newDedupCache(dedupTTL)
+	firstSeen = newSightings()
+	logging.StartRollup(time.Minute, "Remediation messages sent")
 	lambda.Start(handler)
 }
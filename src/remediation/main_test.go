@@ -0,0 +1,891 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/iotdataplane"
+	log "github.com/sirupsen/logrus"
+
+	"siot/internal/dynamo"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of fakeDynamo, records the writes and fails them with the queued errors, in order; the items are kept
+// by digest to evaluate the conditions of the writes
+type fakeDynamo struct {
+	mu      sync.Mutex
+	puts    []*dynamodb.PutItemInput
+	updates []*dynamodb.UpdateItemInput
+	items   map[string]map[string]*dynamodb.AttributeValue
+	errs    []error
+	seq     int64
+}
+
+// type of fakePublisher, records the published messages
+type fakePublisher struct {
+	mu       sync.Mutex
+	messages []*iotdataplane.PublishInput
+	errs     []error
+}
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+var (
+	_ dynamoClient = (*dynamodb.DynamoDB)(nil)
+	_ iotPublisher = (*iotdataplane.IoTDataPlane)(nil)
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// the next error of the writes, nil once they are exhausted
+func (f *fakeDynamo) next() error {
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+// evaluate the condition of a write, among the ones the remediation uses, against the current item
+func (f *fakeDynamo) holds(condition *string, digest string, values map[string]*dynamodb.AttributeValue) bool {
+	item, exists := f.items[digest]
+	number := func(value *dynamodb.AttributeValue) int64 {
+		n, _ := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+		return n
+	}
+	switch aws.StringValue(condition) {
+	case "":
+		return true
+	case "attribute_not_exists(digest)":
+		return !exists
+	case "attribute_not_exists(digest) OR last_remediation <= :threshold":
+		return !exists || number(item["last_remediation"]) <= number(values[":threshold"])
+	case "last_remediation = :at":
+		return exists && number(item["last_remediation"]) == number(values[":at"])
+	case "claimed_by = :record":
+		return exists && aws.StringValue(item["claimed_by"].S) == aws.StringValue(values[":record"].S)
+	}
+	panic("condition not supported by the fake: " + aws.StringValue(condition))
+}
+
+func (f *fakeDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	digest := aws.StringValue(input.Item["digest"].S)
+	if !f.holds(input.ConditionExpression, digest, input.ExpressionAttributeValues) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition not met", nil)
+	}
+	f.puts = append(f.puts, input)
+	if f.items == nil {
+		f.items = make(map[string]map[string]*dynamodb.AttributeValue)
+	}
+	f.items[digest] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamo) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	digest := aws.StringValue(input.Key["digest"].S)
+	if !f.holds(input.ConditionExpression, digest, input.ExpressionAttributeValues) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition not met", nil)
+	}
+	delete(f.items, digest)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// item of the digest, nil if there is none
+func (f *fakeDynamo) item(digest string) map[string]*dynamodb.AttributeValue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.items[digest]
+}
+
+func (f *fakeDynamo) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	f.updates = append(f.updates, input)
+	f.seq++
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]*dynamodb.AttributeValue{
+		"sequence": {N: aws.String(strconv.FormatInt(f.seq, 10))},
+	}}, nil
+}
+
+func (f *fakeDynamo) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{}, nil
+}
+
+// digests of the remediation records put, in order, without the cooldown rows
+func (f *fakeDynamo) digests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var digests []string
+	for _, put := range f.puts {
+		if _, ok := put.Item["temperature"]; ok {
+			digests = append(digests, aws.StringValue(put.Item["digest"].S))
+		}
+	}
+	return digests
+}
+
+func (f *fakePublisher) Publish(input *iotdataplane.PublishInput) (*iotdataplane.PublishOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	f.messages = append(f.messages, input)
+	return &iotdataplane.PublishOutput{}, nil
+}
+
+// remediation messages published, decoded
+func (f *fakePublisher) events(t *testing.T) []IoTEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var published []IoTEvent
+	for _, message := range f.messages {
+		var event IoTEvent
+		if err := json.Unmarshal(message.Payload, &event); err != nil {
+			t.Fatalf("invalid remediation message %s: %v", message.Payload, err)
+		}
+		published = append(published, event)
+	}
+	return published
+}
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.FatalLevel)
+	os.Exit(m.Run())
+}
+
+// replace the clients and the settings of the handler with fakes and defaults for the test, restoring them after
+func withFakes(t *testing.T) (*fakeDynamo, *fakePublisher) {
+	savedDynamo, savedIoT, savedDedup, savedOn := dynamodbsvc, iotsvc, dedup, remediationOn
+	savedTable, savedCooldown, savedFirst, savedTrigger := tableName, cooldown, firstReading, triggerOn
+	savedSmoother, savedTrend, savedLimiter, savedRetry := smoother, trendWindow, limiter, dynamoRetry
+	savedSightings, savedFirstSeen, savedSetpoint := sightings, firstSeen, setpoint
+	t.Cleanup(func() {
+		dynamodbsvc, iotsvc, dedup, remediationOn = savedDynamo, savedIoT, savedDedup, savedOn
+		tableName, cooldown, firstReading, triggerOn = savedTable, savedCooldown, savedFirst, savedTrigger
+		smoother, trendWindow, limiter, dynamoRetry = savedSmoother, savedTrend, savedLimiter, savedRetry
+		sightings, firstSeen, setpoint = savedSightings, savedFirstSeen, savedSetpoint
+	})
+	db, publisher := &fakeDynamo{}, &fakePublisher{}
+	dynamodbsvc, iotsvc, dedup, remediationOn = db, publisher, newDedupCache(DEDUP_TTL), true
+	tableName, cooldown, firstReading, triggerOn = "remediation-table", 0, FIRST_READING_POLICY, TRIGGER_ON
+	smoother, trendWindow, limiter, dynamoRetry = nil, nil, nil, dynamo.RetryPolicy{}
+	sightings, firstSeen, setpoint = nil, newSightings(), SETPOINT
+	return db, publisher
+}
+
+// remediation of the records, failing the test if the logic does
+func remediate(t *testing.T, records ...events.DynamoDBEventRecord) *IoTEvent {
+	t.Helper()
+	event, err := remediationLogic(events.DynamoDBEvent{Records: records})
+	if err != nil {
+		t.Fatalf("remediation logic failed: %v", err)
+	}
+	return event
+}
+
+// image of a reading of the device as the worker writes it
+func image(device string, temp float64, action string) map[string]events.DynamoDBAttributeValue {
+	return map[string]events.DynamoDBAttributeValue{
+		"device":      events.NewStringAttribute(device),
+		"temperature": events.NewNumberAttribute(strconv.FormatFloat(temp, 'f', -1, 64)),
+		"humidity":    events.NewNumberAttribute("40"),
+		"action":      events.NewStringAttribute(action),
+	}
+}
+
+// stream record of a reading of the device replacing the previous one
+func modified(id string, device string, old float64, temp float64) events.DynamoDBEventRecord {
+	return events.DynamoDBEventRecord{
+		EventID:   id,
+		EventName: "MODIFY",
+		Change: events.DynamoDBStreamRecord{
+			NewImage: image(device, temp, Monitor.String()),
+			OldImage: image(device, old, Monitor.String()),
+		},
+	}
+}
+
+// stream record of a reading of the device inserted without old image, as the first one or in the history
+func inserted(id string, device string, temp float64) events.DynamoDBEventRecord {
+	return events.DynamoDBEventRecord{
+		EventID:   id,
+		EventName: "INSERT",
+		Change:    events.DynamoDBStreamRecord{NewImage: image(device, temp, Monitor.String())},
+	}
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+func TestHandlerSkipsRedeliveredRecord(t *testing.T) {
+	db, publisher := withFakes(t)
+	stream := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{modified("c4ca4238a0b923820dcc509a6f75849b", "930129302", 21.5, 24.5)}}
+	for i := 0; i < 2; i++ {
+		handler(stream)
+	}
+	if published := publisher.events(t); len(published) != 1 || published[0].Body.Temp != 21.5 {
+		t.Errorf("expected a single remediation to 21.5, got %+v", published)
+	}
+	if digests := db.digests(); len(digests) != 1 {
+		t.Errorf("expected a single remediation record, got %v", digests)
+	}
+}
+
+func TestDedupCacheExpires(t *testing.T) {
+	cache := newDedupCache(time.Millisecond)
+	if cache.Seen("c4ca4238") {
+		t.Fatal("first sighting reported as seen")
+	}
+	if !cache.Seen("c4ca4238") {
+		t.Fatal("second sighting within the ttl not reported as seen")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if cache.Seen("c4ca4238") {
+		t.Error("sighting after the ttl reported as seen")
+	}
+}
+
+func TestDedupCacheExpiresInOrder(t *testing.T) {
+	cache := newDedupCache(30 * time.Millisecond)
+	cache.Seen("c4ca4238")
+	cache.Seen("c81e728d")
+	time.Sleep(20 * time.Millisecond)
+	// forgotten and seen again, the record must outlive its first sighting
+	cache.Forget([]events.DynamoDBEventRecord{{EventID: "c4ca4238"}})
+	cache.Seen("c4ca4238")
+	time.Sleep(20 * time.Millisecond)
+	if cache.Seen("eccbc87e") {
+		t.Fatal("first sighting reported as seen")
+	}
+	if _, ok := cache.seen["c81e728d"]; ok {
+		t.Error("expired record still cached")
+	}
+	if !cache.Seen("c4ca4238") {
+		t.Error("record seen again expired with its first sighting")
+	}
+}
+
+func TestPublishFailureFailsInvocation(t *testing.T) {
+	db, publisher := withFakes(t)
+	cooldown = 30 * time.Second
+	publisher.errs = []error{awserr.New("ServiceUnavailableException", "unavailable", nil)}
+	stream := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{modified("45c48cce2e2d7fbdea1afc51c7c6ad26", "930129302", 21.5, 24.5)}}
+	if err := handler(stream); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Fatalf("expected the publish failure to fail the invocation, got %v", err)
+	}
+	if db.item(COOLDOWN_KEY+"930129302") != nil {
+		t.Error("device held by the cooldown of a remediation never sent")
+	}
+	// the record is forgotten, so the retry of the stream sends the remediation
+	if err := handler(stream); err != nil {
+		t.Fatalf("retried record failed: %v", err)
+	}
+	if published := publisher.events(t); len(published) != 1 {
+		t.Errorf("expected the retried remediation sent, got %+v", published)
+	}
+}
+
+func TestRemediateRecordDoesNotTrigger(t *testing.T) {
+	_, publisher := withFakes(t)
+	record := modified("c81e728d9d4c2f636f067f89cc14862c", "930129302", 21.5, 24.5)
+	record.Change.NewImage["action"] = events.NewStringAttribute(Remediate.String())
+	if event := remediate(t, record); event != nil {
+		t.Errorf("remediation triggered by its own record: %+v", event.Body)
+	}
+	handler(events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}})
+	if published := publisher.events(t); len(published) != 0 {
+		t.Errorf("expected no remediation, got %+v", published)
+	}
+}
+
+func TestTriggerOnAllowlist(t *testing.T) {
+	withFakes(t)
+	triggerOn = "Monitor, Alarm"
+	cases := []struct {
+		action   string
+		triggers bool
+	}{
+		{"Monitor", true},
+		{"Alarm", true},
+		{"Remediate", false},
+		{"Calibrate", false},
+	}
+	for _, c := range cases {
+		record := modified("eccbc87e4b5ce2fe28308fd9f2a7baf3", "930129302", 21.5, 24.5)
+		record.Change.NewImage["action"] = events.NewStringAttribute(c.action)
+		if got := triggers(record); got != c.triggers {
+			t.Errorf("action %s: expected trigger %t, got %t", c.action, c.triggers, got)
+		}
+	}
+	triggerOn = "Monitor,Remediate"
+	record := modified("a87ff679a2f3e71d9181a67b7542122c", "930129302", 21.5, 24.5)
+	record.Change.NewImage["action"] = events.NewStringAttribute(Remediate.String())
+	if triggers(record) {
+		t.Error("Remediate triggered although it is always ignored")
+	}
+}
+
+func TestPersistRetriesThrottledWrite(t *testing.T) {
+	db, publisher := withFakes(t)
+	dynamoRetry = dynamo.RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond}
+	db.errs = []error{awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)}
+	if err := handler(events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{modified("e4da3b7fbbce2345d7772b0674a318d5", "930129302", 21.5, 24.5)}}); err != nil {
+		t.Fatalf("throttled write not retried: %v", err)
+	}
+	if len(db.digests()) != 1 || len(publisher.events(t)) != 1 {
+		t.Errorf("expected the remediation persisted and published once")
+	}
+}
+
+func TestPersistentWriteFailureFailsInvocation(t *testing.T) {
+	db, publisher := withFakes(t)
+	dynamoRetry = dynamo.RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond}
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+	db.errs = []error{throttled, throttled}
+	stream := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{modified("1679091c5a880faf6fb5e6087eb1b2dc", "930129302", 21.5, 24.5)}}
+	if err := handler(stream); err == nil {
+		t.Fatal("expected the invocation to fail for the stream to retry it")
+	}
+	if len(publisher.events(t)) != 0 {
+		t.Error("remediation published without its record")
+	}
+	// the record is forgotten, so the retry of the stream remediates it
+	if err := handler(stream); err != nil {
+		t.Fatalf("retried record failed: %v", err)
+	}
+	if len(db.digests()) != 1 || len(publisher.events(t)) != 1 {
+		t.Errorf("expected the retried record remediated once")
+	}
+}
+
+// cooldown row of the device, as claimed by a remediation at the given time
+func cooldownRow(device string, at time.Time) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"digest":           {S: aws.String(COOLDOWN_KEY + device)},
+		"device":           {S: aws.String(device)},
+		"last_remediation": {N: aws.String(strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10))},
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	cases := []struct {
+		name       string
+		last       time.Duration
+		remediates bool
+	}{
+		{"never remediated", 0, true},
+		{"within the cooldown", 10 * time.Second, false},
+		{"past the cooldown", time.Minute, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, publisher := withFakes(t)
+			cooldown = 30 * time.Second
+			if c.last > 0 {
+				db.items = map[string]map[string]*dynamodb.AttributeValue{COOLDOWN_KEY + "930129302": cooldownRow("930129302", time.Now().Add(-c.last))}
+			}
+			if err := handler(events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{modified("8f14e45fceea167a5a36dedd4bea2543", "930129302", 21.5, 24.5)}}); err != nil {
+				t.Fatalf("handler failed: %v", err)
+			}
+			if remediated := len(publisher.events(t)) == 1; remediated != c.remediates {
+				t.Fatalf("expected remediation %t, got %t", c.remediates, remediated)
+			}
+			if len(db.digests()) != len(publisher.events(t)) {
+				t.Errorf("expected a record for every remediation sent")
+			}
+			last, _ := strconv.ParseInt(aws.StringValue(db.item(COOLDOWN_KEY + "930129302")["last_remediation"].N), 10, 64)
+			held := time.Since(time.Unix(0, last*int64(time.Millisecond)))
+			if c.remediates && held > time.Second || !c.remediates && held < c.last {
+				t.Errorf("cooldown row not updated by the remediation only: last remediation %s ago", held)
+			}
+		})
+	}
+}
+
+func TestCooldownReleasedWhenPersistFails(t *testing.T) {
+	db, publisher := withFakes(t)
+	cooldown = 30 * time.Second
+	// the claim succeeds, the remediation record fails for good
+	db.errs = []error{nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "no table", nil)}
+	stream := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{modified("c9f0f895fb98ab9159f51fd0297e236d", "930129302", 21.5, 24.5)}}
+	if err := handler(stream); err == nil {
+		t.Fatal("expected the invocation to fail")
+	}
+	if row := db.item(COOLDOWN_KEY + "930129302"); row != nil {
+		t.Fatalf("device held by the cooldown of a remediation never sent: %v", row)
+	}
+	if err := handler(stream); err != nil {
+		t.Fatalf("retried record failed: %v", err)
+	}
+	if len(publisher.events(t)) != 1 || db.item(COOLDOWN_KEY+"930129302") == nil {
+		t.Errorf("expected the retried record remediated and its cooldown claimed")
+	}
+}
+
+func TestCooldownOfAnotherClaimIsNotReleased(t *testing.T) {
+	db, _ := withFakes(t)
+	cooldown = 30 * time.Second
+	claimedAt := time.Now()
+	db.items = map[string]map[string]*dynamodb.AttributeValue{COOLDOWN_KEY + "930129302": cooldownRow("930129302", claimedAt.Add(time.Second))}
+	if err := releaseCooldown("930129302", claimedAt); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if db.item(COOLDOWN_KEY+"930129302") == nil {
+		t.Error("claim of another container released")
+	}
+}
+
+// stream record of the i-th reading of a sensor alternating around 20 degrees by 0.8
+func noisyRecord(i int) events.DynamoDBEventRecord {
+	noise := 0.8
+	if i%2 == 1 {
+		noise = -noise
+	}
+	return modified(fmt.Sprintf("noisy-%d", i), "930129302", 20-noise, 20+noise)
+}
+
+func TestSmoothingConvergesAndSuppressesSpuriousCorrections(t *testing.T) {
+	withFakes(t)
+	// a correction moving the reading by more than a degree is spurious for a sensor steady at 20
+	spurious := func(i int, event *IoTEvent) bool {
+		reading, _ := noisyRecord(i).Change.NewImage["temperature"].Float()
+		return math.Abs(event.Body.Temp-reading) > 1
+	}
+	raw := 0
+	for i := 0; i < 40; i++ {
+		if event := remediate(t, noisyRecord(i)); spurious(i, event) {
+			raw++
+		}
+	}
+	if raw != 40 {
+		t.Fatalf("expected every raw correction spurious, got %d", raw)
+	}
+	smoother = newSmoother(0.2)
+	smoothed := 0
+	var target float64
+	for i := 0; i < 40; i++ {
+		event := remediate(t, noisyRecord(i))
+		target = event.Body.Temp
+		// the first readings seed the average, the corrections count once it settled
+		if i >= 10 && spurious(i, event) {
+			smoothed++
+		}
+	}
+	if math.Abs(target-20) > 0.2 {
+		t.Errorf("expected the average to converge to 20, got %g", target)
+	}
+	if smoothed != 0 {
+		t.Errorf("expected no spurious correction around the average, got %d", smoothed)
+	}
+}
+
+func TestSeverityBands(t *testing.T) {
+	savedMajor, savedCritical := severityMajor, severityCritical
+	t.Cleanup(func() { severityMajor, severityCritical = savedMajor, savedCritical })
+	severityMajor, severityCritical = SEVERITY_MAJOR, SEVERITY_CRITICAL
+	cases := []struct {
+		deviation float64
+		band      string
+	}{
+		{0, "minor"},
+		{0.99, "minor"},
+		{1, "major"},
+		{-2.5, "major"},
+		{3, "critical"},
+		{-12, "critical"},
+	}
+	for _, c := range cases {
+		if band := severity(c.deviation); band != c.band {
+			t.Errorf("deviation %g: expected %s, got %s", c.deviation, c.band, band)
+		}
+	}
+	severityMajor, severityCritical = 0.5, 2
+	if band := severity(1); band != "major" {
+		t.Errorf("deviation 1 with configured thresholds: expected major, got %s", band)
+	}
+}
+
+func TestSeverityIsCarriedToTheDevice(t *testing.T) {
+	_, publisher := withFakes(t)
+	stream := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{modified("45c48cce2e2d7fbdea1afc51c7c6ad26", "930129302", 21.5, 26)}}
+	if err := handler(stream); err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if published := publisher.events(t); len(published) != 1 || published[0].Body.Severity != "critical" {
+		t.Errorf("expected a critical remediation, got %+v", published)
+	}
+}
+
+func TestTrendDetection(t *testing.T) {
+	cases := []struct {
+		name     string
+		readings []float64
+		trends   []string
+	}{
+		{"rising", []float64{20, 20.5, 21, 21.5}, []string{"", "", "rising", "rising"}},
+		{"falling", []float64{24, 23, 22.5, 22}, []string{"", "", "falling", "falling"}},
+		{"oscillating", []float64{20, 22, 21, 23, 22, 24}, []string{"", "", "", "", "", ""}},
+		{"flat", []float64{21, 21, 21}, []string{"", "", ""}},
+		{"turning", []float64{20, 21, 22, 21}, []string{"", "", "rising", ""}},
+	}
+	for _, c := range cases {
+		window := newTrendWindow(3)
+		for i, reading := range c.readings {
+			if trend := window.Add("930129302", reading); trend != c.trends[i] {
+				t.Errorf("%s, reading %d: expected %q, got %q", c.name, i+1, c.trends[i], trend)
+			}
+		}
+	}
+	window := newTrendWindow(2)
+	window.Add("930129302", 20)
+	if trend := window.Add("381938912", 21); trend != "" {
+		t.Errorf("readings of two devices mixed in a trend: %q", trend)
+	}
+}
+
+func TestRemediationWaitsForATrend(t *testing.T) {
+	withFakes(t)
+	trendWindow = newTrendWindow(3)
+	temperatures := []float64{20, 21, 22, 23, 22.5}
+	// the window fills with the new temperature of every record, the trend holds from the third one
+	remediates := []bool{false, false, true, false}
+	for i := 1; i < len(temperatures); i++ {
+		record := modified(fmt.Sprintf("trend-%d", i), "930129302", temperatures[i-1], temperatures[i])
+		event := remediate(t, record)
+		if (event != nil) != remediates[i-1] {
+			t.Errorf("reading %g: expected remediation %t, got %+v", temperatures[i], remediates[i-1], event)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(10, 3)
+	for i := 0; i < 3; i++ {
+		if !bucket.Take(0) {
+			t.Fatalf("token %d of the burst refused", i+1)
+		}
+	}
+	if bucket.Take(0) {
+		t.Fatal("token over the burst taken without waiting")
+	}
+	if bucket.Take(10 * time.Millisecond) {
+		t.Fatal("token taken although it is due after the wait")
+	}
+	start := time.Now()
+	if !bucket.Take(time.Second) {
+		t.Fatal("token due within the wait refused")
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("token taken without waiting for the refill: %s", waited)
+	}
+	time.Sleep(250 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if !bucket.Take(0) {
+			t.Errorf("token %d refilled in the meantime refused", i+1)
+		}
+	}
+}
+
+func TestTokenBucketPacesConcurrentTakes(t *testing.T) {
+	bucket := newTokenBucket(50, 1)
+	var wg sync.WaitGroup
+	var taken int64
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if bucket.Take(time.Second) {
+				atomic.AddInt64(&taken, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	// the first token is there at start, the other five come every 20ms
+	if elapsed := time.Since(start); taken != 6 || elapsed < 90*time.Millisecond {
+		t.Errorf("expected 6 tokens over at least 100ms, got %d in %s", taken, elapsed)
+	}
+}
+
+func TestRemediationsOverTheGlobalRateAreDropped(t *testing.T) {
+	_, publisher := withFakes(t)
+	savedWait := globalWait
+	t.Cleanup(func() { globalWait = savedWait })
+	limiter, globalWait = newTokenBucket(0.001, 1), 0
+	dropped := atomic.LoadUint64(&throttled)
+	for i, device := range []string{"930129302", "381938912", "573920193"} {
+		record := modified(fmt.Sprintf("global-%d", i), device, 21.5, 24.5)
+		if err := handler(events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}}); err != nil {
+			t.Fatalf("handler failed: %v", err)
+		}
+	}
+	if published := publisher.events(t); len(published) != 1 || published[0].Body.Device != "930129302" {
+		t.Errorf("expected only the first remediation sent, got %+v", published)
+	}
+	if n := atomic.LoadUint64(&throttled) - dropped; n != 2 {
+		t.Errorf("expected 2 remediations dropped and counted, got %d", n)
+	}
+}
+
+func TestCorrelationIDIsEchoedInTheRemediation(t *testing.T) {
+	db, publisher := withFakes(t)
+	record := modified("1f0e3dad99908345f7439f8ffabdffc4", "930129302", 21.5, 24.5)
+	record.Change.NewImage["correlation_id"] = events.NewStringAttribute("9f2c4e1ab37d0c55")
+	if err := handler(events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}}); err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if published := publisher.events(t); len(published) != 1 || published[0].Body.CorrelationID != "9f2c4e1ab37d0c55" {
+		t.Errorf("expected the correlation_id echoed to the device, got %+v", published)
+	}
+	digests := db.digests()
+	if len(digests) != 1 || aws.StringValue(db.item(digests[0])["correlation_id"].S) != "9f2c4e1ab37d0c55" {
+		t.Errorf("expected the correlation_id in the remediation record")
+	}
+}
+
+func TestAckIsRecordedOutOfTheHistoryIndex(t *testing.T) {
+	db, _ := withFakes(t)
+	ack := Ack{Device: "930129302", CorrelationID: "9f2c4e1ab37d0c55", MessageID: "1f0e3dad99908345f7439f8ffabdffc4", Applied: true, Timestamp: 1700000000000}
+	if err := ackHandler(ack); err != nil {
+		t.Fatalf("ack handler failed: %v", err)
+	}
+	item := db.item(ACK_KEY + "930129302#1f0e3dad99908345f7439f8ffabdffc4")
+	if item == nil || !aws.BoolValue(item["applied"].BOOL) || aws.StringValue(item["correlation_id"].S) != "9f2c4e1ab37d0c55" {
+		t.Fatalf("expected the ack recorded under its message, got %v", item)
+	}
+	if _, ok := item["timestamp"]; ok {
+		t.Errorf("ack recorded with a timestamp, it would enter the history index")
+	}
+	if aws.StringValue(item["acked_at"].N) != "1700000000000" {
+		t.Errorf("expected the time of the ack as acked_at, got %v", item["acked_at"])
+	}
+
+	// an ack without device is ignored
+	if err := ackHandler(Ack{Applied: true}); err != nil || len(db.puts) != 1 {
+		t.Errorf("expected the ack without device ignored, got %v and %d items", err, len(db.puts))
+	}
+}
+
+func TestFirstReadingPolicies(t *testing.T) {
+	cases := []struct {
+		policy string
+		// temperature the first reading is remediated to, 0 if it is not
+		first float64
+		// temperature the second reading is remediated to, the average of the readings it was fed
+		second float64
+	}{
+		{"skip", 0, 25.5},
+		{"seed", 0, 25},
+		{"remediate-to-setpoint", 20, 25},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			db, publisher := withFakes(t)
+			firstReading, smoother = c.policy, newSmoother(0.5)
+			if err := handler(events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{inserted("first-1", "930129302", 24.5)}}); err != nil {
+				t.Fatalf("handler failed: %v", err)
+			}
+			published := publisher.events(t)
+			if remediated := len(published) == 1; remediated != (c.first != 0) {
+				t.Fatalf("expected remediation of the first reading %t, got %+v", c.first != 0, published)
+			}
+			if c.first != 0 && (published[0].Body.Temp != c.first || published[0].Body.Severity != "critical") {
+				t.Errorf("expected a critical remediation to the setpoint, got %+v", published[0].Body)
+			}
+			if db.item(FIRST_KEY+"930129302") == nil {
+				t.Fatal("first reading of the device not recorded")
+			}
+			if err := handler(events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{modified("first-2", "930129302", 24.5, 25.5)}}); err != nil {
+				t.Fatalf("handler failed: %v", err)
+			}
+			if published := publisher.events(t); len(published) == 0 || published[len(published)-1].Body.Temp != c.second {
+				t.Errorf("expected the second reading remediated to %g, got %+v", c.second, published)
+			}
+		})
+	}
+}
+
+func TestFirstReadingAtZeroDegreesIsNotMistakenForMissingHistory(t *testing.T) {
+	withFakes(t)
+	if event := remediate(t, modified("freezing-1", "930129302", 0, 3.5)); event == nil || event.Body.Temp != 0 {
+		t.Errorf("expected a remediation back to 0 degrees, got %+v", event)
+	}
+}
+
+func TestFirstReadingIsClaimedOncePerDevice(t *testing.T) {
+	db, _ := withFakes(t)
+	firstReading = "remediate-to-setpoint"
+	// the items of the history are all inserted, only the first one of the device is its first reading
+	if event := remediate(t, inserted("history-1", "930129302", 24.5)); event == nil || event.Body.Temp != setpoint {
+		t.Fatalf("expected the first reading remediated to the setpoint, got %+v", event)
+	}
+	if event := remediate(t, inserted("history-2", "930129302", 25.5)); event == nil || event.Body.Temp != 25.5 {
+		t.Errorf("expected a later reading without old image compared to itself, got %+v", event)
+	}
+	// the first reading seen by another container is not claimed again
+	db.items[FIRST_KEY+"381938912"] = map[string]*dynamodb.AttributeValue{"digest": {S: aws.String(FIRST_KEY + "381938912")}}
+	if event := remediate(t, inserted("history-3", "381938912", 24.5)); event == nil || event.Body.Temp != 24.5 {
+		t.Errorf("expected the reading of a device already seen not treated as first, got %+v", event)
+	}
+	if digests := db.digests(); len(digests) != 0 {
+		t.Errorf("first reading rows taken for remediation records: %v", digests)
+	}
+}
+
+func TestKnownDeviceIsNotClaimedAgain(t *testing.T) {
+	db, _ := withFakes(t)
+	remediate(t, inserted("known-1", "930129302", 24.5))
+	row := db.item(FIRST_KEY + "930129302")
+	if row == nil || row["ttl"] == nil || aws.StringValue(row["claimed_by"].S) != "known-1" {
+		t.Fatalf("expected the first reading row claimed by the record with a ttl, got %v", row)
+	}
+	if at, _ := strconv.ParseInt(aws.StringValue(row["ttl"].N), 10, 64); at <= time.Now().Unix() {
+		t.Errorf("expected the first reading row to expire in the future, got %d", at)
+	}
+	// the container knows the device, the table is not asked again
+	puts := len(db.puts)
+	remediate(t, inserted("known-2", "930129302", 25.5))
+	if len(db.puts) != puts {
+		t.Errorf("expected no write for a device known by the container, got %d", len(db.puts)-puts)
+	}
+}
+
+func TestFirstReadingIsReleasedWhenTheRemediationFails(t *testing.T) {
+	cases := []struct {
+		name string
+		fail func(db *fakeDynamo, publisher *fakePublisher)
+	}{
+		// the claim of the first reading goes through, the remediation record does not
+		{"persist", func(db *fakeDynamo, _ *fakePublisher) { db.errs = []error{nil, fmt.Errorf("write failed")} }},
+		{"publish", func(_ *fakeDynamo, publisher *fakePublisher) { publisher.errs = []error{fmt.Errorf("publish failed")} }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, publisher := withFakes(t)
+			firstReading = "remediate-to-setpoint"
+			c.fail(db, publisher)
+			stream := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{inserted("retry-1", "930129302", 24.5)}}
+			if err := handler(stream); err == nil {
+				t.Fatal("expected the invocation to fail for the stream to retry it")
+			}
+			if db.item(FIRST_KEY+"930129302") != nil {
+				t.Fatal("expected the first reading released")
+			}
+			// the retry of the stream still finds the first reading and remediates it to the setpoint
+			if err := handler(stream); err != nil {
+				t.Fatalf("retried record failed: %v", err)
+			}
+			if published := publisher.events(t); len(published) != 1 || published[0].Body.Temp != setpoint {
+				t.Errorf("expected the retried first reading remediated to the setpoint, got %+v", published)
+			}
+		})
+	}
+}
+
+func TestFirstReadingOfAnotherRecordIsNotReleased(t *testing.T) {
+	db, publisher := withFakes(t)
+	firstReading = "remediate-to-setpoint"
+	// the first reading was claimed by another record, this one is compared to itself and fails to publish
+	db.items = map[string]map[string]*dynamodb.AttributeValue{FIRST_KEY + "930129302": {
+		"digest":     {S: aws.String(FIRST_KEY + "930129302")},
+		"claimed_by": {S: aws.String("other")},
+	}}
+	publisher.errs = []error{fmt.Errorf("publish failed")}
+	if err := handler(events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{inserted("retry-2", "930129302", 24.5)}}); err == nil {
+		t.Fatal("expected the invocation to fail")
+	}
+	if db.item(FIRST_KEY+"930129302") == nil {
+		t.Error("expected the first reading of the other record kept")
+	}
+}
+
+func TestSkippedFirstReadingKeepsTheBatch(t *testing.T) {
+	withFakes(t)
+	event := remediate(t, modified("batch-1", "930129302", 21.5, 24.5), inserted("batch-2", "381938912", 30))
+	if event == nil || event.Body.Device != "930129302" || event.Body.Temp != 21.5 || event.Body.MessageID != "batch-1" {
+		t.Errorf("expected the valid record of the batch remediated, got %+v", event)
+	}
+}
+
+func TestFirstReadingCheckFailureFailsInvocation(t *testing.T) {
+	db, publisher := withFakes(t)
+	db.errs = []error{awserr.New(dynamodb.ErrCodeResourceNotFoundException, "no table", nil)}
+	stream := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{inserted("a3f390d88e4c41f2747bfa2f1b5f87db", "930129302", 24.5)}}
+	if err := handler(stream); err == nil {
+		t.Fatal("expected the invocation to fail for the stream to retry it")
+	}
+	// the record is forgotten, so the retry of the stream applies the policy to it
+	if err := handler(stream); err != nil {
+		t.Fatalf("retried record failed: %v", err)
+	}
+	if db.item(FIRST_KEY+"930129302") == nil || len(publisher.events(t)) != 0 {
+		t.Errorf("expected the retried first reading recorded and skipped")
+	}
+}
+
+func TestReplayTracksFirstReadingsInMemory(t *testing.T) {
+	withFakes(t)
+	// nothing is written in a replay, a call to the table would fail the test
+	dynamodbsvc, firstReading = nil, "remediate-to-setpoint"
+	streams := pairReadings([]*Information{
+		{Device: "930129302", Temp: 24.5, Hum: 40, Action: Monitor.String(), Timestamp: 1700000000000},
+		{Device: "930129302", Temp: 25.5, Hum: 40, Action: Monitor.String(), Timestamp: 1700000060000},
+		{Device: "381938912", Temp: 18, Hum: 40, Action: Monitor.String(), Timestamp: 1700000120000},
+	})
+	var out bytes.Buffer
+	if err := replayDecisions(streams, &out); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	var temperatures []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var decision Decision
+		if err := json.Unmarshal([]byte(line), &decision); err != nil {
+			t.Fatalf("invalid decision %s: %v", line, err)
+		}
+		temperatures = append(temperatures, fmt.Sprintf("%s:%g", decision.Device, decision.Temperature))
+	}
+	if got := strings.Join(temperatures, ","); got != "930129302:20,930129302:24.5,381938912:20" {
+		t.Errorf("expected the first reading of every device remediated to the setpoint, got %s", got)
+	}
+}
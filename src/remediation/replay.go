@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of Decision, outcome of the remediation logic over a recorded stream event
+type Decision struct {
+	Event       int     `json:"event"`
+	Device      string  `json:"device,omitempty"`
+	Decision    string  `json:"decision"`
+	Temperature float64 `json:"temperature,omitempty"`
+	Humidity    float64 `json:"humidity,omitempty"`
+	Severity    string  `json:"severity,omitempty"`
+}
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// image of the reading as the worker writes it in the monitoring table
+func readingImage(reading *Information) map[string]events.DynamoDBAttributeValue {
+	image := map[string]events.DynamoDBAttributeValue{
+		"device":      events.NewStringAttribute(reading.Device),
+		"temperature": events.NewNumberAttribute(strconv.FormatFloat(reading.Temp, 'f', -1, 64)),
+		"humidity":    events.NewNumberAttribute(strconv.FormatFloat(reading.Hum, 'f', -1, 64)),
+		"action":      events.NewStringAttribute(reading.Action),
+		"timestamp":   events.NewNumberAttribute(strconv.FormatInt(reading.Timestamp, 10)),
+	}
+	if reading.Pressure != 0 {
+		image["pressure"] = events.NewNumberAttribute(strconv.FormatFloat(reading.Pressure, 'f', -1, 64))
+	}
+	if strings.Compare(reading.FirmwareVersion, "") != 0 {
+		image["fw_version"] = events.NewStringAttribute(reading.FirmwareVersion)
+	}
+	if strings.Compare(reading.CorrelationID, "") != 0 {
+		image["correlation_id"] = events.NewStringAttribute(reading.CorrelationID)
+	}
+	return image
+}
+
+// rebuild a stream event for every reading, paired with the previous reading of the same device in time order
+func pairReadings(readings []*Information) []events.DynamoDBEvent {
+	sort.SliceStable(readings, func(i, j int) bool { return readings[i].Timestamp < readings[j].Timestamp })
+	var streams []events.DynamoDBEvent
+	previous := make(map[string]*Information)
+	for _, reading := range readings {
+		record := events.DynamoDBEventRecord{
+			EventID:   fmt.Sprintf("%s-%d", reading.Device, reading.Timestamp),
+			EventName: "INSERT",
+			Change:    events.DynamoDBStreamRecord{NewImage: readingImage(reading)},
+		}
+		if last, ok := previous[reading.Device]; ok {
+			record.EventName = "MODIFY"
+			record.Change.OldImage = readingImage(last)
+		}
+		previous[reading.Device] = reading
+		streams = append(streams, events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}})
+	}
+	return streams
+}
+
+// load the stream events of the file, given as DynamoDB stream events or as readings of the history
+// (one JSON document after the other, as in a JSON-lines file or in the history objects concatenated)
+func loadStreamEvents(path string) ([]events.DynamoDBEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var streams []events.DynamoDBEvent
+	var readings []*Information
+	decoder := json.NewDecoder(file)
+	for n := 1; ; n++ {
+		var document struct {
+			Records []events.DynamoDBEventRecord `json:"Records"`
+			Body    *Information                 `json:"body"`
+		}
+		if err := decoder.Decode(&document); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("document %d of %s: %s", n, path, err)
+		}
+		switch {
+		case document.Records != nil:
+			streams = append(streams, events.DynamoDBEvent{Records: document.Records})
+		case document.Body != nil:
+			readings = append(readings, document.Body)
+		default:
+			return nil, fmt.Errorf("document %d of %s is neither a stream event nor a reading", n, path)
+		}
+	}
+	return append(streams, pairReadings(readings)...), nil
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// run the remediation logic over the recorded stream events without writing or publishing anything,
+// holding the cooldown against the time of the readings, and print a decision per event as a JSON line;
+// the first readings of the devices are tracked in memory over the replay, not claimed in the table
+func replayDecisions(streams []events.DynamoDBEvent, out io.Writer) error {
+	lastRemediation := make(map[string]time.Time)
+	sightings = newSightings()
+	for i, stream := range streams {
+		decision := Decision{Event: i + 1, Decision: "none"}
+		event, err := remediationLogic(stream)
+		if err != nil {
+			return err
+		}
+		if event != nil {
+			at := time.Unix(0, event.Body.Timestamp*int64(time.Millisecond))
+			decision = Decision{Event: i + 1, Device: event.Body.Device, Decision: "remediate", Temperature: event.Body.Temp, Humidity: event.Body.Hum, Severity: event.Body.Severity}
+			if last, ok := lastRemediation[event.Body.Device]; ok && cooldown > 0 && at.Sub(last) < cooldown {
+				decision.Decision = "cooldown"
+			} else {
+				lastRemediation[event.Body.Device] = at
+			}
+		}
+		line, _ := json.Marshal(decision)
+		fmt.Fprintln(out, string(line))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/iotdataplane"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of dryRunUploader, s3 uploader logging the uploads instead of sending them
+type dryRunUploader struct{}
+
+// type of dryRunDynamo, DynamoDB client logging the writes instead of sending them
+type dryRunDynamo struct{}
+
+// type of dryRunCloudWatch, CloudWatch client logging the metrics instead of sending them
+type dryRunCloudWatch struct{}
+
+// type of dryRunPublisher, IoT data client logging the messages instead of publishing them
+type dryRunPublisher struct{}
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// log the input of the call that would have been made
+func logDryRun(operation string, input interface{}) {
+	b, err := json.Marshal(input)
+	if err != nil {
+		log.Errorf("Error in marshal of %s input: %s", operation, err)
+		return
+	}
+	log.WithFields(log.Fields{"dry_run": operation, "input": json.RawMessage(b)}).Infof("Dry run, %s not sent", operation)
+}
+
+// log the upload, with its body as text since the reader does not marshal
+func (dryRunUploader) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	body, _ := ioutil.ReadAll(input.Body)
+	logDryRun("Upload", map[string]interface{}{
+		"Bucket":   aws.StringValue(input.Bucket),
+		"Key":      aws.StringValue(input.Key),
+		"Metadata": input.Metadata,
+		"Body":     string(body),
+	})
+	return &s3manager.UploadOutput{}, nil
+}
+
+// log the item put
+func (dryRunDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	logDryRun("PutItem", input)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// log the item update
+func (dryRunDynamo) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	logDryRun("UpdateItem", input)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+// log the metrics put
+func (dryRunCloudWatch) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	logDryRun("PutMetricData", input)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+// log the message published, with its payload as text
+func (dryRunPublisher) Publish(input *iotdataplane.PublishInput) (*iotdataplane.PublishOutput, error) {
+	logDryRun("Publish", map[string]interface{}{
+		"Topic":   aws.StringValue(input.Topic),
+		"Qos":     aws.Int64Value(input.Qos),
+		"Payload": string(input.Payload),
+	})
+	return &iotdataplane.PublishOutput{}, nil
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// replace the clients of the sinks with the ones logging the calls: the sinks build their inputs as usual
+func useDryRunClients() {
+	s3svc = dryRunUploader{}
+	dynamodbsvc = dryRunDynamo{}
+	cwsvc = dryRunCloudWatch{}
+	iotsvc = dryRunPublisher{}
+}
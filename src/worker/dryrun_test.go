@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of dryRunHook, records the operations logged by the dry-run clients
+type dryRunHook struct {
+	mu         sync.Mutex
+	operations []string
+}
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+func (h *dryRunHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *dryRunHook) Fire(entry *log.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if operation, ok := entry.Data["dry_run"].(string); ok && entry.Data["input"] != nil {
+		h.operations = append(h.operations, operation)
+	}
+	return nil
+}
+
+// operations logged, sorted
+func (h *dryRunHook) logged() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	operations := append([]string(nil), h.operations...)
+	sort.Strings(operations)
+	return operations
+}
+
+// ****************************************************
+// ********************* TESTS ************************
+// ****************************************************
+
+func TestDryRunMakesNoAWSCall(t *testing.T) {
+	f := withFakes(t)
+	topicSaved, highSaved, stateSaved := alarmTopic, alarmHighLimits, alarmState
+	levelSaved, hooksSaved := log.GetLevel(), log.StandardLogger().Hooks
+	t.Cleanup(func() {
+		alarmTopic, alarmHighLimits, alarmState = topicSaved, highSaved, stateSaved
+		log.SetLevel(levelSaved)
+		log.StandardLogger().ReplaceHooks(hooksSaved)
+	})
+	sinks, alarmTopic, alarmState = "metrics,history,dynamo,alarm", "alarms/building-1", &AlarmState{crossed: make(map[string]string)}
+	alarmHighLimits, _ = parseThresholds("temperature=30")
+	hook := &dryRunHook{}
+	log.SetLevel(log.InfoLevel)
+	log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	log.AddHook(hook)
+
+	useDryRunClients()
+	if err := handler(context.Background(), rawReading("381938912", 35)); err != nil {
+		t.Fatalf("dry run reported a failure: %v", err)
+	}
+	if len(f.s3.inputs) != 0 || len(f.dynamo.puts) != 0 || len(f.dynamo.updates) != 0 || len(f.cw.inputs) != 0 || len(f.iot.inputs) != 0 {
+		t.Fatal("AWS client called in dry run")
+	}
+	if logged := strings.Join(hook.logged(), ","); logged != "Publish,PutItem,PutMetricData,Upload" {
+		t.Errorf("expected the input of every sink logged, got %s", logged)
+	}
+}
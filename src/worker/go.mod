@@ -1,9 +1,16 @@
 require (
-	github.com/aws/aws-lambda-go v1.32.0 // indirect
-	github.com/aws/aws-sdk-go v1.44.24 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
+	github.com/aws/aws-lambda-go v1.32.0
+	github.com/aws/aws-sdk-go v1.44.24
+	github.com/fxamacker/cbor/v2 v2.4.0 // indirect
+	github.com/sirupsen/logrus v1.8.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5 // indirect
+	go.opentelemetry.io/otel/trace v1.11.2
+	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
+	siot v0.0.0
 )
 
-module worker
+module siot/worker
 
 go 1.13
+
+replace siot => ../
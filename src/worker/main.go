@@ -2,23 +2,49 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
+	"math/rand"
+	"net"
 	"os"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/aws/aws-sdk-go/service/iot"
+	"github.com/aws/aws-sdk-go/service/iotdataplane"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
+
+	"siot/internal/awsfactory"
+	"siot/internal/codec"
+	"siot/internal/config"
+	"siot/internal/dynamo"
+	"siot/internal/logging"
+	"siot/internal/preflight"
+	"siot/internal/tracing"
 )
 
 // ****************************************************
@@ -35,27 +61,175 @@ type IoTEvent struct {
 
 // type of Information
 type Information struct {
-	Device string  `json:"device"`
-	Temp   float64 `json:"temperature"`
-	Hum    float64 `json:"humidity"`
-	Action string  `json:"action"`
+	Device      string            `json:"device"`
+	Temp        float64           `json:"temperature"`
+	Hum         float64           `json:"humidity"`
+	Pressure    float64           `json:"pressure,omitempty"`
+	Action      string            `json:"action"`
+	Building    string            `json:"building,omitempty"`
+	Timestamp   int64             `json:"timestamp,omitempty"`
+	TraceParent string            `json:"traceparent,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	// software version of the device, to correlate the anomalies with a rollout
+	FirmwareVersion string `json:"fw_version,omitempty"`
+	// identifier of the reading given by the device, logged with the event and stored with the item
+	CorrelationID string `json:"correlation_id,omitempty"`
 }
 
 // type of Item
 type Item struct {
-	Digest string  `json:"digest"`
-	Device string  `json:"device"`
-	Temp   float64 `json:"temperature"`
-	Hum    float64 `json:"humidity"`
-	Action string  `json:"action"`
-	TTL    int64   `json:"ttl"`
+	Digest    string  `json:"digest"`
+	Device    string  `json:"device"`
+	Temp      float64 `json:"temperature"`
+	Hum       float64 `json:"humidity"`
+	Pressure  float64 `json:"pressure,omitempty"`
+	Action    string  `json:"action"`
+	Timestamp int64   `json:"timestamp,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
+	TTL       int64   `json:"ttl"`
+	// tags of the device, stored as they are in a nested map
+	Tags            map[string]string `json:"tags,omitempty"`
+	FirmwareVersion string            `json:"fw_version,omitempty"`
+	CorrelationID   string            `json:"correlation_id,omitempty"`
+	// items without it were written before it was introduced, with schema version 1
+	SchemaVersion int `json:"schema_version"`
+}
+
+// type of s3Uploader, satisfied by the s3manager uploader
+type s3Uploader interface {
+	Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error)
+}
+
+// type of dynamoPutter, satisfied by the DynamoDB client
+type dynamoPutter interface {
+	PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+}
+
+// type of cwPutter, satisfied by the CloudWatch client
+type cwPutter interface {
+	PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// type of iotPublisher, satisfied by the IoT data client
+type iotPublisher interface {
+	Publish(input *iotdataplane.PublishInput) (*iotdataplane.PublishOutput, error)
+}
+
+// type of limitedUploader, s3 uploader holding a slot of the in-flight AWS calls during every upload
+type limitedUploader struct {
+	s3Uploader
+}
+
+// type of limitedDynamo, DynamoDB client holding a slot of the in-flight AWS calls during every write
+type limitedDynamo struct {
+	dynamoPutter
+}
+
+// type of limitedCloudWatch, CloudWatch client holding a slot of the in-flight AWS calls during every put
+type limitedCloudWatch struct {
+	cwPutter
+}
+
+// type of DeviceWindow, readings of a device aggregated before being sent to Cloudwatch
+type DeviceWindow struct {
+	Temp       *cloudwatch.StatisticSet
+	Hum        *cloudwatch.StatisticSet
+	Pressure   *cloudwatch.StatisticSet
+	Dimensions []*cloudwatch.Dimension
+	Started    time.Time
+}
+
+// type of MetricWindow, aggregation windows of every device seen by the container
+type MetricWindow struct {
+	mu      sync.Mutex
+	devices map[string]*DeviceWindow
+}
+
+// type of BuildingReading, last reading of a device kept for the building aggregates
+type BuildingReading struct {
+	Temp float64
+	Hum  float64
+	At   time.Time
+}
+
+// type of BuildingWindow, recent readings of the devices of every building seen by the container
+type BuildingWindow struct {
+	mu        sync.Mutex
+	buildings map[string]map[string]BuildingReading
+}
+
+// type of Range, closed interval of plausible values for a reading
+type Range struct {
+	Min float64
+	Max float64
 }
 
 // type of Job for pipelining of function
 type Job struct {
 	Event  *IoTEvent
+	Now    string
+	Key    string
 	Result string
 	Error  error
+	Sink   string
+}
+
+// type of SinkError, failure of one of the sinks of the pipeline
+type SinkError struct {
+	Sink      string
+	Retryable bool
+	Err       error
+}
+
+// type of Sampler, count of the readings of every device, keeping one every rate
+type Sampler struct {
+	mu     sync.Mutex
+	rate   int64
+	counts map[string]int64
+}
+
+// type of LocalFile, JSON-lines file shared by the concurrent writes of the localfile sink
+type LocalFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// type of Alarm, notification sent on the alarm topic when a reading crosses a safety limit or returns within it
+type Alarm struct {
+	Device    string  `json:"device"`
+	Metric    string  `json:"metric"`
+	State     string  `json:"state"`
+	Limit     string  `json:"limit"`
+	Threshold float64 `json:"threshold"`
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp,omitempty"`
+}
+
+// type of AlarmState, limit currently crossed by every metric of every device seen by the container
+type AlarmState struct {
+	mu      sync.Mutex
+	crossed map[string]string
+}
+
+// type of BinaryEvent, a binary payload wrapped in base64 by the IoT rule (SELECT encode(*, 'base64') AS data)
+type BinaryEvent struct {
+	Data []byte `json:"data"`
+}
+
+// type of BatchEvent, an event decoded from a record of a Kinesis or SQS batch, with the identifier reported
+// on failure and the one unique to the record, which names what it is stored as
+type BatchEvent struct {
+	ID     string
+	Record string
+	Event  IoTEvent
+}
+
+// type of BatchFailure, a record of a Kinesis or SQS batch that failed, with the reason
+type BatchFailure struct {
+	ID     string
+	Reason string
 }
 
 // ****************************************************
@@ -63,20 +237,101 @@ type Job struct {
 // ****************************************************
 
 var (
-	err           error
-	historyBucket string
-	tableName     string
-	unixNow       string
-	ttlDynamo     int64
-	s3svc         *s3manager.Uploader
-	dynamodbsvc   *dynamodb.DynamoDB
-	cwsvc         *cloudwatch.CloudWatch
+	historyBucket       string
+	tableName           string
+	stackName           string
+	stage               string
+	source              string
+	requestID           string
+	maxConcurrentEvents int
+	reportBatchFailures bool
+	tagRequestID        bool
+	ttlDynamo           time.Duration
+	s3PartSize          int64
+	s3Concurrency       int
+	partitionStrategy   string
+	logSampleRate       int64
+	logFlushInterval    time.Duration
+	factory             awsfactory.Factory
+	sess                *session.Session
+	metricAggregation   string
+	metricWindowSize    int64
+	metricFlushInterval time.Duration
+	shutdownFlush       bool
+	dryRun              bool
+	highResMetrics      bool
+	highResDevices      string
+	highResPattern      string
+	highResSet          map[string]bool
+	highResRegexp       *regexp.Regexp
+	emitSinkMetrics     bool
+	cwDimensions        string
+	inputEncoding       string
+	sampler             = &Sampler{counts: make(map[string]int64)}
+	metricWindow        = &MetricWindow{devices: make(map[string]*DeviceWindow)}
+	bucketNamePattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	tableNamePattern    = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,255}$`)
+	metadataKeyPattern  = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	validTempRange      Range
+	validHumRange       Range
+	dlqPrefix           string
+	onUnknownAction     string
+	sinks               string
+	localOutput         = &LocalFile{}
+	statsdOutput        = &StatsD{}
+	otelEndpoint        string
+	dynamoMode          string
+	dynamoRetry         dynamo.RetryPolicy
+	dynamoMinimal       bool
+	dynamoMinimalTTL    time.Duration
+	buildingAggregates  bool
+	buildingWindowAge   time.Duration
+	buildingWindow      = &BuildingWindow{buildings: make(map[string]map[string]BuildingReading)}
+	preflightEnabled    bool
+	preflightFailFast   bool
+	tracer              trace.Tracer
+	s3svc               s3Uploader
+	dynamodbsvc         dynamoPutter
+	cwsvc               cwPutter
+	maxInflightAWSCalls int64
+	inflight            *semaphore.Weighted
+	summaryEvent        bool
+	maxClockSkew        time.Duration
+	clockSkewPolicy     string
+	alarmTopic          string
+	alarmHigh           string
+	alarmLow            string
+	alarmHighLimits     map[string]float64
+	alarmLowLimits      map[string]float64
+	alarmState          = &AlarmState{crossed: make(map[string]string)}
+	iotsvc              iotPublisher
 )
 
 const (
 	Monitor Action = iota
 	Remediate
-	TTL_DYNAMO = 60
+	TTL_DYNAMO = 24 * time.Hour
+	SOURCE     = "iot"
+	// history objects are a few hundred bytes, so they are always sent with a single PutObject:
+	// keep the minimum part size and one goroutine to avoid allocating buffers that are never used
+	S3_PART_SIZE          = s3manager.MinUploadPartSize
+	S3_CONCURRENCY        = 1
+	PARTITION_STRATEGY    = "none"
+	METRIC_AGGREGATION    = "raw"
+	METRIC_WINDOW_SIZE    = 10
+	METRIC_FLUSH_INTERVAL = time.Minute
+	VALID_TEMP_RANGE      = "-50:100"
+	VALID_HUM_RANGE       = "0:100"
+	DYNAMO_MODE           = "history"
+	BUILDING_WINDOW       = 5 * time.Minute
+	DYNAMO_MINIMAL_TTL    = 15 * time.Minute
+	ON_UNKNOWN_ACTION     = "reject"
+	CLOCK_SKEW_POLICY     = "server-time"
+	SINKS                 = "metrics,history,dynamo"
+	CW_DIMENSIONS         = "Device"
+	LOCAL_OUTPUT          = "events.jsonl"
+	// the events of a batch all run their pipeline at the same time unless a limit is set
+	MAX_CONCURRENT_EVENTS = 0
 )
 
 // ****************************************************
@@ -86,91 +341,950 @@ const (
 func init() {
 
 	// set logger
-	log.SetFormatter(&log.JSONFormatter{})
-	log.SetOutput(os.Stdout)
-	log.SetLevel(log.InfoLevel)
-	logLevelStr := os.Getenv("LOG_LEVEL")
-	if strings.Compare(logLevelStr, "ERROR") == 0 {
-		log.SetLevel(log.ErrorLevel)
-	}
-	if strings.Compare(logLevelStr, "WARNING") == 0 {
-		log.SetLevel(log.WarnLevel)
-	}
-	if strings.Compare(logLevelStr, "DEBUG") == 0 {
-		log.SetLevel(log.DebugLevel)
+	logging.Setup(config.Lookup("LOG_LEVEL"))
+	logging.SetQuiet(config.Bool("QUIET", false))
+	// init sampling and batching of the log lines
+	logSampleRate = config.Int("LOG_SAMPLE_RATE", 1)
+	logFlushInterval = config.Duration("LOG_FLUSH_INTERVAL", 0)
+	historyBucket = config.Lookup("HISTORY_BUCKET")
+	tableName = config.Lookup("MONITORING_TABLE")
+	// init naming convention of the bucket and the table, used when they are not given explicitly
+	stackName = config.Lookup("STACK_NAME")
+	stage = config.Lookup("STAGE")
+
+	// set input source from environment variable or default
+	source = config.String("SOURCE", SOURCE)
+	// init encoding of the payloads published by the devices
+	inputEncoding = config.String("INPUT_ENCODING", codec.JSON)
+	// init the events of a batch processed at the same time
+	maxConcurrentEvents = int(config.Int("MAX_CONCURRENT_EVENTS", MAX_CONCURRENT_EVENTS))
+	// init the report of the failed records only, for the event source mappings with ReportBatchItemFailures
+	reportBatchFailures = config.Bool("REPORT_BATCH_FAILURES", false)
+	// init the AWS calls in flight at the same time in the container, across invocations
+	maxInflightAWSCalls = config.Int("MAX_INFLIGHT_AWS_CALLS", 0)
+
+	// init building aggregates, computed over the readings of the last window
+	buildingAggregates = config.Bool("EMIT_BUILDING_AGGREGATES", false)
+	buildingWindowAge = config.Duration("BUILDING_WINDOW", BUILDING_WINDOW)
+
+	// init preflight checks of the resources at cold start
+	preflightEnabled = config.Bool("PREFLIGHT", false)
+	preflightFailFast = config.Bool("PREFLIGHT_FAIL_FAST", false)
+
+	// init dynamo write mode
+	dynamoMode = config.String("DYNAMO_MODE", DYNAMO_MODE)
+	// init minimal items, kept only for the remediation stream
+	dynamoMinimal = config.Bool("DYNAMO_MINIMAL", false)
+	dynamoMinimalTTL = config.Duration("DYNAMO_MINIMAL_TTL", DYNAMO_MINIMAL_TTL)
+	// init retry of the throttled dynamo writes
+	dynamoRetry = dynamo.RetryPolicy{
+		MaxRetries: int(config.Int("DYNAMO_MAX_RETRIES", dynamo.MAX_RETRIES)),
+		BaseDelay:  config.Duration("DYNAMO_RETRY_DELAY", dynamo.BASE_DELAY),
+		Jitter:     config.Float("DYNAMO_RETRY_JITTER", dynamo.JITTER),
 	}
-	historyBucket = os.Getenv("HISTORY_BUCKET")
-	tableName = os.Getenv("MONITORING_TABLE")
 
 	// init ttl dynamo
-	ttlDynamo, err = strconv.ParseInt(os.Getenv("TTL_DYNAMO"), 10, 64)
-	if err != nil {
-		ttlDynamo = TTL_DYNAMO
-	}
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(os.Getenv("AWS_REGION")),
-	}))
+	ttlDynamo = parseTTL(config.Lookup("TTL_DYNAMO"))
+	// init s3 uploader tuning
+	s3PartSize = config.Int("S3_PART_SIZE", S3_PART_SIZE)
+	s3Concurrency = int(config.Int("S3_CONCURRENCY", S3_CONCURRENCY))
+	// init the prefix spreading the history objects over the S3 partitions
+	partitionStrategy = config.String("PARTITION_KEY_STRATEGY", PARTITION_STRATEGY)
+	// init metric aggregation
+	metricAggregation = config.String("METRIC_AGGREGATION", METRIC_AGGREGATION)
+	metricWindowSize = config.Int("METRIC_WINDOW_SIZE", METRIC_WINDOW_SIZE)
+	metricFlushInterval = config.Duration("METRIC_FLUSH_INTERVAL", METRIC_FLUSH_INTERVAL)
+	// init the flush of the buffers when the container is shut down
+	shutdownFlush = config.Bool("SHUTDOWN_FLUSH", true)
+	// init the dry run, logging the calls of the AWS sinks instead of making them
+	dryRun = config.Bool("DRY_RUN", false)
+	highResMetrics = config.Bool("HIGH_RES_METRICS", false)
+	// init the devices whose metrics are stored at high resolution, by ID list or pattern, none if both are empty
+	highResDevices = config.Lookup("HIGH_RES_DEVICES")
+	highResPattern = config.Lookup("HIGH_RES_DEVICE_PATTERN")
+	emitSinkMetrics = config.Bool("EMIT_SINK_METRICS", false)
+	cwDimensions = config.String("CW_DIMENSIONS", CW_DIMENSIONS)
+	// init sampling of the readings stored, one every rate per device
+	sampler.rate = config.Int("SAMPLE_RATE", 1)
+	// init validation of the incoming events
+	validTempRange = parseRange(config.String("VALID_TEMP_RANGE", VALID_TEMP_RANGE))
+	validHumRange = parseRange(config.String("VALID_HUM_RANGE", VALID_HUM_RANGE))
+	dlqPrefix = config.Lookup("DLQ_PREFIX")
+	onUnknownAction = config.String("ON_UNKNOWN_ACTION", ON_UNKNOWN_ACTION)
+	// init the check of the device clocks, disabled if zero
+	maxClockSkew = config.Duration("MAX_CLOCK_SKEW", 0)
+	clockSkewPolicy = config.String("CLOCK_SKEW_POLICY", CLOCK_SKEW_POLICY)
+
+	// init sinks the events are written to, and the file of the localfile sink
+	sinks = config.String("SINKS", SINKS)
+	localOutput.path = config.String("LOCAL_OUTPUT", LOCAL_OUTPUT)
+	// init the endpoint of the statsd sink, host:port, and the prefix of its metrics
+	statsdOutput.addr = config.Lookup("STATSD_ADDR")
+	statsdOutput.prefix = config.String("STATSD_PREFIX", STATSD_PREFIX)
+	// init the topic and the safety limits of the alarm sink, as metric=threshold lists
+	alarmTopic = config.Lookup("ALARM_TOPIC")
+	alarmHigh = config.Lookup("ALARM_HIGH")
+	alarmLow = config.Lookup("ALARM_LOW")
+
+	// init the full event in the summary line of every event
+	summaryEvent = config.Bool("SUMMARY_EVENT", false)
+	// init tagging of logs, objects and items with the Lambda request ID
+	tagRequestID = config.Bool("TAG_REQUEST_ID", false)
+
+	// init OpenTelemetry collector endpoint, tracing disabled if empty
+	otelEndpoint = config.Lookup("OTEL_ENDPOINT")
+	// init the endpoint and region of the AWS clients, the emulated ones if overridden
+	factory = awsfactory.New()
+	sess = factory.Session()
 
 	// init services
-	s3svc = s3manager.NewUploader(sess)
 	dynamodbsvc = dynamodb.New(sess)
 	cwsvc = cloudwatch.New(sess)
 
 }
 
+// take a slot of the in-flight AWS calls, waiting for one to be free, and return its release
+func acquire() func() {
+	if inflight == nil {
+		return func() {}
+	}
+	inflight.Acquire(context.Background(), 1)
+	return func() { inflight.Release(1) }
+}
+
+// upload within the limit of the in-flight AWS calls
+func (l limitedUploader) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	defer acquire()()
+	return l.s3Uploader.Upload(input, options...)
+}
+
+// put the item within the limit of the in-flight AWS calls
+func (l limitedDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	defer acquire()()
+	return l.dynamoPutter.PutItem(input)
+}
+
+// update the item within the limit of the in-flight AWS calls
+func (l limitedDynamo) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	defer acquire()()
+	return l.dynamoPutter.UpdateItem(input)
+}
+
+// put the metrics within the limit of the in-flight AWS calls
+func (l limitedCloudWatch) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	defer acquire()()
+	return l.cwPutter.PutMetricData(input)
+}
+
+// create the IoT data client, discovering the ATS data endpoint of the account if none is configured
+func newIoTDataPlane(sess *session.Session) (*iotdataplane.IoTDataPlane, error) {
+	endpoint := config.Lookup("IOT_CORE_ENDPOINT")
+	if strings.Compare(endpoint, "") == 0 && factory.Overridden() {
+		endpoint = factory.Endpoint
+	} else if strings.Compare(endpoint, "") == 0 {
+		out, err := iot.New(sess).DescribeEndpoint(&iot.DescribeEndpointInput{EndpointType: aws.String("iot:Data-ATS")})
+		if err != nil {
+			return nil, fmt.Errorf("IOT_CORE_ENDPOINT not set and discovery failed: %s", err)
+		}
+		endpoint = aws.StringValue(out.EndpointAddress)
+	}
+	return iotdataplane.New(sess, aws.NewConfig().WithEndpoint(endpoint)), nil
+}
+
+// create the s3 uploader with the configured part size and concurrency
+func newUploader(sess *session.Session) *s3manager.Uploader {
+	if s3PartSize < s3manager.MinUploadPartSize {
+		log.Warnf("S3 part size %d below the minimum allowed, using %d", s3PartSize, s3manager.MinUploadPartSize)
+		s3PartSize = s3manager.MinUploadPartSize
+	}
+	if s3Concurrency < 1 {
+		log.Warnf("S3 concurrency %d not valid, using %d", s3Concurrency, S3_CONCURRENCY)
+		s3Concurrency = S3_CONCURRENCY
+	}
+	return s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = s3PartSize
+		u.Concurrency = s3Concurrency
+	})
+}
+
 // map the integer value of an action to its corresponding value
 func (d Action) String() string {
 	return [...]string{"Monitor", "Remediate"}[d]
 }
 
+// select the reading of an event by the structure of the document: the nested schema ({"body":{...}}, also
+// with the topic and timestamp a rule may add beside it), a rule envelope ({"topic":...,"payload":{...}})
+// or the flat schema, the reading itself
+func unwrapReading(decode func(v interface{}) error) (*Information, error) {
+	var shape struct {
+		Body    *Information `json:"body"`
+		Payload *Information `json:"payload"`
+		Topic   string       `json:"topic"`
+		Device  string       `json:"device"`
+	}
+	if err := decode(&shape); err != nil {
+		return nil, err
+	}
+	switch {
+	case shape.Body != nil:
+		return shape.Body, nil
+	case shape.Payload != nil && strings.Compare(shape.Topic, "") != 0:
+		return shape.Payload, nil
+	case strings.Compare(shape.Device, "") != 0:
+		var flat Information
+		if err := decode(&flat); err != nil {
+			return nil, err
+		}
+		return &flat, nil
+	}
+	return nil, errors.New(`unrecognized event, expected a reading, {"body":{...}} or {"topic":...,"payload":{...}}`)
+}
+
+// decode an event in any of the shapes of unwrapReading
+func (e *IoTEvent) UnmarshalJSON(data []byte) error {
+	body, err := unwrapReading(func(v interface{}) error { return json.Unmarshal(data, v) })
+	if err != nil {
+		return err
+	}
+	e.Body = body
+	return nil
+}
+
+// parse the retention of the DynamoDB items as a duration, accepting the deprecated number of seconds
+func parseTTL(value string) time.Duration {
+	if strings.Compare(value, "") == 0 {
+		return TTL_DYNAMO
+	}
+	if ttl, err := time.ParseDuration(value); err == nil {
+		return ttl
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		log.Warnf("TTL_DYNAMO=%s as seconds is deprecated, use a duration like %s", value, time.Duration(seconds)*time.Second)
+		return time.Duration(seconds) * time.Second
+	}
+	log.Warnf("TTL_DYNAMO=%s not valid, using %s", value, TTL_DYNAMO)
+	return TTL_DYNAMO
+}
+
+// parse a range in the min:max form, falling back to an unbounded one if not valid
+func parseRange(value string) Range {
+	bounds := strings.Split(value, ":")
+	if len(bounds) == 2 {
+		min, errMin := strconv.ParseFloat(strings.TrimSpace(bounds[0]), 64)
+		max, errMax := strconv.ParseFloat(strings.TrimSpace(bounds[1]), 64)
+		if errMin == nil && errMax == nil && min <= max {
+			return Range{Min: min, Max: max}
+		}
+	}
+	log.Warnf("Range %s not valid, readings will not be bounded", value)
+	return Range{Min: math.Inf(-1), Max: math.Inf(1)}
+}
+
+// report whether the value falls in the range
+func (r Range) Contains(value float64) bool {
+	return value >= r.Min && value <= r.Max
+}
+
+// string representation of the range, as accepted by parseRange
+func (r Range) String() string {
+	return fmt.Sprintf("%g:%g", r.Min, r.Max)
+}
+
+// parse a range flag in the min:max form
+func (r *Range) Set(value string) error {
+	*r = parseRange(value)
+	return nil
+}
+
+// describe the failure with the sink it comes from
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Sink, e.Err)
+}
+
+// the underlying error returned by AWS
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// wrap the error of a sink, deciding if retrying the event could succeed (throttling, 5xx, network failures)
+func sinkError(sink string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SinkError{Sink: sink, Retryable: request.IsErrorThrottle(err) || request.IsErrorRetryable(err), Err: err}
+}
+
+// parse the safety limits in the metric=threshold,... form, for the metrics of the readings
+func parseThresholds(value string) (map[string]float64, error) {
+	thresholds := make(map[string]float64)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); strings.Compare(pair, "") == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid alarm threshold, expected metric=value: %s", pair)
+		}
+		metric := strings.TrimSpace(parts[0])
+		if _, ok := metricValue(&Information{}, metric); !ok {
+			return nil, fmt.Errorf("unknown alarm metric: %s", metric)
+		}
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alarm threshold of %s: %s", metric, parts[1])
+		}
+		thresholds[metric] = threshold
+	}
+	return thresholds, nil
+}
+
+// value of the named metric of the reading, false if there is no such metric
+func metricValue(info *Information, metric string) (float64, bool) {
+	switch metric {
+	case "temperature":
+		return info.Temp, true
+	case "humidity":
+		return info.Hum, true
+	case "pressure":
+		return info.Pressure, true
+	}
+	return 0, false
+}
+
+// the alarms raised or cleared by the reading: only a crossing of a limit notifies, not every reading beyond it
+func (s *AlarmState) Transitions(info *Information, high map[string]float64, low map[string]float64) []Alarm {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var alarms []Alarm
+	for _, metric := range []string{"temperature", "humidity", "pressure"} {
+		value, _ := metricValue(info, metric)
+		limit, threshold := "", 0.0
+		if t, ok := high[metric]; ok && value > t {
+			limit, threshold = "high", t
+		} else if t, ok := low[metric]; ok && value < t {
+			limit, threshold = "low", t
+		}
+		key := info.Device + "/" + metric
+		previous := s.crossed[key]
+		if strings.Compare(previous, limit) == 0 {
+			continue
+		}
+		if strings.Compare(previous, "") != 0 {
+			t := high[metric]
+			if strings.Compare(previous, "low") == 0 {
+				t = low[metric]
+			}
+			alarms = append(alarms, Alarm{Device: info.Device, Metric: metric, State: "ok", Limit: previous, Threshold: t, Value: value, Timestamp: info.Timestamp})
+		}
+		if strings.Compare(limit, "") != 0 {
+			alarms = append(alarms, Alarm{Device: info.Device, Metric: metric, State: "alarm", Limit: limit, Threshold: threshold, Value: value, Timestamp: info.Timestamp})
+			s.crossed[key] = limit
+		} else {
+			delete(s.crossed, key)
+		}
+	}
+	return alarms
+}
+
+// restore the limits crossed before the alarms, which could not be published, so that the next reading raises
+// them again; a limit changed since by another reading of the device is left as it is
+func (s *AlarmState) Rollback(unpublished []Alarm) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	restored := make(map[string]bool)
+	for i, alarm := range unpublished {
+		key := alarm.Device + "/" + alarm.Metric
+		if restored[key] {
+			continue
+		}
+		restored[key] = true
+		// the limit crossed before, unless its return within was published, and the one the reading left crossed
+		before, after := "", ""
+		if strings.Compare(alarm.State, "ok") == 0 {
+			before = alarm.Limit
+		}
+		for _, later := range unpublished[i:] {
+			if strings.Compare(later.Device+"/"+later.Metric, key) == 0 && strings.Compare(later.State, "alarm") == 0 {
+				after = later.Limit
+			}
+		}
+		if strings.Compare(s.crossed[key], after) != 0 {
+			continue
+		}
+		if strings.Compare(before, "") == 0 {
+			delete(s.crossed, key)
+		} else {
+			s.crossed[key] = before
+		}
+	}
+}
+
+// decode an event from a payload in the input encoding, in any of the shapes of unwrapReading
+func decodeEvent(data []byte) (IoTEvent, error) {
+	var event IoTEvent
+	body, err := unwrapReading(func(v interface{}) error { return codec.Unmarshal(inputEncoding, data, v) })
+	if err != nil {
+		return event, err
+	}
+	event.Body = body
+	return event, nil
+}
+
+// name of a resource following the <stack>-<stage>-<suffix> convention, empty without stack name or stage
+func derivedName(suffix string) string {
+	if strings.Compare(stackName, "") == 0 || strings.Compare(stage, "") == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-%s", stackName, stage, suffix)
+}
+
+// check the name of the history bucket against the S3 naming rules
+func validBucketName(name string) error {
+	if !bucketNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid history bucket name: %s", name)
+	}
+	return nil
+}
+
+// check the name of the monitoring table against the DynamoDB naming rules
+func validTableName(name string) error {
+	if !tableNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid monitoring table name: %s", name)
+	}
+	return nil
+}
+
+// names of the enabled sinks, given comma separated
+func enabledSinks() []string {
+	var names []string
+	for _, name := range strings.Split(sinks, ",") {
+		if name = strings.TrimSpace(name); strings.Compare(name, "") != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// report whether the sink is enabled
+func sinkEnabled(sink string) bool {
+	for _, name := range enabledSinks() {
+		if strings.Compare(name, sink) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// report whether the reading of the device is one to keep: the first of every rate readings
+func (s *Sampler) Keep(device string) bool {
+	if s.rate <= 1 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.counts[device]
+	s.counts[device] = (n + 1) % s.rate
+	return n == 0
+}
+
+// append a line to the file, opened on the first write; the lock keeps the lines of concurrent events whole
+func (f *LocalFile) Append(line []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.file = file
+	}
+	_, err := f.file.Write(append(line, '\n'))
+	return err
+}
+
+// map the name of an action to its corresponding value
+func parseAction(name string) (Action, bool) {
+	for _, a := range []Action{Monitor, Remediate} {
+		if strings.Compare(a.String(), name) == 0 {
+			return a, true
+		}
+	}
+	return Monitor, false
+}
+
+// remember the request ID of the invocation, if tagging is enabled, and add it to every log line
+func tagRequest(ctx context.Context) {
+	requestID = ""
+	if lc, ok := lambdacontext.FromContext(ctx); ok && tagRequestID {
+		requestID = lc.AwsRequestID
+	}
+	logging.SetField("request_id", requestID)
+}
+
+// metadata of the uploaded objects, carrying the request ID if tagged and the tags of the device as tag-<key>;
+// the tags that cannot be an HTTP header are left to the object body
+func objectMetadata(tags map[string]string) map[string]*string {
+	metadata := make(map[string]*string)
+	if strings.Compare(requestID, "") != 0 {
+		metadata["request-id"] = aws.String(requestID)
+	}
+	for key, value := range tags {
+		if !metadataKeyPattern.MatchString(key) || strings.IndexFunc(value, func(c rune) bool { return c < 0x20 || c > 0x7e }) >= 0 {
+			log.Debugf("Tag %s not valid as object metadata, kept in the object only", key)
+			continue
+		}
+		metadata["tag-"+key] = aws.String(value)
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
 // ****************************************************
 // ****************** CORE FUNCTION *******************
 // ****************************************************
 
-// publish on Cloudwatch metrics for the specific device using the information in the message
-func publishMetric(m *Job, r chan *Job) {
-	_, err := cwsvc.PutMetricData(&cloudwatch.PutMetricDataInput{
-		Namespace: aws.String("Device/Monitoring"),
-		MetricData: []*cloudwatch.MetricDatum{
+// check that the event carries a plausible reading of a known device
+func validate(event IoTEvent) error {
+	if event.Body == nil {
+		return errors.New("missing body")
+	}
+	if strings.Compare(event.Body.Device, "") == 0 {
+		return errors.New("missing device")
+	}
+	if !validTempRange.Contains(event.Body.Temp) {
+		return fmt.Errorf("temperature %g out of range %s", event.Body.Temp, validTempRange)
+	}
+	if !validHumRange.Contains(event.Body.Hum) {
+		return fmt.Errorf("humidity %g out of range %s", event.Body.Hum, validHumRange)
+	}
+	if _, ok := parseAction(event.Body.Action); !ok && strings.Compare(onUnknownAction, "reject") == 0 {
+		return fmt.Errorf("unknown action %q", event.Body.Action)
+	}
+	return nil
+}
+
+// apply the unknown action policy to a valid event, reporting whether it must still be processed
+func handleUnknownAction(event IoTEvent) (bool, error) {
+	if _, ok := parseAction(event.Body.Action); ok {
+		return true, nil
+	}
+	switch onUnknownAction {
+	case "skip":
+		log.Warnf("Skipping event of %s with unknown action %q", event.Body.Device, event.Body.Action)
+		err := putMetrics([]*cloudwatch.MetricDatum{
 			&cloudwatch.MetricDatum{
-				MetricName: aws.String("Temperature"),
-				Unit:       aws.String("None"),
-				Value:      aws.Float64(m.Event.Body.Temp),
-				Dimensions: []*cloudwatch.Dimension{
-					&cloudwatch.Dimension{
-						Name:  aws.String("Device"),
-						Value: aws.String(m.Event.Body.Device),
-					},
-				},
+				MetricName: aws.String("UnknownActions"),
+				Unit:       aws.String("Count"),
+				Value:      aws.Float64(1),
 			},
-			&cloudwatch.MetricDatum{
-				MetricName: aws.String("Humidity"),
-				Unit:       aws.String("None"),
-				Value:      aws.Float64(m.Event.Body.Hum),
-				Dimensions: []*cloudwatch.Dimension{
-					&cloudwatch.Dimension{
-						Name:  aws.String("Device"),
-						Value: aws.String(m.Event.Body.Device),
-					},
+		})
+		if err != nil {
+			log.Errorf("Error in publish UnknownActions metric: %s", err)
+		}
+		return false, nil
+	case "error":
+		return false, fmt.Errorf("unknown action %q", event.Body.Action)
+	}
+	return true, nil
+}
+
+// check the timestamp of the reading against the clock of the worker and apply the skew policy when it is
+// further than the maximum skew, in the future or in the past; the error is set if the event is to be rejected
+func handleClockSkew(event IoTEvent, now time.Time) error {
+	if maxClockSkew <= 0 || event.Body.Timestamp == 0 {
+		return nil
+	}
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	skew := time.Duration(event.Body.Timestamp-nowMs) * time.Millisecond
+	if skew <= maxClockSkew && skew >= -maxClockSkew {
+		return nil
+	}
+	err := putMetrics([]*cloudwatch.MetricDatum{
+		&cloudwatch.MetricDatum{
+			MetricName: aws.String("ClockSkewDetected"),
+			Unit:       aws.String("Count"),
+			Value:      aws.Float64(1),
+		},
+	})
+	if err != nil {
+		log.Errorf("Error in publish ClockSkewDetected metric: %s", err)
+	}
+	log.WithField("clock_skew", skew.Seconds()).Warnf("Timestamp of %s off by %s, over the maximum clock skew of %s (%s)", event.Body.Device, skew, maxClockSkew, clockSkewPolicy)
+	switch clockSkewPolicy {
+	case "reject":
+		return fmt.Errorf("timestamp %d off by %s", event.Body.Timestamp, skew)
+	case "clamp":
+		bound := int64(maxClockSkew / time.Millisecond)
+		if skew < 0 {
+			bound = -bound
+		}
+		event.Body.Timestamp = nowMs + bound
+	default:
+		event.Body.Timestamp = nowMs
+	}
+	return nil
+}
+
+// move an invalid event to the DLQ prefix if configured, count it as invalid otherwise
+func rejectEvent(event IoTEvent, reason error, key string) {
+	e, _ := json.Marshal(event)
+	log.Warnf("Invalid event (%s): %s", reason, string(e))
+	deadLetter(event, key, "InvalidEvents")
+}
+
+// move an event to the DLQ prefix if configured, count it with the given metric otherwise
+func deadLetter(event IoTEvent, key string, metric string) {
+	e, _ := json.Marshal(event)
+	if strings.Compare(dlqPrefix, "") != 0 {
+		_, err := s3svc.Upload(&s3manager.UploadInput{
+			Bucket:   aws.String(historyBucket),
+			Key:      aws.String(dlqPrefix + key),
+			Body:     bytes.NewReader(e),
+			Metadata: objectMetadata(nil),
+		})
+		if err == nil {
+			return
+		}
+		log.Errorf("Error in DLQ upload: %s", err)
+	}
+	err := putMetrics([]*cloudwatch.MetricDatum{
+		&cloudwatch.MetricDatum{
+			MetricName: aws.String(metric),
+			Unit:       aws.String("Count"),
+			Value:      aws.Float64(1),
+		},
+	})
+	if err != nil {
+		log.Errorf("Error in publish %s metric: %s", metric, err)
+	}
+}
+
+// names of the Information fields the device metrics are dimensioned by, given comma separated
+func dimensionNames() []string {
+	var names []string
+	for _, name := range strings.Split(cwDimensions, ",") {
+		if name = strings.TrimSpace(name); strings.Compare(name, "") != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// check that the dimension names a string field of the events
+func validDimension(name string) error {
+	field, ok := reflect.TypeOf(Information{}).FieldByName(name)
+	if !ok || field.Type.Kind() != reflect.String {
+		return fmt.Errorf("unknown metric dimension: %s", name)
+	}
+	return nil
+}
+
+// dimensions of the device metrics of the event, the fields left empty in the event omitted
+func eventDimensions(body *Information) []*cloudwatch.Dimension {
+	var dimensions []*cloudwatch.Dimension
+	for _, name := range dimensionNames() {
+		value := reflect.ValueOf(body).Elem().FieldByName(name)
+		if !value.IsValid() || strings.Compare(value.String(), "") == 0 {
+			continue
+		}
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(value.String()),
+		})
+	}
+	return dimensions
+}
+
+// key identifying the combination of dimension values, e.g. Device=1;Building=2
+func dimensionKey(dimensions []*cloudwatch.Dimension) string {
+	var parts []string
+	for _, d := range dimensions {
+		parts = append(parts, aws.StringValue(d.Name)+"="+aws.StringValue(d.Value))
+	}
+	return strings.Join(parts, ";")
+}
+
+// create a metric datum with the given dimensions
+func deviceDatum(name string, dimensions []*cloudwatch.Dimension) *cloudwatch.MetricDatum {
+	return &cloudwatch.MetricDatum{
+		MetricName: aws.String(name),
+		Unit:       aws.String("None"),
+		Dimensions: dimensions,
+	}
+}
+
+// add a reading to the statistic set, initializing it on the first one
+func addToStatSet(set *cloudwatch.StatisticSet, value float64) {
+	if aws.Float64Value(set.SampleCount) == 0 {
+		set.Minimum = aws.Float64(value)
+		set.Maximum = aws.Float64(value)
+	}
+	set.SampleCount = aws.Float64(aws.Float64Value(set.SampleCount) + 1)
+	set.Sum = aws.Float64(aws.Float64Value(set.Sum) + value)
+	set.Minimum = aws.Float64(math.Min(aws.Float64Value(set.Minimum), value))
+	set.Maximum = aws.Float64(math.Max(aws.Float64Value(set.Maximum), value))
+}
+
+// add the readings of the event to the window of its device, returning the datums to flush if the window is full
+func (w *MetricWindow) Add(event *IoTEvent) []*cloudwatch.MetricDatum {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dimensions := eventDimensions(event.Body)
+	key := dimensionKey(dimensions)
+	window, ok := w.devices[key]
+	if !ok {
+		window = &DeviceWindow{Temp: &cloudwatch.StatisticSet{}, Hum: &cloudwatch.StatisticSet{}, Pressure: &cloudwatch.StatisticSet{}, Dimensions: dimensions, Started: time.Now()}
+		w.devices[key] = window
+	}
+	addToStatSet(window.Temp, event.Body.Temp)
+	addToStatSet(window.Hum, event.Body.Hum)
+	// devices without a barometer never report a pressure
+	if event.Body.Pressure != 0 {
+		addToStatSet(window.Pressure, event.Body.Pressure)
+	}
+	if int64(aws.Float64Value(window.Temp.SampleCount)) < metricWindowSize && time.Since(window.Started) < metricFlushInterval {
+		return nil
+	}
+	delete(w.devices, key)
+	return window.Datums()
+}
+
+// drain every window, returning the datums to flush
+func (w *MetricWindow) Drain() []*cloudwatch.MetricDatum {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var datums []*cloudwatch.MetricDatum
+	for key, window := range w.devices {
+		datums = append(datums, window.Datums()...)
+		delete(w.devices, key)
+	}
+	return datums
+}
+
+// convert the window of the device to metric datums
+func (d *DeviceWindow) Datums() []*cloudwatch.MetricDatum {
+	temp := deviceDatum("Temperature", d.Dimensions)
+	temp.StatisticValues = d.Temp
+	hum := deviceDatum("Humidity", d.Dimensions)
+	hum.StatisticValues = d.Hum
+	datums := []*cloudwatch.MetricDatum{temp, hum}
+	if aws.Float64Value(d.Pressure.SampleCount) > 0 {
+		pressure := deviceDatum("Pressure", d.Dimensions)
+		pressure.StatisticValues = d.Pressure
+		datums = append(datums, pressure)
+	}
+	return datums
+}
+
+// record the reading of the event, returning the mean temperature and humidity of its building
+func (w *BuildingWindow) Add(event *IoTEvent) (float64, float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	devices, ok := w.buildings[event.Body.Building]
+	if !ok {
+		devices = make(map[string]BuildingReading)
+		w.buildings[event.Body.Building] = devices
+	}
+	now := time.Now()
+	devices[event.Body.Device] = BuildingReading{Temp: event.Body.Temp, Hum: event.Body.Hum, At: now}
+	var temp, hum float64
+	for device, reading := range devices {
+		if now.Sub(reading.At) > buildingWindowAge {
+			delete(devices, device)
+			continue
+		}
+		temp += reading.Temp
+		hum += reading.Hum
+	}
+	return temp / float64(len(devices)), hum / float64(len(devices))
+}
+
+// create the building aggregate datums for the event, none if disabled or the building is unknown
+func buildingDatums(event *IoTEvent) []*cloudwatch.MetricDatum {
+	if !buildingAggregates || strings.Compare(event.Body.Building, "") == 0 {
+		return nil
+	}
+	temp, hum := buildingWindow.Add(event)
+	datums := []*cloudwatch.MetricDatum{}
+	for name, value := range map[string]float64{"BuildingAvgTemperature": temp, "BuildingAvgHumidity": hum} {
+		datums = append(datums, &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Unit:       aws.String("None"),
+			Value:      aws.Float64(value),
+			Dimensions: []*cloudwatch.Dimension{
+				&cloudwatch.Dimension{
+					Name:  aws.String("Building"),
+					Value: aws.String(event.Body.Building),
 				},
 			},
-		},
+		})
+	}
+	return datums
+}
+
+// store the datums at 1-second resolution, stamped with the time the reading was taken if known
+func highResolution(datums []*cloudwatch.MetricDatum, event *IoTEvent) {
+	for _, datum := range datums {
+		datum.StorageResolution = aws.Int64(1)
+		// a statistic set spans several readings, so it keeps the time it is received
+		if datum.StatisticValues == nil && event.Body.Timestamp > 0 {
+			datum.Timestamp = aws.Time(time.Unix(0, event.Body.Timestamp*int64(time.Millisecond)))
+		}
+	}
+}
+
+// IDs of the devices listed, given comma separated
+func parseDeviceList(list string) map[string]bool {
+	devices := make(map[string]bool)
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); strings.Compare(id, "") != 0 {
+			devices[id] = true
+		}
+	}
+	return devices
+}
+
+// report whether the metrics of the device are stored at high resolution, being listed or matching the pattern
+func highResDevice(device string) bool {
+	if highResSet[device] {
+		return true
+	}
+	return highResRegexp != nil && highResRegexp.MatchString(device)
+}
+
+// send the datums to Cloudwatch
+func putMetrics(datums []*cloudwatch.MetricDatum) error {
+	_, err := cwsvc.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String("Device/Monitoring"),
+		MetricData: datums,
 	})
+	return err
+}
+
+// flush on Cloudwatch every reading still aggregated in the window
+func flushMetrics() error {
+	datums := metricWindow.Drain()
+	if len(datums) == 0 {
+		return nil
+	}
+	return putMetrics(datums)
+}
+
+// publish on Cloudwatch metrics for the specific device using the information in the message
+func publishMetric(m *Job, r chan *Job) {
+	datums := buildingDatums(m.Event)
+	// the building metrics mix the devices, so only the ones of the device follow its class
+	building := len(datums)
+	if strings.Compare(metricAggregation, "statset") == 0 {
+		datums = append(datums, metricWindow.Add(m.Event)...)
+		if len(datums) == 0 {
+			log.Debugf("Reading of %s aggregated in metric window", m.Event.Body.Device)
+			r <- &Job{Event: m.Event, Now: m.Now, Result: m.Event.Body.Action, Error: nil}
+			return
+		}
+	} else {
+		dimensions := eventDimensions(m.Event.Body)
+		temp := deviceDatum("Temperature", dimensions)
+		temp.Value = aws.Float64(m.Event.Body.Temp)
+		hum := deviceDatum("Humidity", dimensions)
+		hum.Value = aws.Float64(m.Event.Body.Hum)
+		datums = append(datums, temp, hum)
+		if m.Event.Body.Pressure != 0 {
+			pressure := deviceDatum("Pressure", dimensions)
+			pressure.Value = aws.Float64(m.Event.Body.Pressure)
+			datums = append(datums, pressure)
+		}
+	}
+	if highResMetrics {
+		highResolution(datums, m.Event)
+	} else if highResDevice(m.Event.Body.Device) {
+		highResolution(datums[building:], m.Event)
+	}
+	err := putMetrics(datums)
 	if err != nil {
 		log.Error(fmt.Sprintf("Error in publish metric: %s", err))
 	}
-	r <- &Job{Event: m.Event, Result: m.Event.Body.Action, Error: err}
+	r <- &Job{Event: m.Event, Now: m.Now, Result: m.Event.Body.Action, Error: sinkError("metrics", err)}
+}
+
+// check that every component of the partition key strategy is a known one
+func validPartitionStrategy(strategy string) error {
+	if strings.Compare(strategy, "none") == 0 {
+		return nil
+	}
+	for _, component := range strings.Split(strategy, "+") {
+		switch component {
+		case "device", "building", "random":
+		default:
+			return fmt.Errorf("unknown partition key strategy: %s", component)
+		}
+	}
+	return nil
+}
+
+// partition key of the event under the strategy, empty for none; random spreads the keys evenly but
+// loses the order of the readings of a device
+func partitionKey(event IoTEvent, strategy string) string {
+	if strings.Compare(strategy, "none") == 0 {
+		return ""
+	}
+	var parts []string
+	for _, component := range strings.Split(strategy, "+") {
+		switch component {
+		case "device":
+			parts = append(parts, event.Body.Device)
+		case "building":
+			if strings.Compare(event.Body.Building, "") == 0 {
+				parts = append(parts, "unknown")
+			} else {
+				parts = append(parts, event.Body.Building)
+			}
+		case "random":
+			parts = append(parts, fmt.Sprintf("%04x", rand.Intn(1<<16)))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// key of the event, unique to its record since the events of a batch, or of concurrent invocations, arrive
+// within the same second: the identifier of the record in the batch if any, the correlation ID given by the device
+// otherwise, so that a redelivery lands on the same key; without either, the arrival second, the device and the
+// arrival millisecond. The keys are not in time order, the readings are ordered by their timestamp attribute
+func recordKey(event IoTEvent, record string, start time.Time) string {
+	if strings.Compare(record, "") != 0 {
+		return record
+	}
+	device := ""
+	if event.Body != nil {
+		if strings.Compare(event.Body.CorrelationID, "") != 0 {
+			return event.Body.CorrelationID
+		}
+		device = event.Body.Device
+	}
+	return fmt.Sprintf("%d-%s-%d", start.Unix(), device, start.UnixNano()/int64(time.Millisecond))
+}
+
+// key of the history object of the event, under its partition key if any
+func historyKey(event IoTEvent, key string) string {
+	if prefix := partitionKey(event, partitionStrategy); strings.Compare(prefix, "") != 0 {
+		return prefix + "/" + key
+	}
+	return key
 }
 
 // historicize on s3 metrics for the specific device using the information in the message
 func historicizeOnS3Bucket(m *Job, r chan *Job) {
 	b, _ := json.Marshal(m.Event)
 	log.Debugf("Bucket: %s", historyBucket)
-	log.Debugf("EventKey: %s", unixNow)
+	key := historyKey(*m.Event, m.Key)
+	log.Debugf("EventKey: %s", key)
 	s3r, err := s3svc.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(historyBucket),
-		Key:    aws.String(unixNow),
-		Body:   bytes.NewReader(b),
+		Bucket:   aws.String(historyBucket),
+		Key:      aws.String(key),
+		Body:     bytes.NewReader(b),
+		Metadata: objectMetadata(m.Event.Body.Tags),
 	})
 	res := ""
 	if err != nil {
@@ -179,19 +1293,39 @@ func historicizeOnS3Bucket(m *Job, r chan *Job) {
 		dmy, _ := json.Marshal(s3r)
 		res = string(dmy)
 	}
-	r <- &Job{Event: m.Event, Result: res, Error: err}
+	r <- &Job{Event: m.Event, Now: m.Now, Result: res, Error: sinkError("history", err)}
 }
 
 // persist on DynamoDB metrics for the specific device using the information in the message
 func persistOnDynamoDB(m *Job, r chan *Job) {
-	ttl, _ := strconv.ParseInt(unixNow, 10, 64)
+	ttl, _ := strconv.ParseInt(m.Now, 10, 64)
 	i := &Item{
-		Digest: unixNow,
-		Device: m.Event.Body.Device,
-		Temp:   m.Event.Body.Temp,
-		Hum:    m.Event.Body.Hum,
-		Action: m.Event.Body.Action,
-		TTL:    ttl + ttlDynamo,
+		Digest:          m.Key,
+		Device:          m.Event.Body.Device,
+		Temp:            m.Event.Body.Temp,
+		Hum:             m.Event.Body.Hum,
+		Pressure:        m.Event.Body.Pressure,
+		Action:          m.Event.Body.Action,
+		Timestamp:       m.Event.Body.Timestamp,
+		RequestID:       requestID,
+		TTL:             ttl + int64(ttlDynamo.Seconds()),
+		Tags:            m.Event.Body.Tags,
+		FirmwareVersion: m.Event.Body.FirmwareVersion,
+		CorrelationID:   m.Event.Body.CorrelationID,
+		SchemaVersion:   dynamo.SCHEMA_VERSION,
+	}
+	if dynamoMinimal {
+		// only what the remediation reads from the stream, the full reading is in the history bucket
+		i = &Item{
+			Digest:        m.Key,
+			Device:        m.Event.Body.Device,
+			Temp:          m.Event.Body.Temp,
+			Hum:           m.Event.Body.Hum,
+			Action:        m.Event.Body.Action,
+			TTL:           ttl + int64(dynamoMinimalTTL.Seconds()),
+			CorrelationID: m.Event.Body.CorrelationID,
+			SchemaVersion: dynamo.SCHEMA_VERSION,
+		}
 	}
 	log.Debugf("Dynamo table name: %s", tableName)
 	dae, err := dynamodbattribute.MarshalMap(i)
@@ -202,7 +1336,7 @@ func persistOnDynamoDB(m *Job, r chan *Job) {
 		Item:      dae,
 		TableName: aws.String(tableName),
 	}
-	dar, err := dynamodbsvc.PutItem(input)
+	dar, err := dynamo.PutItem(dynamodbsvc, input, dynamoRetry)
 	res := ""
 	if err != nil {
 		log.Errorf("Error in PutItem: %s", err)
@@ -210,7 +1344,90 @@ func persistOnDynamoDB(m *Job, r chan *Job) {
 		dmy, _ := json.Marshal(dar)
 		res = string(dmy)
 	}
-	r <- &Job{Event: m.Event, Result: res, Error: err}
+	r <- &Job{Event: m.Event, Now: m.Now, Result: res, Error: sinkError("dynamo", err)}
+}
+
+// upsert on DynamoDB the latest reading of the specific device, refreshing its ttl
+func updateLatestOnDynamoDB(m *Job, r chan *Job) {
+	now, _ := strconv.ParseInt(m.Now, 10, 64)
+	update := expression.
+		Set(expression.Name("device"), expression.Value(m.Event.Body.Device)).
+		Set(expression.Name("temperature"), expression.Value(m.Event.Body.Temp)).
+		Set(expression.Name("humidity"), expression.Value(m.Event.Body.Hum)).
+		Set(expression.Name("action"), expression.Value(m.Event.Body.Action)).
+		Set(expression.Name("timestamp"), expression.Value(m.Event.Body.Timestamp)).
+		Set(expression.Name("ttl"), expression.Value(now+int64(ttlDynamo.Seconds()))).
+		Set(expression.Name("schema_version"), expression.Value(dynamo.SCHEMA_VERSION))
+	if m.Event.Body.Pressure != 0 {
+		update = update.Set(expression.Name("pressure"), expression.Value(m.Event.Body.Pressure))
+	}
+	if strings.Compare(requestID, "") != 0 {
+		update = update.Set(expression.Name("request_id"), expression.Value(requestID))
+	}
+	if len(m.Event.Body.Tags) > 0 {
+		update = update.Set(expression.Name("tags"), expression.Value(m.Event.Body.Tags))
+	}
+	if strings.Compare(m.Event.Body.FirmwareVersion, "") != 0 {
+		update = update.Set(expression.Name("fw_version"), expression.Value(m.Event.Body.FirmwareVersion))
+	}
+	if strings.Compare(m.Event.Body.CorrelationID, "") != 0 {
+		update = update.Set(expression.Name("correlation_id"), expression.Value(m.Event.Body.CorrelationID))
+	}
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		log.Errorf("Error in update expression: %s", err)
+		r <- &Job{Event: m.Event, Now: m.Now, Result: "", Error: sinkError("dynamo", err)}
+		return
+	}
+	log.Debugf("Dynamo table name: %s", tableName)
+	dar, err := dynamo.UpdateItem(dynamodbsvc, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"digest": {S: aws.String(m.Event.Body.Device)},
+		},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}, dynamoRetry)
+	res := ""
+	if err != nil {
+		log.Errorf("Error in UpdateItem: %s", err)
+	} else {
+		dmy, _ := json.Marshal(dar)
+		res = string(dmy)
+	}
+	r <- &Job{Event: m.Event, Now: m.Now, Result: res, Error: sinkError("dynamo", err)}
+}
+
+// append the event as a line of the local JSON-lines file, in place of the AWS sinks for offline runs
+func appendToLocalFile(m *Job, r chan *Job) {
+	b, _ := json.Marshal(m.Event)
+	err := localOutput.Append(b)
+	if err != nil {
+		log.Errorf("Error in append to %s: %s", localOutput.path, err)
+	}
+	r <- &Job{Event: m.Event, Now: m.Now, Result: m.Event.Body.Action, Error: sinkError("localfile", err)}
+}
+
+// publish on the alarm topic the safety limits crossed by the reading, or returned within, since the previous one
+func raiseAlarms(m *Job, r chan *Job) {
+	var err error
+	alarms := alarmState.Transitions(m.Event.Body, alarmHighLimits, alarmLowLimits)
+	for i, alarm := range alarms {
+		payload, _ := json.Marshal(alarm)
+		if _, err = iotsvc.Publish(&iotdataplane.PublishInput{
+			Topic:   aws.String(alarmTopic),
+			Payload: payload,
+			Qos:     aws.Int64(1),
+		}); err != nil {
+			log.Errorf("Error in alarm publish: %s", err)
+			// the transitions not published are not taken, the next reading raises them again
+			alarmState.Rollback(alarms[i:])
+			break
+		}
+		log.WithField("alarm", alarm.State).Warnf("Alarm %s: %s of %s %s limit %g (%g)", alarm.State, alarm.Metric, alarm.Device, alarm.Limit, alarm.Threshold, alarm.Value)
+	}
+	r <- &Job{Event: m.Event, Now: m.Now, Result: m.Event.Body.Action, Error: sinkError("alarm", err)}
 }
 
 // ****************************************************
@@ -220,75 +1437,597 @@ func persistOnDynamoDB(m *Job, r chan *Job) {
 // operator Type function to chain actions
 type Operator func(m *Job, r chan *Job)
 
-// encapsulate the event in a Job
-func unit(c IoTEvent) *Job {
+// wrap the operator of a sink, counting its outcome with the SinkSuccess or SinkFailure metric
+func withSinkMetrics(sink string, o Operator) Operator {
+	return func(m *Job, r chan *Job) {
+		inner := make(chan *Job, 1)
+		o(m, inner)
+		result := <-inner
+		name := "SinkSuccess"
+		if result.Error != nil {
+			name = "SinkFailure"
+		}
+		err := putMetrics([]*cloudwatch.MetricDatum{
+			&cloudwatch.MetricDatum{
+				MetricName: aws.String(name),
+				Unit:       aws.String("Count"),
+				Value:      aws.Float64(1),
+				Dimensions: []*cloudwatch.Dimension{
+					&cloudwatch.Dimension{
+						Name:  aws.String("Sink"),
+						Value: aws.String(sink),
+					},
+				},
+			},
+		})
+		if err != nil {
+			log.Errorf("Error in publish %s metric of %s: %s", name, sink, err)
+		}
+		r <- result
+	}
+}
+
+// wrap the operator of a sink, naming its result after the sink
+func withSinkName(sink string, o Operator) Operator {
+	return func(m *Job, r chan *Job) {
+		inner := make(chan *Job, 1)
+		o(m, inner)
+		result := <-inner
+		result.Sink = sink
+		r <- result
+	}
+}
 
-	return &Job{Event: &c, Result: "", Error: nil}
+// operators of the enabled sinks, in the order they are given; the metrics and the alarms only if the reading is not sampled
+func sinkOperators(sampled bool) []Operator {
+	var operators []Operator
+	for _, name := range enabledSinks() {
+		if !sampled && strings.Compare(name, "metrics") != 0 && strings.Compare(name, "statsd") != 0 && strings.Compare(name, "alarm") != 0 {
+			continue
+		}
+		var o Operator
+		switch name {
+		case "metrics":
+			o = publishMetric
+		case "history":
+			o = historicizeOnS3Bucket
+		case "dynamo":
+			o = persistOnDynamoDB
+			if strings.Compare(dynamoMode, "latest") == 0 {
+				o = updateLatestOnDynamoDB
+			}
+		case "localfile":
+			o = appendToLocalFile
+		case "statsd":
+			o = emitStatsD
+		case "alarm":
+			o = raiseAlarms
+		default:
+			continue
+		}
+		if emitSinkMetrics {
+			o = withSinkMetrics(name, o)
+		}
+		operators = append(operators, withSinkName(name, o))
+	}
+	return operators
+}
+
+// encapsulate the event dispatched at the given unix timestamp, stored under the given key, in a Job
+func unit(c IoTEvent, now string, key string) *Job {
+
+	return &Job{Event: &c, Now: now, Key: key, Result: "", Error: nil}
 
 }
 
-// chain the operation over specific Job in a concurrent way
+// chain the operation over specific Job in a concurrent way: every operator sends exactly one Job of its own
+// on the returned channel, in completion order rather than in the order of the operators, so the channel
+// must be received from once per operator and a result is told apart by the Sink it is named after
 func pipeline(m *Job, os ...Operator) <-chan *Job {
 
 	r := make(chan *Job, len(os))
 	for i, o := range os {
 		e, _ := json.Marshal(m.Event)
-		log.Infof("Processing %d: %s", i, bytes.NewBuffer(e).String())
+		logging.Verbosef("Processing %d: %s", i, bytes.NewBuffer(e).String())
 		go o(m, r)
 	}
 	return r
 
 }
 
-// consume result for the specific Job
-func consume(r <-chan *Job, wg *sync.WaitGroup) {
+// consume one result for the specific Job, one consumer per operator of the pipeline
+func consume(r <-chan *Job, wg *sync.WaitGroup, results chan<- *Job) {
 
 	defer wg.Done()
 	m := <-r
 	if m.Error != nil {
 		log.Errorf("Error in consume: %s", m.Error)
 	}
+	results <- m
 
 }
 
-// lambda handler
-func handler(event IoTEvent) {
+// dispatch a single event through the whole pipeline and collect the errors; record identifies the event in
+// its batch, empty if it does not come from one
+func process(ctx context.Context, event IoTEvent, record string) error {
 
 	// isolate unix timestamp
-	unixNow = strconv.FormatInt(time.Now().Unix(), 10)
+	start := time.Now()
+	unixNow := strconv.FormatInt(start.Unix(), 10)
 
-	// load event
-	e, _ := json.Marshal(event)
-	log.Infof("Time start %s dispatch event: %+v", unixNow, string(e))
+	key := recordKey(event, record, start)
+
+	// discard events that cannot be trusted
+	if err := validate(event); err != nil {
+		rejectEvent(event, err, key)
+		return nil
+	}
+	if err := handleClockSkew(event, start); err != nil {
+		rejectEvent(event, err, key)
+		return nil
+	}
+	if ok, err := handleUnknownAction(event); !ok {
+		return err
+	}
+
+	// continue the trace started by the device
+	_, span := tracer.Start(tracing.Extract(ctx, event.Body.TraceParent), "process")
+	defer span.End()
 
 	// init a Jobs pipeline
 	var wg sync.WaitGroup
-	Jobs := pipeline(
-		unit(event),
-		publishMetric,
-		historicizeOnS3Bucket,
-		persistOnDynamoDB,
-	)
+	// every reading is sent to the metrics, only the sampled ones are stored
+	sampled := sampler.Keep(event.Body.Device)
+	if !sampled {
+		logging.Verbosef("Reading of %s not sampled, sent to the metrics only", event.Body.Device)
+	}
+	operators := sinkOperators(sampled)
+	Jobs := pipeline(unit(event, unixNow, key), operators...)
 
 	// consume the result
-	for i := 0; i < 3; i++ {
+	results := make(chan *Job, len(operators))
+	for i := 0; i < len(operators); i++ {
+		wg.Add(1)
+		go consume(Jobs, &wg, results)
+	}
+	wg.Wait()
+	close(results)
+
+	var failures []string
+	retryable := false
+	sinkResults := make(map[string]string)
+	for m := range results {
+		if m.Error == nil {
+			sinkResults[m.Sink] = "ok"
+			continue
+		}
+		sinkResults[m.Sink] = m.Error.Error()
+		failures = append(failures, m.Error.Error())
+		var sinkErr *SinkError
+		if !errors.As(m.Error, &sinkErr) || sinkErr.Retryable {
+			retryable = true
+		}
+	}
+
+	// a single machine-parseable line per event, for the log-based dashboards
+	summary := log.Fields{
+		"device":      event.Body.Device,
+		"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		"sampled":     sampled,
+		"sinks":       sinkResults,
+		"errors":      len(failures),
+	}
+	if strings.Compare(event.Body.CorrelationID, "") != 0 {
+		summary["correlation_id"] = event.Body.CorrelationID
+	}
+	if summaryEvent {
+		summary["event"] = event
+	}
+	logging.EventWithFields(summary, "Event of %s dispatched in %s", event.Body.Device, time.Since(start).Round(time.Microsecond))
+
+	if len(failures) == 0 {
+		return nil
+	}
+	err := errors.New(strings.Join(failures, "; "))
+	span.RecordError(err)
+	// only a transient failure is worth a retry of the invocation, a permanent one would fail again
+	if retryable {
+		return err
+	}
+	log.Errorf("Permanent failure of event (%s), moving it to the DLQ", err)
+	deadLetter(event, key, "FailedEvents")
+	return nil
+
+}
+
+// dispatch the events of a batch, at most maxConcurrentEvents at a time (unbounded if 0), returning the failures
+func processBatch(ctx context.Context, batch []BatchEvent) []BatchFailure {
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failures []BatchFailure
+	var sem chan struct{}
+	if maxConcurrentEvents > 0 {
+		sem = make(chan struct{}, maxConcurrentEvents)
+	}
+	for _, b := range batch {
+		if sem != nil {
+			sem <- struct{}{}
+		}
 		wg.Add(1)
-		go consume(Jobs, &wg)
+		go func(b BatchEvent) {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			if err := process(ctx, b.Event, b.Record); err != nil {
+				mu.Lock()
+				failures = append(failures, BatchFailure{ID: b.ID, Reason: err.Error()})
+				mu.Unlock()
+			}
+		}(b)
 	}
 	wg.Wait()
+	return failures
+
+}
+
+// identifiers of the failed records to report, or the error failing the whole batch if they are not reported
+func batchOutcome(failures []BatchFailure, total int, kind string) ([]string, error) {
+
+	if len(failures) == 0 {
+		return nil, nil
+	}
+	var ids, reasons []string
+	for _, f := range failures {
+		ids = append(ids, f.ID)
+		reasons = append(reasons, fmt.Sprintf("%s: %s", f.ID, f.Reason))
+	}
+	if !reportBatchFailures {
+		return nil, fmt.Errorf("%d of %d %s failed: %s", len(failures), total, kind, strings.Join(reasons, "; "))
+	}
+	log.Errorf("Error in %d of %d %s, reported for retry: %s", len(failures), total, kind, strings.Join(reasons, "; "))
+	return ids, nil
+
+}
+
+// lambda handler for events coming directly from IoT rule, decoded here to report the unrecognized ones
+func handler(ctx context.Context, data json.RawMessage) error {
+
+	tagRequest(ctx)
+	defer logging.Flush()
+	event, err := decodeEvent(data)
+	if err != nil {
+		log.Errorf("Error in decoding event: %v", err)
+		return nil
+	}
+	return process(ctx, event, "")
+
+}
+
+// lambda handler for the binary events coming from IoT rule, wrapped in base64
+func binaryHandler(ctx context.Context, wrapped BinaryEvent) error {
+
+	tagRequest(ctx)
+	defer logging.Flush()
+	event, err := decodeEvent(wrapped.Data)
+	if err != nil {
+		log.Errorf("Error in decoding %s event: %v", inputEncoding, err)
+		return nil
+	}
+	return process(ctx, event, "")
 
-	finish := strconv.FormatInt(time.Now().Unix(), 10)
-	log.Infof("Time end %s dispatch event: %+v", finish, bytes.NewBuffer(e).String())
+}
+
+// lambda handler for events coming from a Kinesis stream, the records identified by their sequence number
+func kinesisHandler(ctx context.Context, stream events.KinesisEvent) (events.KinesisEventResponse, error) {
+
+	tagRequest(ctx)
+	defer logging.Flush()
+	var failures []BatchFailure
+	var batch []BatchEvent
+	for _, record := range stream.Records {
+		event, err := decodeEvent(record.Kinesis.Data)
+		if err != nil {
+			log.Errorf("Error in decoding record %s: %v", record.EventID, err)
+			failures = append(failures, BatchFailure{ID: record.Kinesis.SequenceNumber, Reason: "invalid record"})
+			continue
+		}
+		batch = append(batch, BatchEvent{ID: record.Kinesis.SequenceNumber, Record: record.EventID, Event: event})
+	}
+	failures = append(failures, processBatch(ctx, batch)...)
+	var response events.KinesisEventResponse
+	ids, err := batchOutcome(failures, len(stream.Records), "records")
+	for _, id := range ids {
+		response.BatchItemFailures = append(response.BatchItemFailures, events.KinesisBatchItemFailure{ItemIdentifier: id})
+	}
+	return response, err
+
+}
+
+// lambda handler for events coming from a SQS queue
+func sqsHandler(ctx context.Context, queue events.SQSEvent) (events.SQSEventResponse, error) {
+
+	tagRequest(ctx)
+	defer logging.Flush()
+	var failures []BatchFailure
+	var batch []BatchEvent
+	for _, message := range queue.Records {
+		// a SQS message body is text, so the binary payloads travel in base64
+		var event IoTEvent
+		data, err := []byte(message.Body), error(nil)
+		if strings.Compare(inputEncoding, codec.JSON) != 0 {
+			data, err = base64.StdEncoding.DecodeString(message.Body)
+		}
+		if err == nil {
+			event, err = decodeEvent(data)
+		}
+		if err != nil {
+			log.Errorf("Error in decoding message %s: %v", message.MessageId, err)
+			failures = append(failures, BatchFailure{ID: message.MessageId, Reason: "invalid message"})
+			continue
+		}
+		batch = append(batch, BatchEvent{ID: message.MessageId, Record: message.MessageId, Event: event})
+	}
+	failures = append(failures, processBatch(ctx, batch)...)
+	var response events.SQSEventResponse
+	ids, err := batchOutcome(failures, len(queue.Records), "messages")
+	for _, id := range ids {
+		response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: id})
+	}
+	return response, err
+
+}
 
+// check the parameters and the resources the worker needs, without calling AWS
+func validateConfig() []error {
+	var problems []error
+	if sinkEnabled("history") {
+		if strings.Compare(historyBucket, "") == 0 {
+			problems = append(problems, fmt.Errorf("HISTORY_BUCKET is required, or STACK_NAME and STAGE"))
+		} else {
+			problems = append(problems, validBucketName(historyBucket))
+		}
+	}
+	if sinkEnabled("dynamo") {
+		if strings.Compare(tableName, "") == 0 {
+			problems = append(problems, fmt.Errorf("MONITORING_TABLE is required, or STACK_NAME and STAGE"))
+		} else {
+			problems = append(problems, validTableName(tableName))
+		}
+	}
+	if len(enabledSinks()) == 0 {
+		problems = append(problems, fmt.Errorf("no sink enabled"))
+	}
+	for _, name := range enabledSinks() {
+		switch name {
+		case "metrics", "history", "dynamo", "localfile", "statsd", "alarm":
+		default:
+			problems = append(problems, fmt.Errorf("unknown sink: %s", name))
+		}
+	}
+	if sinkEnabled("statsd") {
+		if strings.Compare(statsdOutput.addr, "") == 0 {
+			problems = append(problems, fmt.Errorf("STATSD_ADDR is required by the statsd sink"))
+		} else if _, _, err := net.SplitHostPort(statsdOutput.addr); err != nil {
+			problems = append(problems, fmt.Errorf("invalid STATSD_ADDR %s: %s", statsdOutput.addr, err))
+		}
+	}
+	if sinkEnabled("alarm") {
+		if strings.Compare(alarmTopic, "") == 0 || strings.ContainsAny(alarmTopic, "+#") {
+			problems = append(problems, fmt.Errorf("ALARM_TOPIC is required, without wildcards: %s", alarmTopic))
+		}
+		high, errHigh := parseThresholds(alarmHigh)
+		low, errLow := parseThresholds(alarmLow)
+		problems = append(problems, errHigh, errLow)
+		if len(high) == 0 && len(low) == 0 && errHigh == nil && errLow == nil {
+			problems = append(problems, fmt.Errorf("no alarm threshold configured"))
+		}
+	}
+	if strings.Compare(source, "iot") != 0 && strings.Compare(source, "kinesis") != 0 && strings.Compare(source, "sqs") != 0 {
+		problems = append(problems, fmt.Errorf("unknown input source: %s", source))
+	}
+	if strings.Compare(metricAggregation, "raw") != 0 && strings.Compare(metricAggregation, "statset") != 0 {
+		problems = append(problems, fmt.Errorf("unknown metric aggregation: %s", metricAggregation))
+	}
+	if strings.Compare(highResDevices, "") != 0 && len(parseDeviceList(highResDevices)) == 0 {
+		problems = append(problems, fmt.Errorf("no device in the high resolution devices: %s", highResDevices))
+	}
+	if strings.Compare(highResPattern, "") != 0 {
+		if _, err := regexp.Compile(highResPattern); err != nil {
+			problems = append(problems, fmt.Errorf("invalid high resolution device pattern %s: %s", highResPattern, err))
+		}
+	}
+	if strings.Compare(dynamoMode, "history") != 0 && strings.Compare(dynamoMode, "latest") != 0 {
+		problems = append(problems, fmt.Errorf("unknown dynamo mode: %s", dynamoMode))
+	}
+	switch onUnknownAction {
+	case "reject", "persist", "skip", "error":
+	default:
+		problems = append(problems, fmt.Errorf("unknown action policy: %s", onUnknownAction))
+	}
+	switch clockSkewPolicy {
+	case "server-time", "clamp", "reject":
+	default:
+		problems = append(problems, fmt.Errorf("unknown clock skew policy: %s", clockSkewPolicy))
+	}
+	if maxClockSkew < 0 {
+		problems = append(problems, fmt.Errorf("max clock skew must not be negative: %s", maxClockSkew))
+	}
+	for _, name := range dimensionNames() {
+		problems = append(problems, validDimension(name))
+	}
+	problems = append(problems, codec.Valid(inputEncoding))
+	if sampler.rate < 1 {
+		problems = append(problems, fmt.Errorf("sample rate must be positive: %d", sampler.rate))
+	}
+	if maxInflightAWSCalls < 0 {
+		problems = append(problems, fmt.Errorf("max in-flight AWS calls must not be negative: %d", maxInflightAWSCalls))
+	}
+	if maxConcurrentEvents < 0 {
+		problems = append(problems, fmt.Errorf("max concurrent events must not be negative: %d", maxConcurrentEvents))
+	}
+	if dynamoRetry.MaxRetries < 0 {
+		problems = append(problems, fmt.Errorf("dynamo max retries must not be negative: %d", dynamoRetry.MaxRetries))
+	}
+	problems = append(problems, validPartitionStrategy(partitionStrategy))
+	if logSampleRate < 1 {
+		problems = append(problems, fmt.Errorf("log sample rate must be at least 1: %d", logSampleRate))
+	}
+	if logFlushInterval < 0 {
+		problems = append(problems, fmt.Errorf("log flush interval must not be negative: %s", logFlushInterval))
+	}
+	return problems
 }
 
 func main() {
-	// if false {
-	// 	var iotEvent IoTEvent
-	// 	json.Unmarshal([]byte(os.Args[1]), &iotEvent)
-	// 	handler(iotEvent)
-	// } else {
-	// 	lambda.Start(handler)
-	// }
-	lambda.Start(handler)
+	flag.StringVar(&stackName, "stack-name", stackName, "Stack name the bucket and the table names are derived from, if not given")
+	flag.StringVar(&stage, "stage", stage, "Stage the bucket and the table names are derived from, if not given")
+	flag.StringVar(&source, "source", source, "Input source of the events (iot, kinesis, sqs)")
+	flag.StringVar(&inputEncoding, "input-encoding", inputEncoding, "Encoding of the payloads published by the devices (json, cbor, msgpack)")
+	flag.BoolVar(&reportBatchFailures, "report-batch-failures", reportBatchFailures, "Report only the failed records of a Kinesis or SQS batch for retry (requires ReportBatchItemFailures on the event source mapping)")
+	flag.IntVar(&maxConcurrentEvents, "max-concurrent-events", maxConcurrentEvents, "Events of a Kinesis or SQS batch processed at the same time (0 for unbounded)")
+	flag.Int64Var(&maxInflightAWSCalls, "max-inflight-aws-calls", maxInflightAWSCalls, "AWS calls in flight at the same time in the container, across invocations (0 for unbounded)")
+	flag.Int64Var(&s3PartSize, "s3-part-size", s3PartSize, "Part size (bytes) of the S3 multipart uploads")
+	flag.IntVar(&s3Concurrency, "s3-concurrency", s3Concurrency, "Number of parts uploaded in parallel to S3")
+	flag.StringVar(&partitionStrategy, "partition-key-strategy", partitionStrategy, "Prefix of the history objects: none, device, building, random or a + composite such as building+device")
+	flag.StringVar(&metricAggregation, "metric-aggregation", metricAggregation, "Metric publishing mode (raw sends every reading, statset aggregates a window of readings)")
+	flag.Int64Var(&metricWindowSize, "metric-window-size", metricWindowSize, "Readings of a device aggregated before flushing a statistic set")
+	flag.BoolVar(&highResMetrics, "high-res-metrics", highResMetrics, "Store the metrics at 1-second resolution, stamped with the time of the reading")
+	flag.StringVar(&highResDevices, "high-res-devices", highResDevices, "Comma separated devices whose metrics are stored at 1-second resolution, the others at the standard one")
+	flag.StringVar(&highResPattern, "high-res-device-pattern", highResPattern, "Regular expression of the devices whose metrics are stored at 1-second resolution")
+	flag.BoolVar(&emitSinkMetrics, "emit-sink-metrics", emitSinkMetrics, "Count the outcome of every sink with the SinkSuccess and SinkFailure metrics")
+	flag.Int64Var(&sampler.rate, "sample-rate", sampler.rate, "Store only one reading every rate of each device, still sending all of them to the metrics")
+	flag.StringVar(&cwDimensions, "cw-dimensions", cwDimensions, "Comma separated event fields the device metrics are dimensioned by (Device, Building, Action, FirmwareVersion)")
+	flag.DurationVar(&metricFlushInterval, "metric-flush-interval", metricFlushInterval, "Maximum age of an aggregation window before it is flushed")
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "Log the input of every S3, DynamoDB, CloudWatch and IoT call of the sinks instead of making it")
+	flag.BoolVar(&shutdownFlush, "shutdown-flush", shutdownFlush, "Flush the aggregated metrics and the buffered log lines when the container is shut down")
+	flag.Var(&validTempRange, "valid-temp-range", "Plausible temperature range (min:max) of the incoming events")
+	flag.Var(&validHumRange, "valid-hum-range", "Plausible humidity range (min:max) of the incoming events")
+	flag.StringVar(&onUnknownAction, "on-unknown-action", onUnknownAction, "Handling of an event with an unknown action (reject moves it to the DLQ, persist, skip, error)")
+	flag.DurationVar(&maxClockSkew, "max-clock-skew", maxClockSkew, "Maximum distance of the timestamp of a reading from the clock of the worker (0 to disable the check)")
+	flag.StringVar(&clockSkewPolicy, "clock-skew-policy", clockSkewPolicy, "Handling of a reading beyond the maximum clock skew (server-time, clamp, reject moves it to the DLQ)")
+	flag.StringVar(&sinks, "sinks", sinks, "Comma separated sinks the events are written to (metrics, history, dynamo, localfile, statsd, alarm)")
+	flag.StringVar(&statsdOutput.addr, "statsd-addr", statsdOutput.addr, "UDP host:port of the StatsD or DogStatsD endpoint of the statsd sink")
+	flag.StringVar(&statsdOutput.prefix, "statsd-prefix", statsdOutput.prefix, "Prefix of the metrics sent by the statsd sink")
+	flag.StringVar(&localOutput.path, "local-output", localOutput.path, "JSON-lines file the localfile sink appends the events to")
+	flag.StringVar(&alarmTopic, "alarm-topic", alarmTopic, "Topic the alarm sink publishes the crossings of the safety limits to")
+	flag.StringVar(&alarmHigh, "alarm-high", alarmHigh, "Comma separated metric=value upper safety limits of the alarm sink (temperature, humidity, pressure)")
+	flag.StringVar(&alarmLow, "alarm-low", alarmLow, "Comma separated metric=value lower safety limits of the alarm sink (temperature, humidity, pressure)")
+	flag.StringVar(&dlqPrefix, "dlq-prefix", dlqPrefix, "Prefix of the history bucket where invalid events are moved (empty to only count them)")
+	flag.StringVar(&otelEndpoint, "otel-endpoint", otelEndpoint, "OTLP/HTTP endpoint receiving the traces continued from the devices (disabled if empty)")
+	flag.StringVar(&dynamoMode, "dynamo-mode", dynamoMode, "DynamoDB write mode (history inserts every reading, latest upserts one row per device)")
+	flag.BoolVar(&dynamoMinimal, "dynamo-minimal", dynamoMinimal, "Insert only the fields the remediation needs, with a short ttl, leaving the full reading to S3")
+	flag.DurationVar(&dynamoMinimalTTL, "dynamo-minimal-ttl", dynamoMinimalTTL, "Retention of the minimal DynamoDB items")
+	flag.IntVar(&dynamoRetry.MaxRetries, "dynamo-max-retries", dynamoRetry.MaxRetries, "Retries of a throttled or failed DynamoDB write before giving up")
+	flag.DurationVar(&dynamoRetry.BaseDelay, "dynamo-retry-delay", dynamoRetry.BaseDelay, "Delay before the first retry of a DynamoDB write, doubled at every retry")
+	flag.Float64Var(&dynamoRetry.Jitter, "dynamo-retry-jitter", dynamoRetry.Jitter, "Fraction (0-1) of the retry delay randomized to spread the retries")
+	flag.BoolVar(&preflightEnabled, "preflight", preflightEnabled, "Check table and bucket access at cold start")
+	flag.BoolVar(&preflightFailFast, "preflight-fail-fast", preflightFailFast, "Refuse to start if a preflight check fails")
+	flag.DurationVar(&ttlDynamo, "ttl", ttlDynamo, "Retention of the DynamoDB items after they are written")
+	flag.BoolVar(&buildingAggregates, "emit-building-aggregates", buildingAggregates, "Emit the mean temperature and humidity of the devices of each building")
+	flag.BoolVar(&summaryEvent, "summary-event", summaryEvent, "Add the full event to the summary line logged for every event")
+	flag.BoolVar(&tagRequestID, "tag-request-id", tagRequestID, "Tag log lines, S3 objects and DynamoDB items with the Lambda request ID")
+	flag.DurationVar(&buildingWindowAge, "building-window", buildingWindowAge, "Age after which a device reading no longer counts in the building aggregates")
+	flag.Int64Var(&logSampleRate, "log-sample-rate", logSampleRate, "Keep one in every N info and debug lines, all the warnings and errors (1 keeps every line)")
+	flag.DurationVar(&logFlushInterval, "log-flush-interval", logFlushInterval, "Buffer the log lines and write them in batches at this interval (0 to write every line at once)")
+	validateOnly := config.ValidateOnlyFlag()
+	printSample := flag.Bool("print-sample-payload", false, "Print an example of the event expected from the IoT rule and exit")
+	config.PrefixFlag()
+	awsfactory.EndpointFlag()
+	flag.Parse()
+
+	// sample and buffer the log lines, now that the flags are known
+	logging.SetSampleRate(logSampleRate)
+	logging.SetBuffering(logFlushInterval)
+
+	// the explicit names take precedence over the convention
+	if strings.Compare(historyBucket, "") == 0 {
+		historyBucket = derivedName("history")
+	}
+	if strings.Compare(tableName, "") == 0 {
+		tableName = derivedName("monitoring")
+	}
+
+	if *printSample {
+		sample, _ := json.MarshalIndent(&IoTEvent{Body: &Information{
+			Device:      "930129302",
+			Temp:        27.4312,
+			Hum:         60.4312,
+			Pressure:    1014.12,
+			Action:      Monitor.String(),
+			Building:    "1",
+			Timestamp:   time.Now().UnixNano() / int64(time.Millisecond),
+			TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		}}, "", "  ")
+		fmt.Println(string(sample))
+		return
+	}
+
+	if err := config.Validate(validateConfig(), *validateOnly); err != nil {
+		log.Fatal(err)
+	}
+	s3svc = newUploader(sess)
+	highResSet = parseDeviceList(highResDevices)
+	if strings.Compare(highResPattern, "") != 0 {
+		highResRegexp = regexp.MustCompile(highResPattern)
+	}
+	if sinkEnabled("alarm") {
+		alarmHighLimits, _ = parseThresholds(alarmHigh)
+		alarmLowLimits, _ = parseThresholds(alarmLow)
+		if !dryRun {
+			client, err := newIoTDataPlane(sess)
+			if err != nil {
+				log.Fatalf("Refusing to start: %s", err)
+			}
+			iotsvc = client
+		}
+	}
+	if dryRun {
+		log.Warn("Dry run: no write is sent to AWS")
+		useDryRunClients()
+	}
+	// the limiter lives in the package, so a warm container shares it among all its invocations
+	if maxInflightAWSCalls > 0 {
+		inflight = semaphore.NewWeighted(maxInflightAWSCalls)
+		s3svc = limitedUploader{s3svc}
+		dynamodbsvc = limitedDynamo{dynamodbsvc}
+		cwsvc = limitedCloudWatch{cwsvc}
+	}
+	logging.StartRollup(time.Minute, "Events processed")
+	if _, err := tracing.Setup(otelEndpoint, "worker", true); err != nil {
+		log.Fatalf("Failed to setup tracing: %v", err)
+	}
+	tracer = tracing.Tracer("worker")
+	// only the buffering features leave something to flush
+	if shutdownFlush && (strings.Compare(metricAggregation, "statset") == 0 || logFlushInterval > 0) {
+		flushOnShutdown()
+	}
+	if preflightEnabled {
+		err := preflight.Run([]preflight.Check{
+			{Name: "table", Run: func() error {
+				_, err := dynamodb.New(sess).DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+				return err
+			}},
+			{Name: "bucket", Run: func() error {
+				_, err := s3.New(sess).HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(historyBucket)})
+				return err
+			}},
+		})
+		if err != nil && preflightFailFast {
+			log.Fatalf("Refusing to start: %s", err)
+		}
+	}
+	switch source {
+	case "iot":
+		if strings.Compare(inputEncoding, codec.JSON) != 0 {
+			lambda.Start(binaryHandler)
+		} else {
+			lambda.Start(handler)
+		}
+	case "kinesis":
+		lambda.Start(kinesisHandler)
+	case "sqs":
+		lambda.Start(sqsHandler)
+	}
 }
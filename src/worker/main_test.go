@@ -0,0 +1,1051 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/iotdataplane"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+
+	"siot/internal/codec"
+	"siot/internal/dynamo"
+	"siot/internal/tracing"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of fakeUploader, s3 uploader recording the uploads
+type fakeUploader struct {
+	mu     sync.Mutex
+	inputs []*s3manager.UploadInput
+	bodies []string
+	err    error
+}
+
+// type of fakeDynamo, DynamoDB client recording the writes
+type fakeDynamo struct {
+	mu      sync.Mutex
+	puts    []*dynamodb.PutItemInput
+	updates []*dynamodb.UpdateItemInput
+	errs    []error
+	// device whose items are always throttled
+	throttled string
+}
+
+// type of fakeCloudWatch, CloudWatch client recording the metrics
+type fakeCloudWatch struct {
+	mu     sync.Mutex
+	inputs []*cloudwatch.PutMetricDataInput
+	err    error
+}
+
+// type of fakePublisher, IoT data client recording the messages
+type fakePublisher struct {
+	mu     sync.Mutex
+	inputs []*iotdataplane.PublishInput
+	errs   []error
+}
+
+// type of fakes, the fake AWS services the worker is wired to
+type fakes struct {
+	s3     *fakeUploader
+	dynamo *fakeDynamo
+	cw     *fakeCloudWatch
+	iot    *fakePublisher
+}
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.FatalLevel)
+	tracer = tracing.Tracer("worker")
+	os.Exit(m.Run())
+}
+
+func (f *fakeUploader) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	body, _ := ioutil.ReadAll(input.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inputs = append(f.inputs, input)
+	f.bodies = append(f.bodies, string(body))
+	return &s3manager.UploadOutput{}, f.err
+}
+
+// the next error of the writes, nil once they are exhausted
+func (f *fakeDynamo) next() error {
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+func (f *fakeDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	if device := input.Item["device"]; device != nil && strings.Compare(aws.StringValue(device.S), f.throttled) == 0 {
+		return nil, awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+	}
+	f.puts = append(f.puts, input)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamo) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	f.updates = append(f.updates, input)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakePublisher) Publish(input *iotdataplane.PublishInput) (*iotdataplane.PublishOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	f.inputs = append(f.inputs, input)
+	return &iotdataplane.PublishOutput{}, nil
+}
+
+// names of the metrics put, in order
+func (f *fakeCloudWatch) metricNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for _, input := range f.inputs {
+		for _, datum := range input.MetricData {
+			names = append(names, aws.StringValue(datum.MetricName))
+		}
+	}
+	return names
+}
+
+func (f *fakeCloudWatch) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inputs = append(f.inputs, input)
+	return &cloudwatch.PutMetricDataOutput{}, f.err
+}
+
+// wire the worker to fake AWS services with the default settings, restoring the previous ones after the test
+func withFakes(t *testing.T) *fakes {
+	t.Helper()
+	f := &fakes{s3: &fakeUploader{}, dynamo: &fakeDynamo{}, cw: &fakeCloudWatch{}, iot: &fakePublisher{}}
+	s3Saved, dynamoSaved, cwSaved, iotSaved := s3svc, dynamodbsvc, cwsvc, iotsvc
+	sinksSaved, bucketSaved, tableSaved, modeSaved := sinks, historyBucket, tableName, dynamoMode
+	retrySaved, dlqSaved, samplerSaved, unknownSaved := dynamoRetry, dlqPrefix, sampler, onUnknownAction
+	concurrentSaved, reportSaved, minimalSaved := maxConcurrentEvents, reportBatchFailures, dynamoMinimal
+	t.Cleanup(func() {
+		s3svc, dynamodbsvc, cwsvc, iotsvc = s3Saved, dynamoSaved, cwSaved, iotSaved
+		sinks, historyBucket, tableName, dynamoMode = sinksSaved, bucketSaved, tableSaved, modeSaved
+		dynamoRetry, dlqPrefix, sampler, onUnknownAction = retrySaved, dlqSaved, samplerSaved, unknownSaved
+		maxConcurrentEvents, reportBatchFailures, dynamoMinimal = concurrentSaved, reportSaved, minimalSaved
+	})
+	s3svc, dynamodbsvc, cwsvc, iotsvc = f.s3, f.dynamo, f.cw, f.iot
+	sinks, historyBucket, tableName, dynamoMode = SINKS, "history-bucket", "monitoring-table", DYNAMO_MODE
+	dynamoRetry = dynamo.RetryPolicy{MaxRetries: 0}
+	dlqPrefix, onUnknownAction = "", ON_UNKNOWN_ACTION
+	sampler = &Sampler{rate: 1, counts: make(map[string]int64)}
+	maxConcurrentEvents, reportBatchFailures, dynamoMinimal = MAX_CONCURRENT_EVENTS, false, false
+	return f
+}
+
+// IoT event of a reading of the device
+func reading(device string, temp float64) IoTEvent {
+	return IoTEvent{Body: &Information{Device: device, Temp: temp, Hum: 40, Action: Monitor.String()}}
+}
+
+// raw IoT event of a reading of the device
+func rawReading(device string, temp float64) json.RawMessage {
+	b, _ := json.Marshal(reading(device, temp))
+	return b
+}
+
+// ****************************************************
+// ********************* TESTS ************************
+// ****************************************************
+
+// the real clients satisfy the interfaces the fakes stand in for
+var (
+	_ s3Uploader   = (*s3manager.Uploader)(nil)
+	_ dynamoPutter = (*dynamodb.DynamoDB)(nil)
+	_ cwPutter     = (*cloudwatch.CloudWatch)(nil)
+	_ iotPublisher = (*iotdataplane.IoTDataPlane)(nil)
+)
+
+func TestHandlerWritesEverySink(t *testing.T) {
+	f := withFakes(t)
+	if err := handler(context.Background(), rawReading("381938912", 21.5)); err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if len(f.s3.inputs) != 1 || aws.StringValue(f.s3.inputs[0].Bucket) != "history-bucket" {
+		t.Fatalf("expected one upload to the history bucket, got %d", len(f.s3.inputs))
+	}
+	if !strings.Contains(f.s3.bodies[0], `"device":"381938912"`) {
+		t.Errorf("history object without the reading: %s", f.s3.bodies[0])
+	}
+	if len(f.dynamo.puts) != 1 {
+		t.Fatalf("expected one item put, got %d", len(f.dynamo.puts))
+	}
+	item := f.dynamo.puts[0]
+	if aws.StringValue(item.TableName) != "monitoring-table" || aws.StringValue(item.Item["device"].S) != "381938912" || aws.StringValue(item.Item["temperature"].N) != "21.5" {
+		t.Errorf("unexpected item: %v", item)
+	}
+	var temp *cloudwatch.MetricDatum
+	for _, input := range f.cw.inputs {
+		for _, datum := range input.MetricData {
+			if aws.StringValue(datum.MetricName) == "Temperature" {
+				temp = datum
+			}
+		}
+	}
+	if temp == nil || aws.Float64Value(temp.Value) != 21.5 {
+		t.Errorf("expected the Temperature metric of 21.5, got %v", temp)
+	}
+}
+
+func TestHandlerFailureFailsInvocation(t *testing.T) {
+	f := withFakes(t)
+	f.dynamo.errs = []error{awserr.New("ProvisionedThroughputExceededException", "throttled", nil)}
+	err := handler(context.Background(), rawReading("381938912", 21.5))
+	if err == nil || !strings.Contains(err.Error(), "throttled") {
+		t.Fatalf("expected the dynamo failure to fail the invocation, got %v", err)
+	}
+	if len(f.s3.inputs) != 1 || len(f.cw.inputs) != 1 {
+		t.Errorf("expected the other sinks written despite the failure")
+	}
+}
+
+func TestInvalidEventsAreCountedAndNotStored(t *testing.T) {
+	cases := []struct {
+		name  string
+		event string
+	}{
+		{"empty body", `{"body":{}}`},
+		{"missing device", `{"body":{"temperature":21.5,"humidity":40,"action":"Monitor"}}`},
+		{"temperature too high", `{"body":{"device":"381938912","temperature":180,"humidity":40,"action":"Monitor"}}`},
+		{"temperature too low", `{"body":{"device":"381938912","temperature":-80,"humidity":40,"action":"Monitor"}}`},
+		{"humidity out of range", `{"body":{"device":"381938912","temperature":21.5,"humidity":140,"action":"Monitor"}}`},
+		{"unknown action", `{"body":{"device":"381938912","temperature":21.5,"humidity":40,"action":"Explode"}}`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := withFakes(t)
+			if err := handler(context.Background(), json.RawMessage(c.event)); err != nil {
+				t.Fatalf("invalid event failed the invocation: %v", err)
+			}
+			if len(f.s3.inputs) != 0 || len(f.dynamo.puts) != 0 {
+				t.Errorf("invalid event stored: %d objects, %d items", len(f.s3.inputs), len(f.dynamo.puts))
+			}
+			if names := f.cw.metricNames(); len(names) != 1 || names[0] != "InvalidEvents" {
+				t.Errorf("expected the InvalidEvents metric only, got %v", names)
+			}
+		})
+	}
+}
+
+func TestInvalidEventGoesToTheDLQPrefix(t *testing.T) {
+	f := withFakes(t)
+	dlqPrefix = "dlq/"
+	if err := handler(context.Background(), json.RawMessage(`{"body":{"device":"381938912","temperature":180,"humidity":40,"action":"Monitor"}}`)); err != nil {
+		t.Fatalf("invalid event failed the invocation: %v", err)
+	}
+	if len(f.s3.inputs) != 1 || !strings.HasPrefix(aws.StringValue(f.s3.inputs[0].Key), "dlq/") {
+		t.Fatalf("expected one object under the DLQ prefix, got %d", len(f.s3.inputs))
+	}
+	if !strings.Contains(f.s3.bodies[0], `"temperature":180`) {
+		t.Errorf("DLQ object without the event: %s", f.s3.bodies[0])
+	}
+	if len(f.dynamo.puts) != 0 || len(f.cw.metricNames()) != 0 {
+		t.Errorf("dead lettered event also stored or counted")
+	}
+}
+
+func TestDynamoModes(t *testing.T) {
+	f := withFakes(t)
+	if err := handler(context.Background(), rawReading("381938912", 21.5)); err != nil {
+		t.Fatalf("history write failed: %v", err)
+	}
+	if len(f.dynamo.puts) != 1 || len(f.dynamo.updates) != 0 {
+		t.Errorf("history mode: expected one item put, got %d puts and %d updates", len(f.dynamo.puts), len(f.dynamo.updates))
+	}
+
+	f = withFakes(t)
+	dynamoMode = "latest"
+	for _, temp := range []float64{21.5, 22.5} {
+		if err := handler(context.Background(), rawReading("381938912", temp)); err != nil {
+			t.Fatalf("latest write failed: %v", err)
+		}
+	}
+	if len(f.dynamo.puts) != 0 || len(f.dynamo.updates) != 2 {
+		t.Fatalf("latest mode: expected two updates, got %d puts and %d updates", len(f.dynamo.puts), len(f.dynamo.updates))
+	}
+	for _, update := range f.dynamo.updates {
+		if aws.StringValue(update.Key["digest"].S) != "381938912" {
+			t.Errorf("latest item not keyed by the device: %v", update.Key)
+		}
+	}
+	overwritten := false
+	for _, value := range f.dynamo.updates[1].ExpressionAttributeValues {
+		if aws.StringValue(value.N) == "22.5" {
+			overwritten = true
+		}
+	}
+	if !overwritten {
+		t.Errorf("latest item not overwritten with the last reading: %v", f.dynamo.updates[1].ExpressionAttributeValues)
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	cases := []struct {
+		value string
+		ttl   time.Duration
+	}{
+		{"", TTL_DYNAMO},
+		{"3600", time.Hour},
+		{"24h", 24 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"a day", TTL_DYNAMO},
+		{"12x", TTL_DYNAMO},
+	}
+	for _, c := range cases {
+		if ttl := parseTTL(c.value); ttl != c.ttl {
+			t.Errorf("TTL %q: expected %s, got %s", c.value, c.ttl, ttl)
+		}
+	}
+}
+
+// type of gaugedDynamo, fake table holding every write for a while and recording the most writes in flight
+type gaugedDynamo struct {
+	fakeDynamo
+	inFlight int64
+	peak     int64
+}
+
+func (g *gaugedDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	n := atomic.AddInt64(&g.inFlight, 1)
+	defer atomic.AddInt64(&g.inFlight, -1)
+	for {
+		peak := atomic.LoadInt64(&g.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&g.peak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return g.fakeDynamo.PutItem(input)
+}
+
+func TestBatchConcurrencyIsBounded(t *testing.T) {
+	var messages []events.SQSMessage
+	for i := 0; i < 20; i++ {
+		messages = append(messages, events.SQSMessage{MessageId: fmt.Sprintf("message-%d", i), Body: string(rawReading("381938912", 21.5))})
+	}
+	for _, limit := range []int{1, 3, MAX_CONCURRENT_EVENTS} {
+		withFakes(t)
+		table := &gaugedDynamo{}
+		dynamodbsvc, maxConcurrentEvents = table, limit
+		if _, err := sqsHandler(context.Background(), events.SQSEvent{Records: messages}); err != nil {
+			t.Fatalf("batch failed: %v", err)
+		}
+		if len(table.puts) != len(messages) {
+			t.Errorf("limit %d: expected %d items, got %d", limit, len(messages), len(table.puts))
+		}
+		if limit > 0 && table.peak > int64(limit) {
+			t.Errorf("limit %d: %d events in flight", limit, table.peak)
+		}
+		if limit == 0 && table.peak < 2 {
+			t.Errorf("unbounded: events processed one at a time")
+		}
+	}
+}
+
+func TestMinimalItemOmitsExtraFields(t *testing.T) {
+	f := withFakes(t)
+	dynamoMinimal = true
+	event := json.RawMessage(`{"body":{"device":"381938912","building":"1","temperature":21.5,"humidity":40,"pressure":1013.25,"action":"Monitor","timestamp":1700000000000}}`)
+	if err := handler(context.Background(), event); err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if len(f.dynamo.puts) != 1 || len(f.s3.inputs) != 1 {
+		t.Fatalf("expected one item and one history object, got %d and %d", len(f.dynamo.puts), len(f.s3.inputs))
+	}
+	var names []string
+	for name := range f.dynamo.puts[0].Item {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if expected := "action,device,digest,humidity,schema_version,temperature,ttl"; strings.Join(names, ",") != expected {
+		t.Errorf("expected the minimal item %s, got %s", expected, strings.Join(names, ","))
+	}
+	ttl, _ := strconv.ParseInt(aws.StringValue(f.dynamo.puts[0].Item["ttl"].N), 10, 64)
+	if remaining := time.Until(time.Unix(ttl, 0)); remaining > dynamoMinimalTTL || remaining < dynamoMinimalTTL-time.Minute {
+		t.Errorf("expected the minimal ttl of %s, got %s", dynamoMinimalTTL, remaining)
+	}
+	for _, field := range []string{`"pressure":1013.25`, `"timestamp":1700000000000`} {
+		if !strings.Contains(f.s3.bodies[0], field) {
+			t.Errorf("history object without %s: %s", field, f.s3.bodies[0])
+		}
+	}
+}
+
+func TestUnknownActionPolicies(t *testing.T) {
+	event := json.RawMessage(`{"body":{"device":"381938912","temperature":21.5,"humidity":40,"action":"Calibrate"}}`)
+	cases := []struct {
+		policy  string
+		fails   bool
+		stored  bool
+		metrics []string
+	}{
+		{"reject", false, false, []string{"InvalidEvents"}},
+		{"persist", false, true, []string{"Temperature", "Humidity"}},
+		{"skip", false, false, []string{"UnknownActions"}},
+		{"error", true, false, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			f := withFakes(t)
+			onUnknownAction = c.policy
+			if err := handler(context.Background(), event); (err != nil) != c.fails {
+				t.Fatalf("expected failure %t, got %v", c.fails, err)
+			}
+			if stored := len(f.dynamo.puts) == 1 && len(f.s3.inputs) == 1; stored != c.stored {
+				t.Errorf("expected stored %t, got %d items and %d objects", c.stored, len(f.dynamo.puts), len(f.s3.inputs))
+			}
+			names := f.cw.metricNames()
+			for _, metric := range c.metrics {
+				found := false
+				for _, name := range names {
+					found = found || name == metric
+				}
+				if !found {
+					t.Errorf("expected the %s metric, got %v", metric, names)
+				}
+			}
+			if c.metrics == nil && len(names) != 0 {
+				t.Errorf("expected no metric, got %v", names)
+			}
+		})
+	}
+}
+
+func TestBinaryEventsOfEveryEncoding(t *testing.T) {
+	reading := &Information{Device: "381938912", Temp: 27.4312, Hum: 60.4312, Pressure: 1013.25, Action: Monitor.String(), Timestamp: 1700000000000}
+	for _, encoding := range []string{codec.JSON, codec.CBOR, codec.MSGPACK} {
+		// the simulator publishes the nested or the flat schema
+		for _, payload := range []interface{}{IoTEvent{Body: reading}, reading} {
+			f := withFakes(t)
+			saved := inputEncoding
+			inputEncoding = encoding
+			data, err := codec.Marshal(encoding, payload)
+			if err != nil {
+				t.Fatalf("%s: marshal failed: %v", encoding, err)
+			}
+			err = binaryHandler(context.Background(), BinaryEvent{Data: data})
+			inputEncoding = saved
+			if err != nil {
+				t.Fatalf("%s: handler failed: %v", encoding, err)
+			}
+			if len(f.dynamo.puts) != 1 {
+				t.Fatalf("%s: expected the reading stored, got %d items", encoding, len(f.dynamo.puts))
+			}
+			item := f.dynamo.puts[0].Item
+			if aws.StringValue(item["device"].S) != "381938912" || aws.StringValue(item["temperature"].N) != "27.4312" || aws.StringValue(item["pressure"].N) != "1013.25" {
+				t.Errorf("%s: reading not decoded as sent: %v", encoding, item)
+			}
+		}
+	}
+}
+
+func TestSamplingStoresEveryFifthReading(t *testing.T) {
+	f := withFakes(t)
+	sampler = &Sampler{rate: 5, counts: make(map[string]int64)}
+	for i := 0; i < 20; i++ {
+		if err := handler(context.Background(), rawReading("381938912", 21.5)); err != nil {
+			t.Fatalf("handler failed: %v", err)
+		}
+	}
+	if len(f.s3.inputs) != 4 || len(f.dynamo.puts) != 4 {
+		t.Errorf("expected 4 readings stored, got %d objects and %d items", len(f.s3.inputs), len(f.dynamo.puts))
+	}
+	temperatures := 0
+	for _, name := range f.cw.metricNames() {
+		if name == "Temperature" {
+			temperatures++
+		}
+	}
+	if temperatures != 20 {
+		t.Errorf("expected the metrics of every reading, got %d", temperatures)
+	}
+}
+
+func TestSamplerCountsPerDeviceConcurrently(t *testing.T) {
+	sampler := &Sampler{rate: 5, counts: make(map[string]int64)}
+	var kept int64
+	var wg sync.WaitGroup
+	for _, device := range []string{"381938912", "930129302", "120030012"} {
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(device string) {
+				defer wg.Done()
+				if sampler.Keep(device) {
+					atomic.AddInt64(&kept, 1)
+				}
+			}(device)
+		}
+	}
+	wg.Wait()
+	if kept != 30 {
+		t.Errorf("expected 10 readings kept for each of the 3 devices, got %d", kept)
+	}
+}
+
+func TestPipelineRunsEveryOperatorOnce(t *testing.T) {
+	latencies := map[string]time.Duration{"slow": 30 * time.Millisecond, "instant": 0, "medium": 10 * time.Millisecond, "failing": 5 * time.Millisecond}
+	var calls sync.Map
+	var operators []Operator
+	for name, latency := range latencies {
+		name, latency := name, latency
+		operators = append(operators, withSinkName(name, func(m *Job, r chan *Job) {
+			n, _ := calls.LoadOrStore(name, new(int64))
+			atomic.AddInt64(n.(*int64), 1)
+			time.Sleep(latency)
+			var err error
+			if name == "failing" {
+				err = sinkError(name, errors.New("unavailable"))
+			}
+			r <- &Job{Event: m.Event, Now: m.Now, Result: name, Error: err}
+		}))
+	}
+	event := IoTEvent{Body: &Information{Device: "381938912"}}
+	jobs := pipeline(unit(event, "1700000000", "1700000000-381938912"), operators...)
+	var wg sync.WaitGroup
+	results := make(chan *Job, len(operators))
+	for i := 0; i < len(operators); i++ {
+		wg.Add(1)
+		go consume(jobs, &wg, results)
+	}
+	wg.Wait()
+	close(results)
+
+	seen := map[string]bool{}
+	for m := range results {
+		if seen[m.Sink] {
+			t.Errorf("result of %s received twice", m.Sink)
+		}
+		seen[m.Sink] = true
+		if m.Result != m.Sink {
+			t.Errorf("result %s not matched to its operator %s", m.Result, m.Sink)
+		}
+		if (m.Error != nil) != (m.Sink == "failing") {
+			t.Errorf("unexpected error of %s: %v", m.Sink, m.Error)
+		}
+	}
+	for name := range latencies {
+		n, _ := calls.Load(name)
+		if !seen[name] || n == nil || atomic.LoadInt64(n.(*int64)) != 1 {
+			t.Errorf("operator %s not run exactly once with its result collected", name)
+		}
+	}
+}
+
+func TestErrorsAreCollectedUnderConcurrency(t *testing.T) {
+	f := withFakes(t)
+	f.s3.err = awserr.New("SlowDown", "throttled", nil)
+	f.cw.err = awserr.New("Throttling", "throttled", nil)
+	var batch []BatchEvent
+	for i := 0; i < 50; i++ {
+		batch = append(batch, BatchEvent{ID: fmt.Sprintf("message-%d", i), Event: reading(fmt.Sprintf("device-%d", i), 21.5)})
+	}
+	failures := processBatch(context.Background(), batch)
+	failed := map[string]bool{}
+	for _, failure := range failures {
+		failed[failure.ID] = true
+		if !strings.Contains(failure.Reason, "history: ") || !strings.Contains(failure.Reason, "metrics: ") || strings.Contains(failure.Reason, "dynamo: ") {
+			t.Errorf("%s: expected the history and metrics failures only, got %s", failure.ID, failure.Reason)
+		}
+	}
+	if len(failures) != len(batch) || len(failed) != len(batch) {
+		t.Errorf("expected a failure per event, got %d for %d events", len(failures), len(batch))
+	}
+	if len(f.dynamo.puts) != len(batch) {
+		t.Errorf("expected every event stored in DynamoDB, got %d", len(f.dynamo.puts))
+	}
+}
+
+func TestOnlyTheFailedRecordsAreReported(t *testing.T) {
+	f := withFakes(t)
+	sinks, reportBatchFailures = "dynamo", true
+	f.dynamo.throttled = "930129302"
+	queue := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "059f36b4-87a3-44ab-83d2-661975830a7d", Body: string(rawReading("381938912", 21.5))},
+		{MessageId: "2e1424d4-f796-459a-8184-9c92662be6da", Body: string(rawReading("930129302", 22.5))},
+		{MessageId: "8d4f0a3c-6a1e-4c55-9f0b-3b1f2d0e7a91", Body: "not a reading"},
+		{MessageId: "c5b2f1e0-2d7a-4b8e-a6c3-91e0f4d5b217", Body: string(rawReading("381938912", 23.5))},
+	}}
+	response, err := sqsHandler(context.Background(), queue)
+	if err != nil {
+		t.Fatalf("batch failed as a whole: %v", err)
+	}
+	var ids []string
+	for _, failure := range response.BatchItemFailures {
+		ids = append(ids, failure.ItemIdentifier)
+	}
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "2e1424d4-f796-459a-8184-9c92662be6da,8d4f0a3c-6a1e-4c55-9f0b-3b1f2d0e7a91" {
+		t.Errorf("expected the throttled and the invalid messages reported, got %v", ids)
+	}
+
+	stream := events.KinesisEvent{Records: []events.KinesisEventRecord{
+		{EventID: "shardId-000000000000:49590338271490256608559692538361571095921575989136588801", Kinesis: events.KinesisRecord{SequenceNumber: "49590338271490256608559692538361571095921575989136588801", Data: rawReading("930129302", 21.5)}},
+		{EventID: "shardId-000000000000:49590338271490256608559692538361571095921575989136588802", Kinesis: events.KinesisRecord{SequenceNumber: "49590338271490256608559692538361571095921575989136588802", Data: rawReading("381938912", 22.5)}},
+	}}
+	kinesisResponse, err := kinesisHandler(context.Background(), stream)
+	if err != nil {
+		t.Fatalf("stream batch failed as a whole: %v", err)
+	}
+	if failures := kinesisResponse.BatchItemFailures; len(failures) != 1 || failures[0].ItemIdentifier != "49590338271490256608559692538361571095921575989136588801" {
+		t.Errorf("expected the sequence number of the throttled record reported, got %+v", failures)
+	}
+	if len(f.dynamo.puts) != 3 {
+		t.Errorf("expected the successful records stored, got %d items", len(f.dynamo.puts))
+	}
+
+	// without the reporting, a failure fails the whole batch
+	reportBatchFailures = false
+	response, err = sqsHandler(context.Background(), queue)
+	if err == nil || len(response.BatchItemFailures) != 0 {
+		t.Errorf("expected the batch failed as a whole, got %v and %+v", err, response.BatchItemFailures)
+	}
+}
+
+func TestAlarmFiresOnCrossingsOnly(t *testing.T) {
+	f := withFakes(t)
+	topicSaved, highSaved, lowSaved, stateSaved := alarmTopic, alarmHighLimits, alarmLowLimits, alarmState
+	t.Cleanup(func() {
+		alarmTopic, alarmHighLimits, alarmLowLimits, alarmState = topicSaved, highSaved, lowSaved, stateSaved
+	})
+	sinks, alarmTopic, alarmState = "alarm", "alarms/building-1", &AlarmState{crossed: make(map[string]string)}
+	alarmHighLimits, _ = parseThresholds("temperature=30")
+	alarmLowLimits, _ = parseThresholds("temperature=10, humidity=20")
+
+	steps := []struct {
+		name   string
+		temp   float64
+		alarms []string
+	}{
+		{"within the limits", 25, nil},
+		{"crossing up", 31, []string{"alarm high"}},
+		{"staying high", 33, nil},
+		{"crossing back down", 28, []string{"ok high"}},
+		{"crossing the low limit", 5, []string{"alarm low"}},
+		{"jumping from low to high", 35, []string{"ok low", "alarm high"}},
+	}
+	for _, step := range steps {
+		published := len(f.iot.inputs)
+		if err := handler(context.Background(), rawReading("381938912", step.temp)); err != nil {
+			t.Fatalf("%s: handler failed: %v", step.name, err)
+		}
+		var alarms []string
+		for _, input := range f.iot.inputs[published:] {
+			var alarm Alarm
+			if err := json.Unmarshal(input.Payload, &alarm); err != nil {
+				t.Fatalf("%s: invalid alarm %s", step.name, input.Payload)
+			}
+			if aws.StringValue(input.Topic) != alarmTopic || alarm.Device != "381938912" || alarm.Metric != "temperature" || alarm.Value != step.temp {
+				t.Errorf("%s: unexpected alarm %+v on %s", step.name, alarm, aws.StringValue(input.Topic))
+			}
+			alarms = append(alarms, alarm.State+" "+alarm.Limit)
+		}
+		if strings.Join(alarms, ",") != strings.Join(step.alarms, ",") {
+			t.Errorf("%s: expected %v, got %v", step.name, step.alarms, alarms)
+		}
+	}
+}
+
+func TestUnpublishedAlarmIsRaisedAgain(t *testing.T) {
+	f := withFakes(t)
+	topicSaved, highSaved, lowSaved, stateSaved := alarmTopic, alarmHighLimits, alarmLowLimits, alarmState
+	t.Cleanup(func() {
+		alarmTopic, alarmHighLimits, alarmLowLimits, alarmState = topicSaved, highSaved, lowSaved, stateSaved
+	})
+	sinks, alarmTopic, alarmState = "alarm", "alarms/building-1", &AlarmState{crossed: make(map[string]string)}
+	alarmHighLimits, _ = parseThresholds("temperature=30")
+	alarmLowLimits, _ = parseThresholds("temperature=10")
+	unavailable := awserr.New("ServiceUnavailableException", "unavailable", nil)
+
+	steps := []struct {
+		name   string
+		temp   float64
+		errs   []error
+		alarms []string
+	}{
+		{"crossing up, not published", 31, []error{unavailable}, nil},
+		{"staying high", 32, nil, []string{"alarm high"}},
+		{"jumping low, the alarm not published", 5, []error{nil, unavailable}, []string{"ok high"}},
+		{"staying low", 6, nil, []string{"alarm low"}},
+		{"staying low again", 7, nil, nil},
+	}
+	for _, step := range steps {
+		published := len(f.iot.inputs)
+		f.iot.errs = step.errs
+		handler(context.Background(), rawReading("381938912", step.temp))
+		var alarms []string
+		for _, input := range f.iot.inputs[published:] {
+			var alarm Alarm
+			if err := json.Unmarshal(input.Payload, &alarm); err != nil {
+				t.Fatalf("%s: invalid alarm %s", step.name, input.Payload)
+			}
+			alarms = append(alarms, alarm.State+" "+alarm.Limit)
+		}
+		if strings.Join(alarms, ",") != strings.Join(step.alarms, ",") {
+			t.Errorf("%s: expected %v, got %v", step.name, step.alarms, alarms)
+		}
+	}
+}
+
+func TestParseThresholds(t *testing.T) {
+	thresholds, err := parseThresholds(" temperature=30.5 ,humidity=80,")
+	if err != nil || len(thresholds) != 2 || thresholds["temperature"] != 30.5 || thresholds["humidity"] != 80 {
+		t.Errorf("unexpected thresholds %v: %v", thresholds, err)
+	}
+	for _, invalid := range []string{"temperature", "voltage=3", "temperature=hot"} {
+		if _, err := parseThresholds(invalid); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+func TestTagsAreCarriedToS3AndDynamoDB(t *testing.T) {
+	f := withFakes(t)
+	event := `{"body":{"device":"381938912","temperature":21.5,"humidity":40,"action":"Monitor","tags":{"env":"prod","floor":"3","bad key":"kept"}}}`
+	if err := handler(context.Background(), json.RawMessage(event)); err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if len(f.dynamo.puts) != 1 || len(f.s3.inputs) != 1 {
+		t.Fatalf("expected one item and one history object, got %d and %d", len(f.dynamo.puts), len(f.s3.inputs))
+	}
+	metadata := f.s3.inputs[0].Metadata
+	if len(metadata) != 2 || aws.StringValue(metadata["tag-env"]) != "prod" || aws.StringValue(metadata["tag-floor"]) != "3" {
+		t.Errorf("expected the valid tags as object metadata, got %v", aws.StringValueMap(metadata))
+	}
+	var body IoTEvent
+	if err := json.Unmarshal([]byte(f.s3.bodies[0]), &body); err != nil || body.Body == nil || len(body.Body.Tags) != 3 || body.Body.Tags["bad key"] != "kept" {
+		t.Errorf("expected every tag in the history object: %s", f.s3.bodies[0])
+	}
+	tags := f.dynamo.puts[0].Item["tags"]
+	if tags == nil || len(tags.M) != 3 || aws.StringValue(tags.M["env"].S) != "prod" || aws.StringValue(tags.M["floor"].S) != "3" {
+		t.Errorf("expected the tags as a nested map of the item, got %v", tags)
+	}
+}
+
+func TestClockSkewPolicies(t *testing.T) {
+	withFakes(t)
+	skewSaved, policySaved := maxClockSkew, clockSkewPolicy
+	t.Cleanup(func() { maxClockSkew, clockSkewPolicy = skewSaved, policySaved })
+	maxClockSkew = 5 * time.Minute
+	now := time.Unix(1700000000, 0)
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	skewMs := int64(maxClockSkew / time.Millisecond)
+	future, ancient, within := nowMs+int64(time.Hour/time.Millisecond), nowMs-int64(24*time.Hour/time.Millisecond), nowMs-60000
+	cases := []struct {
+		policy    string
+		timestamp int64
+		expected  int64
+		rejected  bool
+	}{
+		{"server-time", future, nowMs, false},
+		{"server-time", ancient, nowMs, false},
+		{"clamp", future, nowMs + skewMs, false},
+		{"clamp", ancient, nowMs - skewMs, false},
+		{"reject", future, future, true},
+		{"reject", ancient, ancient, true},
+		{"reject", within, within, false},
+	}
+	for _, c := range cases {
+		clockSkewPolicy = c.policy
+		event := IoTEvent{Body: &Information{Device: "381938912", Timestamp: c.timestamp}}
+		err := handleClockSkew(event, now)
+		if (err != nil) != c.rejected || event.Body.Timestamp != c.expected {
+			t.Errorf("%s of %d: expected timestamp %d and rejection %t, got %d and %v", c.policy, c.timestamp, c.expected, c.rejected, event.Body.Timestamp, err)
+		}
+	}
+}
+
+func TestClockSkewIsCountedAndRejected(t *testing.T) {
+	f := withFakes(t)
+	skewSaved, policySaved := maxClockSkew, clockSkewPolicy
+	t.Cleanup(func() { maxClockSkew, clockSkewPolicy = skewSaved, policySaved })
+	maxClockSkew, clockSkewPolicy = 5*time.Minute, "reject"
+	future := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	event := fmt.Sprintf(`{"body":{"device":"381938912","temperature":21.5,"humidity":40,"action":"Monitor","timestamp":%d}}`, future)
+	if err := handler(context.Background(), json.RawMessage(event)); err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if names := f.cw.metricNames(); strings.Join(names, ",") != "ClockSkewDetected,InvalidEvents" {
+		t.Errorf("expected the skew counted and the event rejected, got %v", names)
+	}
+	if len(f.dynamo.puts) != 0 || len(f.s3.inputs) != 0 {
+		t.Errorf("future-dated event stored")
+	}
+}
+
+func TestPartitionKeyStrategies(t *testing.T) {
+	event := IoTEvent{Body: &Information{Device: "381938912", Building: "7"}}
+	cases := []struct {
+		strategy string
+		key      string
+	}{
+		{"none", ""},
+		{"device", "381938912"},
+		{"building", "7"},
+		{"building+device", "7/381938912"},
+	}
+	for _, c := range cases {
+		if err := validPartitionStrategy(c.strategy); err != nil {
+			t.Errorf("%s: rejected: %v", c.strategy, err)
+		}
+		if key := partitionKey(event, c.strategy); key != c.key {
+			t.Errorf("%s: expected %q, got %q", c.strategy, c.key, key)
+		}
+	}
+	if key := partitionKey(IoTEvent{Body: &Information{Device: "381938912"}}, "building"); key != "unknown" {
+		t.Errorf("expected the unknown building, got %q", key)
+	}
+	random := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		key := partitionKey(event, "random+device")
+		parts := strings.Split(key, "/")
+		if len(parts) != 2 || len(parts[0]) != 4 || parts[1] != "381938912" {
+			t.Fatalf("unexpected random key %q", key)
+		}
+		random[parts[0]] = true
+	}
+	if len(random) < 2 {
+		t.Errorf("expected the random keys spread, got %v", random)
+	}
+	if err := validPartitionStrategy("device+shard"); err == nil {
+		t.Error("expected an unknown component rejected")
+	}
+}
+
+func TestHistoryObjectIsKeyedUnderThePartition(t *testing.T) {
+	f := withFakes(t)
+	sinks, partitionStrategy = "history", "device"
+	if err := handler(context.Background(), rawReading("381938912", 21.5)); err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if len(f.s3.inputs) != 1 || !strings.HasPrefix(aws.StringValue(f.s3.inputs[0].Key), "381938912/") {
+		t.Errorf("expected the history object under the device prefix, got %v", f.s3.inputs)
+	}
+}
+
+func TestEventShapes(t *testing.T) {
+	cases := []struct {
+		name  string
+		event string
+	}{
+		{"nested", `{"body":{"device":"381938912","temperature":21.5,"humidity":40,"action":"Monitor"}}`},
+		{"nested with the rule fields", `{"topic":"monitoring-device/building-1","timestamp":1700000000000,"body":{"device":"381938912","temperature":21.5,"humidity":40,"action":"Monitor"}}`},
+		{"rule envelope", `{"topic":"monitoring-device/building-1","timestamp":1700000000000,"payload":{"device":"381938912","temperature":21.5,"humidity":40,"action":"Monitor"}}`},
+		{"flat", `{"device":"381938912","temperature":21.5,"humidity":40,"action":"Monitor"}`},
+	}
+	for _, c := range cases {
+		event, err := decodeEvent([]byte(c.event))
+		if err != nil {
+			t.Errorf("%s: not decoded: %v", c.name, err)
+			continue
+		}
+		if event.Body == nil || event.Body.Device != "381938912" || event.Body.Temp != 21.5 || event.Body.Action != "Monitor" {
+			t.Errorf("%s: unexpected reading %+v", c.name, event.Body)
+		}
+	}
+	for _, unrecognized := range []string{`{}`, `{"payload":{"device":"381938912"}}`, `{"topic":"monitoring-device/building-1","reading":{"device":"381938912"}}`} {
+		if _, err := decodeEvent([]byte(unrecognized)); err == nil || !strings.Contains(err.Error(), "unrecognized event") {
+			t.Errorf("%s: expected the unrecognized event error, got %v", unrecognized, err)
+		}
+	}
+}
+
+func TestCorrelationIDIsStoredWithTheReading(t *testing.T) {
+	f := withFakes(t)
+	event := `{"body":{"device":"381938912","temperature":21.5,"humidity":40,"action":"Monitor","correlation_id":"9f2c4e1ab37d0c55"}}`
+	if err := handler(context.Background(), json.RawMessage(event)); err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if len(f.dynamo.puts) != 1 || aws.StringValue(f.dynamo.puts[0].Item["correlation_id"].S) != "9f2c4e1ab37d0c55" {
+		t.Fatalf("expected the correlation_id in the item, got %v", f.dynamo.puts)
+	}
+	if len(f.s3.bodies) != 1 || !strings.Contains(f.s3.bodies[0], `"correlation_id":"9f2c4e1ab37d0c55"`) {
+		t.Errorf("expected the correlation_id in the history object, got %v", f.s3.bodies)
+	}
+}
+
+func TestHighResolutionOfTheSelectedDevices(t *testing.T) {
+	f := withFakes(t)
+	setSaved, regexpSaved, allSaved, devicesSaved, patternSaved := highResSet, highResRegexp, highResMetrics, highResDevices, highResPattern
+	t.Cleanup(func() {
+		highResSet, highResRegexp, highResMetrics, highResDevices, highResPattern = setSaved, regexpSaved, allSaved, devicesSaved, patternSaved
+	})
+	sinks, highResMetrics = "metrics", false
+	highResSet, highResRegexp = parseDeviceList(" 381938912, 573920193,"), regexp.MustCompile(`^critical-`)
+	cases := []struct {
+		device     string
+		resolution int64
+	}{
+		{"381938912", 1},
+		{"573920193", 1},
+		{"critical-7", 1},
+		{"930129302", 0},
+	}
+	for _, c := range cases {
+		published := len(f.cw.inputs)
+		if err := handler(context.Background(), rawReading(c.device, 21.5)); err != nil {
+			t.Fatalf("%s: handler failed: %v", c.device, err)
+		}
+		for _, input := range f.cw.inputs[published:] {
+			for _, datum := range input.MetricData {
+				if resolution := aws.Int64Value(datum.StorageResolution); resolution != c.resolution {
+					t.Errorf("%s: %s stored at resolution %d, expected %d", c.device, aws.StringValue(datum.MetricName), resolution, c.resolution)
+				}
+			}
+		}
+	}
+
+	for _, selector := range []struct{ devices, pattern, problem string }{
+		{" , ", "", "no device in the high resolution devices"},
+		{"", "critical-[", "invalid high resolution device pattern"},
+	} {
+		highResDevices, highResPattern = selector.devices, selector.pattern
+		found := false
+		for _, problem := range validateConfig() {
+			found = found || problem != nil && strings.Contains(problem.Error(), selector.problem)
+		}
+		if !found {
+			t.Errorf("%q %q: expected the problem %q", selector.devices, selector.pattern, selector.problem)
+		}
+	}
+}
+
+func TestBatchRecordsOfTheSameSecondAllPersist(t *testing.T) {
+	f := withFakes(t)
+	_, err := kinesisHandler(context.Background(), events.KinesisEvent{Records: []events.KinesisEventRecord{
+		{EventID: "shardId-000000000000:49590338271490256608559692538361571095921575989136588801", Kinesis: events.KinesisRecord{SequenceNumber: "49590338271490256608559692538361571095921575989136588801", Data: rawReading("381938912", 21.5)}},
+		{EventID: "shardId-000000000000:49590338271490256608559692538361571095921575989136588802", Kinesis: events.KinesisRecord{SequenceNumber: "49590338271490256608559692538361571095921575989136588802", Data: rawReading("381938912", 22.5)}},
+	}})
+	if err != nil {
+		t.Fatalf("kinesis handler failed: %v", err)
+	}
+	_, err = sqsHandler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "059f36b4-87a3-44ab-83d2-661975830a7d", Body: string(rawReading("381938912", 23.5))},
+		{MessageId: "2e1424d4-f796-459a-8184-9c92662be6da", Body: string(rawReading("381938912", 24.5))},
+	}})
+	if err != nil {
+		t.Fatalf("sqs handler failed: %v", err)
+	}
+	digests := map[string]bool{}
+	for _, put := range f.dynamo.puts {
+		digests[aws.StringValue(put.Item["digest"].S)] = true
+	}
+	if len(f.dynamo.puts) != 4 || len(digests) != 4 {
+		t.Errorf("expected 4 items under 4 digests, got %d under %v", len(f.dynamo.puts), digests)
+	}
+	keys := map[string]bool{}
+	for _, input := range f.s3.inputs {
+		keys[aws.StringValue(input.Key)] = true
+	}
+	if len(f.s3.inputs) != 4 || len(keys) != 4 {
+		t.Errorf("expected 4 history objects under 4 keys, got %d under %v", len(f.s3.inputs), keys)
+	}
+}
+
+func TestRecordKey(t *testing.T) {
+	start := time.Unix(1700000000, 123*int64(time.Millisecond))
+	reading := IoTEvent{Body: &Information{Device: "381938912"}}
+	correlated := IoTEvent{Body: &Information{Device: "381938912", CorrelationID: "9f2c4e1ab37d0c55"}}
+	cases := []struct {
+		event  IoTEvent
+		record string
+		key    string
+	}{
+		{correlated, "059f36b4", "059f36b4"},
+		{correlated, "", "9f2c4e1ab37d0c55"},
+		{reading, "", "1700000000-381938912-1700000000123"},
+		{IoTEvent{}, "", "1700000000--1700000000123"},
+	}
+	for _, c := range cases {
+		if key := recordKey(c.event, c.record, start); key != c.key {
+			t.Errorf("expected key %s, got %s", c.key, key)
+		}
+	}
+}
+
+func TestRedeliveredRecordIsStoredUnderTheSameKey(t *testing.T) {
+	record := "shardId-000000000000:49590338271490256608559692538361571095921575989136588801"
+	first, redelivered := time.Unix(1700000000, 0), time.Unix(1700000097, 450*int64(time.Millisecond))
+	if a, b := recordKey(IoTEvent{}, record, first), recordKey(IoTEvent{}, record, redelivered); a != b {
+		t.Errorf("expected the redelivery under the key of the first delivery, got %s and %s", a, b)
+	}
+
+	f := withFakes(t)
+	sinks = "history,dynamo"
+	batch := events.KinesisEvent{Records: []events.KinesisEventRecord{
+		{EventID: record, Kinesis: events.KinesisRecord{SequenceNumber: "49590338271490256608559692538361571095921575989136588801", Data: rawReading("381938912", 21.5)}},
+	}}
+	for i := 0; i < 2; i++ {
+		if _, err := kinesisHandler(context.Background(), batch); err != nil {
+			t.Fatalf("kinesis handler failed: %v", err)
+		}
+	}
+	if len(f.dynamo.puts) != 2 || aws.StringValue(f.dynamo.puts[0].Item["digest"].S) != record || aws.StringValue(f.dynamo.puts[1].Item["digest"].S) != record {
+		t.Errorf("expected both deliveries written to the digest %s", record)
+	}
+	if len(f.s3.inputs) != 2 || aws.StringValue(f.s3.inputs[0].Key) != aws.StringValue(f.s3.inputs[1].Key) {
+		t.Errorf("expected both deliveries written to the same history object")
+	}
+}
+
+func TestLatestUpdateIsRetriedWhenThrottled(t *testing.T) {
+	f := withFakes(t)
+	dynamoMode = "latest"
+	dynamoRetry = dynamo.RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond}
+	f.dynamo.errs = []error{awserr.New("ProvisionedThroughputExceededException", "throttled", nil)}
+	if err := handler(context.Background(), rawReading("381938912", 21.5)); err != nil {
+		t.Fatalf("throttled update not retried: %v", err)
+	}
+	if len(f.dynamo.updates) != 1 || aws.StringValue(f.dynamo.updates[0].Key["digest"].S) != "381938912" {
+		t.Errorf("expected the latest item of the device updated once, got %d updates", len(f.dynamo.updates))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"siot/internal/logging"
+)
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+const (
+	EXTENSION_NAME     = "worker-shutdown-flush"
+	EXTENSION_API      = "2020-01-01/extension"
+	EXTENSION_ID_HDR   = "Lambda-Extension-Identifier"
+	EXTENSION_NAME_HDR = "Lambda-Extension-Name"
+)
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// register an internal extension with the Lambda Extensions API, since the runtime receives the SIGTERM of the
+// shutdown only if at least one extension is registered; it subscribes to no event, so it only waits on next
+func registerExtension(api string) error {
+	url := fmt.Sprintf("http://%s/%s", api, EXTENSION_API)
+	req, _ := http.NewRequest(http.MethodPost, url+"/register", bytes.NewBufferString(`{"events":[]}`))
+	req.Header.Set(EXTENSION_NAME_HDR, EXTENSION_NAME)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("extension registration answered %s", res.Status)
+	}
+	id := res.Header.Get(EXTENSION_ID_HDR)
+	go func() {
+		next, _ := http.NewRequest(http.MethodGet, url+"/event/next", nil)
+		next.Header.Set(EXTENSION_ID_HDR, id)
+		if res, err := http.DefaultClient.Do(next); err == nil {
+			res.Body.Close()
+		}
+	}()
+	return nil
+}
+
+// write what is still buffered in the container: the aggregated metrics and the log lines
+func flushBuffers() {
+	if err := flushMetrics(); err != nil {
+		log.Errorf("Error in flush of the aggregated metrics: %s", err)
+	}
+	logging.Flush()
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// flush the buffers when the container is shut down, instead of losing them with the container
+func flushOnShutdown() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM)
+	if api := os.Getenv("AWS_LAMBDA_RUNTIME_API"); strings.Compare(api, "") != 0 {
+		if err := registerExtension(api); err != nil {
+			log.Warnf("Failed to register the shutdown extension, buffers may be lost on shutdown: %s", err)
+		}
+	}
+	go awaitShutdown(stop, os.Exit)
+}
+
+// wait for the shutdown signal, flush the buffers and exit
+func awaitShutdown(stop <-chan os.Signal, exit func(int)) {
+	sig := <-stop
+	log.Infof("Received %s, flushing the buffers before shutdown", sig)
+	flushBuffers()
+	exit(0)
+}
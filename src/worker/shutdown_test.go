@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// ****************************************************
+// ********************* TESTS ************************
+// ****************************************************
+
+func TestShutdownFlushesTheAggregatedMetrics(t *testing.T) {
+	f := withFakes(t)
+	aggregationSaved, sizeSaved, intervalSaved, windowSaved := metricAggregation, metricWindowSize, metricFlushInterval, metricWindow
+	t.Cleanup(func() {
+		metricAggregation, metricWindowSize, metricFlushInterval, metricWindow = aggregationSaved, sizeSaved, intervalSaved, windowSaved
+	})
+	metricAggregation, metricWindowSize, metricFlushInterval = "statset", 100, time.Hour
+	metricWindow = &MetricWindow{devices: make(map[string]*DeviceWindow)}
+	sinks = "metrics"
+	for _, temp := range []float64{21.5, 22.5, 23.5} {
+		if err := handler(context.Background(), rawReading("381938912", temp)); err != nil {
+			t.Fatalf("handler failed: %v", err)
+		}
+	}
+	if names := f.cw.metricNames(); len(names) != 0 {
+		t.Fatalf("window flushed before the shutdown: %v", names)
+	}
+
+	stop := make(chan os.Signal, 1)
+	stop <- syscall.SIGTERM
+	exited := -1
+	awaitShutdown(stop, func(code int) { exited = code })
+	if exited != 0 {
+		t.Errorf("expected a clean exit after the flush, got %d", exited)
+	}
+	if names := f.cw.metricNames(); strings.Join(names, ",") != "Temperature,Humidity" {
+		t.Fatalf("expected the aggregated temperature and humidity flushed, got %v", names)
+	}
+	if count := *f.cw.inputs[0].MetricData[0].StatisticValues.SampleCount; count != 3 {
+		t.Errorf("expected the 3 readings of the window flushed, got %g", count)
+	}
+}
+
+func TestExtensionRegistration(t *testing.T) {
+	var mu sync.Mutex
+	var id, name string
+	next := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/" + EXTENSION_API + "/register":
+			name = r.Header.Get(EXTENSION_NAME_HDR)
+			w.Header().Set(EXTENSION_ID_HDR, "d07a4e1c-7c3b-4a4e-9f9e-5c0b1a2f3e4d")
+		case "/" + EXTENSION_API + "/event/next":
+			id = r.Header.Get(EXTENSION_ID_HDR)
+			next <- struct{}{}
+		}
+	}))
+	defer server.Close()
+	if err := registerExtension(strings.TrimPrefix(server.URL, "http://")); err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+	select {
+	case <-next:
+	case <-time.After(5 * time.Second):
+		t.Fatal("extension not waiting on the next event")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if name != EXTENSION_NAME || id != "d07a4e1c-7c3b-4a4e-9f9e-5c0b1a2f3e4d" {
+		t.Errorf("expected the extension registered by name and waiting under its id, got %q and %q", name, id)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ****************************************************
+// ******************** STRUCT ************************
+// ****************************************************
+
+// type of StatsD, UDP endpoint of the statsd sink shared by the concurrent events, dialed on the first one
+type StatsD struct {
+	mu     sync.Mutex
+	addr   string
+	prefix string
+	conn   net.Conn
+}
+
+// ****************************************************
+// ******************* VARS & CONS ********************
+// ****************************************************
+
+const (
+	STATSD_PREFIX = "siot"
+)
+
+// characters with a meaning in the DogStatsD line format, not allowed in a tag
+var statsdReplacer = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_")
+
+// ****************************************************
+// ********************* HELPERS **********************
+// ****************************************************
+
+// tags in the DogStatsD format, only the ones with a value
+func statsdTags(pairs [][2]string) string {
+	var tags []string
+	for _, tag := range pairs {
+		if strings.Compare(tag[1], "") == 0 {
+			continue
+		}
+		tags = append(tags, tag[0]+":"+statsdReplacer.Replace(tag[1]))
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+// lines of the gauges of the reading and of the counter of the processed events, e.g. siot.temperature:21.5|g|#device:1
+func statsdLines(prefix string, body *Information) []string {
+	pairs := [][2]string{{"device", body.Device}, {"building", body.Building}, {"fw_version", body.FirmwareVersion}}
+	tags := statsdTags(pairs)
+	gauge := func(name string, value float64) string {
+		return fmt.Sprintf("%s.%s:%s|g%s", prefix, name, strconv.FormatFloat(value, 'f', -1, 64), tags)
+	}
+	lines := []string{gauge("temperature", body.Temp), gauge("humidity", body.Hum)}
+	if body.Pressure != 0 {
+		lines = append(lines, gauge("pressure", body.Pressure))
+	}
+	counterTags := statsdTags(append(pairs, [2]string{"action", body.Action}))
+	return append(lines, fmt.Sprintf("%s.events.processed:1|c%s", prefix, counterTags))
+}
+
+// send the lines in a single datagram, dialing the endpoint on the first call; UDP only fails locally,
+// a missing listener is not reported
+func (s *StatsD) Send(lines []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := net.Dial("udp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	_, err := s.conn.Write([]byte(strings.Join(lines, "\n")))
+	return err
+}
+
+// ****************************************************
+// ****************** CORE FUNCTION *******************
+// ****************************************************
+
+// send the gauges of the reading and the processing counter to the StatsD endpoint, alongside or instead of CloudWatch
+func emitStatsD(m *Job, r chan *Job) {
+	err := statsdOutput.Send(statsdLines(statsdOutput.prefix, m.Event.Body))
+	if err != nil {
+		log.Errorf("Error in send to statsd %s: %s", statsdOutput.addr, err)
+	}
+	r <- &Job{Event: m.Event, Now: m.Now, Result: m.Event.Body.Action, Error: sinkError("statsd", err)}
+}
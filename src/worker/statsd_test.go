@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ****************************************************
+// ********************* TESTS ************************
+// ****************************************************
+
+func TestStatsDSinkEmitsTaggedLines(t *testing.T) {
+	withFakes(t)
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	outputSaved := statsdOutput
+	t.Cleanup(func() { statsdOutput = outputSaved })
+	statsdOutput = &StatsD{addr: listener.LocalAddr().String(), prefix: STATSD_PREFIX}
+	sinks = "statsd"
+
+	event := `{"body":{"device":"381938912","building":"1","temperature":21.5,"humidity":40,"action":"Monitor","fw_version":"1.4.2"}}`
+	if err := handler(context.Background(), json.RawMessage(event)); err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	buffer := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := listener.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("no datagram received: %v", err)
+	}
+	expected := []string{
+		"siot.temperature:21.5|g|#device:381938912,building:1,fw_version:1.4.2",
+		"siot.humidity:40|g|#device:381938912,building:1,fw_version:1.4.2",
+		"siot.events.processed:1|c|#device:381938912,building:1,fw_version:1.4.2,action:Monitor",
+	}
+	if lines := string(buffer[:n]); lines != strings.Join(expected, "\n") {
+		t.Errorf("unexpected lines:\n%s", lines)
+	}
+}
+
+func TestStatsDTagsAreSanitized(t *testing.T) {
+	lines := statsdLines("siot", &Information{Device: "381938912", Building: "north|1,#2", Temp: 21.5, Hum: 40, Pressure: 1013.25, Action: "Monitor"})
+	if len(lines) != 4 || lines[2] != "siot.pressure:1013.25|g|#device:381938912,building:north_1__2" {
+		t.Errorf("expected the pressure gauge and the separators replaced in the tags, got %v", lines)
+	}
+}